@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fivebillionmph/be227a/client"
+	"strings"
+	"time"
+)
+
+func commandAdminUsers(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("admin-users", flag.ExitOnError)
+	query := flags.String("q", "", "name or organization")
+	flags.Parse(args)
+
+	users, err := c.AdminUsers(*query)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		state := "active"
+		if !user.Active {
+			state = "inactive"
+		}
+		fmt.Printf("%d %s (%s) [%s] %s\n%s\n", user.Id, user.Name, user.Organization, state, strings.Join(user.Roles, ","), user.Public_key)
+	}
+	return nil
+}
+
+/* the admin actions that target a user by public key */
+func commandAdminUser(c *client.Client, command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	user_file := flags.String("user", "", "file with the user's public key")
+	flags.Parse(args)
+
+	public_key, err := readKeyFile(*user_file)
+	if err != nil {
+		return err
+	}
+
+	var done string
+	switch command {
+	case "admin-deactivate":
+		err = c.AdminDeactivate(public_key)
+		done = "deactivated"
+	case "admin-reactivate":
+		err = c.AdminReactivate(public_key)
+		done = "reactivated"
+	case "admin-grant":
+		err = c.AdminGrantAdmin(public_key)
+		done = "granted"
+	case "admin-ungrant":
+		err = c.AdminRevokeAdmin(public_key)
+		done = "ungranted"
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(done)
+	return nil
+}
+
+func commandAdminSignature(c *client.Client, command string, args []string) error {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	id := flags.Int("id", 0, "signature id")
+	flags.Parse(args)
+
+	var err error
+	var done string
+	if command == "admin-delete-signature" {
+		err = c.AdminDeleteSignature(*id)
+		done = "deleted"
+	} else {
+		err = c.AdminRevokeSignature(*id)
+		done = "revoked"
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(done)
+	return nil
+}
+
+func commandAdminSessions(c *client.Client) error {
+	sessions, err := c.AdminSessions()
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		fmt.Printf("%s %s %s:%d last seen %s", session.Id, session.Name, session.IP, session.Port, time.Unix(int64(session.Lastcheck_timestamp), 0).Format(time.RFC3339))
+		if session.Observed_ip != session.IP {
+			fmt.Printf(" via %s", session.Observed_ip)
+		}
+		if session.Claimed_ip != "" && session.Claimed_ip != session.IP {
+			fmt.Printf(" claiming %s", session.Claimed_ip)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func commandAdminKillSession(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("admin-kill-session", flag.ExitOnError)
+	id := flags.String("id", "", "session id")
+	flags.Parse(args)
+
+	err := c.AdminKillSession(*id)
+	if err != nil {
+		return err
+	}
+	fmt.Println("killed")
+	return nil
+}
+
+func commandAdminChallenges(c *client.Client) error {
+	challenges, err := c.AdminChallenges()
+	if err != nil {
+		return err
+	}
+	for _, challenge := range challenges {
+		fmt.Printf("%s %s expires %s\n%s\n", challenge.Challenge_type, challenge.Scheme, time.Unix(int64(challenge.Expire_timestamp), 0).Format(time.RFC3339), challenge.Public_key)
+	}
+	return nil
+}
+
+func commandAdminAudit(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("admin-audit", flag.ExitOnError)
+	count := flags.Int("n", 0, "number of entries, 0 for the server default")
+	flags.Parse(args)
+
+	entries, err := c.AdminAuditLog(*count)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fmt.Printf("%s %s %s %s\n", time.Unix(int64(entry.Timestamp), 0).Format(time.RFC3339), entry.Action, entry.Target, entry.Details)
+	}
+	return nil
+}
+
+func commandAdminWebhooks(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("admin-webhooks", flag.ExitOnError)
+	count := flags.Int("n", 0, "number of deliveries, 0 for the server default")
+	flags.Parse(args)
+
+	deliveries, err := c.AdminWebhookDeliveries(*count)
+	if err != nil {
+		return err
+	}
+	for _, delivery := range deliveries {
+		fmt.Printf("%d %s %s %s %s attempts %d", delivery.Id, time.Unix(int64(delivery.Timestamp), 0).Format(time.RFC3339), delivery.Event_type, delivery.Url, delivery.Status, delivery.Attempts)
+		if delivery.Last_error != "" {
+			fmt.Printf(" last error %s", delivery.Last_error)
+		}
+		fmt.Println()
+	}
+	return nil
+}
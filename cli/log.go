@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"github.com/fivebillionmph/be227a/client"
+)
+
+func commandLogHead(c *client.Client) error {
+	tree_head, err := c.LogHead(0)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("size %d root %s\n", tree_head.Tree_size, base64.StdEncoding.EncodeToString(tree_head.Root_hash))
+	return nil
+}
+
+func commandLogProof(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("log-proof", flag.ExitOnError)
+	id := flags.Int("id", 0, "signature id")
+	flags.Parse(args)
+
+	log_proof, err := c.LogSignatureProof(*id, 0)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("signature %d is leaf %d of %d\n", *id, log_proof.Signature.Leaf_index, log_proof.Tree_head.Tree_size)
+	if log_proof.Revocation != nil {
+		fmt.Printf("revocation is leaf %d of %d\n", log_proof.Revocation.Leaf_index, log_proof.Tree_head.Tree_size)
+	}
+	return nil
+}
+
+func commandLogProofUser(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("log-proof-user", flag.ExitOnError)
+	user_file := flags.String("user", "", "file with the user's public key")
+	flags.Parse(args)
+
+	public_key, err := readKeyFile(*user_file)
+	if err != nil {
+		return err
+	}
+
+	log_proof, err := c.LogUserProof(public_key, 0)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("user %d is leaf %d of %d\n", log_proof.User.Entry.Item_id, log_proof.User.Leaf_index, log_proof.Tree_head.Tree_size)
+	return nil
+}
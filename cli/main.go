@@ -0,0 +1,569 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/fivebillionmph/be227a/client"
+	"github.com/fivebillionmph/be227a/protocol"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+const usage = `usage: cli [-server url] [-key file] [-server-key file] <command> [arguments]
+
+commands:
+  keygen [-algorithm rsa|ecdsa|ed25519]    create a private key at -key
+  pubkey                                   print the public key for -key
+  register -name name [-organization org]  register the public key for -key
+  deactivate                               deactivate the user for -key
+  admin-users [-q query]                   list users, including deactivated ones and their roles
+  admin-deactivate -user file              deactivate another user
+  admin-reactivate -user file              reactivate a deactivated user
+  admin-grant -user file                   give a user the admin role
+  admin-ungrant -user file                 take the admin role from a user
+  admin-delete-signature -id signature_id
+  admin-revoke-signature -id signature_id
+  admin-sessions                           list sessions with their ids
+  admin-kill-session -id session_id
+  admin-challenges                         list outstanding challenges
+  admin-audit [-n count]                   show the most recent admin actions
+  admin-webhooks [-n count]                show the most recent webhook deliveries
+  rotate -new-key file                     move the user from -key to an existing key file
+  session -port port [session options]     start a session and refresh it until interrupted
+  session-start -port port [session options]
+                                           start a session and print its token
+  session-refresh -token token             refresh a session and print its new token
+  session-stop -token token                stop a session
+  session-list -token token                list the user's sessions
+  session-end -token token -id session_id  end another of the user's sessions
+  sign -signee file [-start t] [-end t] [-check-server host] [-message-key k] [-modifiers m]
+  revoke -id signature_id [-reason text]
+  keys [-q query]
+  sessions [-q query] [-group]             -group lists each user's endpoints together
+  sessions-watch [-q query]                print sessions starting and stopping until interrupted
+  signatures -signee file [-federated] [-valid-only] [-scope message_key]
+  server-key                               print the key the server signs with
+  log-head                                 print the transparency log's current tree head
+  log-proof -id signature_id               check a signature, and its revocation, are in the log
+  log-proof-user -user file                check a user's registration is in the log
+
+session options are -label device, which replaces the user's session with
+the same label, -protocol name and -capabilities a,b,c.
+
+the admin commands need -key to be an admin key on the server.
+
+with -server-key, keys, sessions and signatures only accept responses signed
+with that key, the server must be run with SIGN_RESPONSES=1.
+`
+
+func main() {
+	server_url := flag.String("server", os.Getenv("KEY_SERVER"), "key server base url")
+	key_file := flag.String("key", os.Getenv("KEY_FILE"), "private key file")
+	server_key_file := flag.String("server-key", os.Getenv("KEY_SERVER_PUBLIC_KEY"), "file with the server's public key")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	command := flag.Arg(0)
+	args := flag.Args()[1:]
+
+	if command == "keygen" {
+		err := commandKeygen(*key_file, args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	c, err := newClient(*server_url, *key_file, command)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *server_key_file != "" {
+		err = pinServerKey(c, *server_key_file)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	switch command {
+	case "pubkey":
+		err = commandPubkey(c)
+	case "register":
+		err = commandRegister(c, args)
+	case "deactivate":
+		err = commandDeactivate(c)
+	case "admin-users":
+		err = commandAdminUsers(c, args)
+	case "admin-deactivate", "admin-reactivate", "admin-grant", "admin-ungrant":
+		err = commandAdminUser(c, command, args)
+	case "admin-delete-signature", "admin-revoke-signature":
+		err = commandAdminSignature(c, command, args)
+	case "admin-sessions":
+		err = commandAdminSessions(c)
+	case "admin-kill-session":
+		err = commandAdminKillSession(c, args)
+	case "admin-challenges":
+		err = commandAdminChallenges(c)
+	case "admin-audit":
+		err = commandAdminAudit(c, args)
+	case "admin-webhooks":
+		err = commandAdminWebhooks(c, args)
+	case "rotate":
+		err = commandRotate(c, args)
+	case "session":
+		err = commandSession(c, args)
+	case "session-start":
+		err = commandSessionStart(c, args)
+	case "session-refresh":
+		err = commandSessionRefresh(c, args)
+	case "session-stop":
+		err = commandSessionStop(c, args)
+	case "session-list":
+		err = commandSessionList(c, args)
+	case "session-end":
+		err = commandSessionEnd(c, args)
+	case "sign":
+		err = commandSign(c, args)
+	case "revoke":
+		err = commandRevoke(c, args)
+	case "keys":
+		err = commandKeys(c, args)
+	case "sessions":
+		err = commandSessions(c, args)
+	case "sessions-watch":
+		err = commandSessionsWatch(c, args)
+	case "signatures":
+		err = commandSignatures(c, args)
+	case "server-key":
+		err = commandServerKey(c)
+	case "log-head":
+		err = commandLogHead(c)
+	case "log-proof":
+		err = commandLogProof(c, args)
+	case "log-proof-user":
+		err = commandLogProofUser(c, args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+/* the read only queries and session refresh/stop don't need a key */
+func newClient(server_url string, key_file string, command string) (*client.Client, error) {
+	if server_url == "" && command != "pubkey" {
+		return nil, fmt.Errorf("server url not specified")
+	}
+
+	switch command {
+	case "keys", "sessions", "sessions-watch", "signatures", "session-refresh", "session-stop", "session-list", "session-end", "server-key", "log-head", "log-proof", "log-proof-user":
+		if key_file == "" {
+			return client.Client__new(server_url, nil), nil
+		}
+	}
+
+	if key_file == "" {
+		return nil, fmt.Errorf("key file not specified")
+	}
+	private_key, err := client.LoadPrivateKey(key_file)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.Client__new(server_url, private_key), nil
+}
+
+/* the server only reports its host name, the key has to match the pinned one */
+func pinServerKey(c *client.Client, server_key_file string) error {
+	pinned_key_str, err := readKeyFile(server_key_file)
+	if err != nil {
+		return err
+	}
+	pinned_key, err := protocol.StringToPublicKey(pinned_key_str)
+	if err != nil {
+		return err
+	}
+
+	server_key, err := c.ServerKey()
+	if err != nil {
+		return err
+	}
+	server_public_key, err := protocol.StringToPublicKey(server_key.Public_key)
+	if err != nil {
+		return err
+	}
+	pinned_key_pem, _ := protocol.PublicKeyToString(pinned_key)
+	server_key_pem, _ := protocol.PublicKeyToString(server_public_key)
+	if pinned_key_pem != server_key_pem {
+		return fmt.Errorf("server key does not match %s", server_key_file)
+	}
+
+	c.SetServerKey(server_key.Host_name, pinned_key)
+	return nil
+}
+
+func commandServerKey(c *client.Client) error {
+	server_key, err := c.ServerKey()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n%s", server_key.Host_name, server_key.Public_key)
+	return nil
+}
+
+func readKeyFile(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("public key file not specified")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)) + "\n", nil
+}
+
+func commandKeygen(key_file string, args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	algorithm := flags.String("algorithm", "ed25519", "rsa, ecdsa or ed25519")
+	flags.Parse(args)
+
+	if key_file == "" {
+		return fmt.Errorf("key file not specified")
+	}
+	if _, err := os.Stat(key_file); err == nil {
+		return fmt.Errorf("%s already exists", key_file)
+	}
+
+	private_key, err := client.GenerateKey(*algorithm)
+	if err != nil {
+		return err
+	}
+	err = client.SavePrivateKey(key_file, private_key)
+	if err != nil {
+		return err
+	}
+
+	public_key_string, err := protocol.PublicKeyToString(private_key.Public())
+	if err != nil {
+		return err
+	}
+	fmt.Print(public_key_string)
+	return nil
+}
+
+func commandPubkey(c *client.Client) error {
+	public_key_string, err := c.PublicKeyString()
+	if err != nil {
+		return err
+	}
+	fmt.Print(public_key_string)
+	return nil
+}
+
+func commandRegister(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("register", flag.ExitOnError)
+	name := flags.String("name", "", "user name")
+	organization := flags.String("organization", "", "organization")
+	flags.Parse(args)
+
+	err := c.Register(*name, *organization)
+	if err != nil {
+		return err
+	}
+	fmt.Println("registered")
+	return nil
+}
+
+func commandDeactivate(c *client.Client) error {
+	err := c.Deactivate()
+	if err != nil {
+		return err
+	}
+	fmt.Println("deactivated")
+	return nil
+}
+
+func commandRotate(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("rotate", flag.ExitOnError)
+	new_key_file := flags.String("new-key", "", "private key file to rotate to")
+	flags.Parse(args)
+
+	if *new_key_file == "" {
+		return fmt.Errorf("new key file not specified")
+	}
+	new_private_key, err := client.LoadPrivateKey(*new_key_file)
+	if err != nil {
+		return err
+	}
+
+	err = c.RotateKey(new_private_key)
+	if err != nil {
+		return err
+	}
+	fmt.Println("rotated")
+	return nil
+}
+
+type sessionFlags struct {
+	port         *int
+	label        *string
+	protocol     *string
+	capabilities *string
+}
+
+func addSessionFlags(flags *flag.FlagSet) sessionFlags {
+	return sessionFlags{
+		port:         flags.Int("port", 0, "port this client listens on"),
+		label:        flags.String("label", "", "device label"),
+		protocol:     flags.String("protocol", "", "protocol spoken on the port"),
+		capabilities: flags.String("capabilities", "", "comma separated capabilities"),
+	}
+}
+
+func (self sessionFlags) start(c *client.Client) (*client.Session, error) {
+	metadata := protocol.SessionMetadata{
+		Protocol:     *self.protocol,
+		Capabilities: make([]string, 0, 4),
+	}
+	for _, capability := range strings.Split(*self.capabilities, ",") {
+		capability = strings.TrimSpace(capability)
+		if capability != "" {
+			metadata.Capabilities = append(metadata.Capabilities, capability)
+		}
+	}
+
+	return c.StartLabeledSession(*self.port, *self.label, metadata)
+}
+
+func commandSession(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("session", flag.ExitOnError)
+	session_flags := addSessionFlags(flags)
+	flags.Parse(args)
+
+	session, err := session_flags.start(c)
+	if err != nil {
+		return err
+	}
+	fmt.Println(session.Id)
+
+	session.StartRefreshing(client.SESSION_REFRESH_INTERVAL, func(err error) {
+		log.Println("refresh failed:", err)
+	})
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+
+	return session.Stop()
+}
+
+func commandSessionStart(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("session-start", flag.ExitOnError)
+	session_flags := addSessionFlags(flags)
+	flags.Parse(args)
+
+	session, err := session_flags.start(c)
+	if err != nil {
+		return err
+	}
+	fmt.Println(session.Token)
+	return nil
+}
+
+func commandSessionRefresh(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("session-refresh", flag.ExitOnError)
+	token := flags.String("token", "", "session token")
+	flags.Parse(args)
+
+	session := c.Session(*token)
+	err := session.Refresh()
+	if err != nil {
+		return err
+	}
+	fmt.Println(session.Token)
+	return nil
+}
+
+func commandSessionStop(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("session-stop", flag.ExitOnError)
+	token := flags.String("token", "", "session token")
+	flags.Parse(args)
+
+	return c.Session(*token).Stop()
+}
+
+func commandSessionList(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("session-list", flag.ExitOnError)
+	token := flags.String("token", "", "session token")
+	flags.Parse(args)
+
+	sessions, err := c.Session(*token).Mine()
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		current := ""
+		if session.Current {
+			current = " (current)"
+		}
+		fmt.Printf("%s %q %s:%d %s last seen %s%s\n", session.Id, session.Label, session.IP, session.Port, session.Metadata.Protocol, time.Unix(int64(session.Lastcheck_timestamp), 0).Format(time.RFC3339), current)
+	}
+	return nil
+}
+
+func commandSessionEnd(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("session-end", flag.ExitOnError)
+	token := flags.String("token", "", "session token")
+	id := flags.String("id", "", "session id")
+	flags.Parse(args)
+
+	return c.Session(*token).End(*id)
+}
+
+func commandSign(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	signee_file := flags.String("signee", "", "file with the signee's public key")
+	start_time := flags.Int("start", int(time.Now().Unix()), "unix time the signature starts")
+	end_time := flags.Int("end", 0, "unix time the signature ends, 0 never ends")
+	check_server := flags.String("check-server", "", "server the signer is registered on")
+	message_key := flags.String("message-key", "identity", "what is being vouched for, see /a/message-keys")
+	modifiers := flags.String("modifiers", "", "json object of modifiers for the message key")
+	flags.Parse(args)
+
+	signee_public_key, err := readKeyFile(*signee_file)
+	if err != nil {
+		return err
+	}
+
+	message := protocol.VerifyMessage{
+		Start_time:   *start_time,
+		End_time:     *end_time,
+		Check_server: *check_server,
+		Message_key:  *message_key,
+		Modifiers:    *modifiers,
+	}
+	err = c.Sign(signee_public_key, message)
+	if err != nil {
+		return err
+	}
+	fmt.Println("signed")
+	return nil
+}
+
+func commandRevoke(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("revoke", flag.ExitOnError)
+	id := flags.Int("id", 0, "signature id")
+	reason := flags.String("reason", "", "reason for revoking")
+	flags.Parse(args)
+
+	err := c.Revoke(*id, *reason)
+	if err != nil {
+		return err
+	}
+	fmt.Println("revoked")
+	return nil
+}
+
+func commandKeys(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("keys", flag.ExitOnError)
+	query := flags.String("q", "", "name or organization")
+	flags.Parse(args)
+
+	users, err := c.Keys(*query)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		fmt.Printf("%s (%s)\n%s\n", user.Name, user.Organization, user.Public_key)
+	}
+	return nil
+}
+
+func commandSessions(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("sessions", flag.ExitOnError)
+	query := flags.String("q", "", "name or organization")
+	group := flags.Bool("group", false, "list each user's endpoints together")
+	flags.Parse(args)
+
+	if *group {
+		users, err := c.SessionsByUser(*query)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			fmt.Printf("%s (%s)\n", user.Name, user.Organization)
+			for _, endpoint := range user.Endpoints {
+				fmt.Printf("  %q %s:%d %s %s\n", endpoint.Label, endpoint.IP, endpoint.Port, endpoint.Metadata.Protocol, strings.Join(endpoint.Metadata.Capabilities, ","))
+			}
+		}
+		return nil
+	}
+
+	sessions, err := c.Sessions(*query)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		fmt.Printf("%s (%s) %s:%d %q\n", session.Name, session.Organization, session.IP, session.Port, session.Label)
+	}
+	return nil
+}
+
+func commandSessionsWatch(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("sessions-watch", flag.ExitOnError)
+	query := flags.String("q", "", "name or organization")
+	flags.Parse(args)
+
+	stop := make(chan bool)
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		close(stop)
+	}()
+
+	return c.WatchSessions(*query, stop, func(event client.SessionEvent) {
+		fmt.Printf("%s %s (%s) %s:%d %q\n", event.Event_type, event.Name, event.Organization, event.IP, event.Port, event.Label)
+	})
+}
+
+func commandSignatures(c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("signatures", flag.ExitOnError)
+	signee_file := flags.String("signee", "", "file with the signee's public key")
+	federated := flags.Bool("federated", false, "also ask federation peers")
+	valid_only := flags.Bool("valid-only", false, "only currently valid signatures")
+	scope := flags.String("scope", "", "message key, or a prefix like role:")
+	flags.Parse(args)
+
+	signee_public_key, err := readKeyFile(*signee_file)
+	if err != nil {
+		return err
+	}
+
+	signatures, err := c.Signatures(signee_public_key, *federated, *valid_only, *scope)
+	if err != nil {
+		return err
+	}
+	for _, signature := range signatures {
+		status := signature.Status
+		if signature.Revoked {
+			status = "revoked"
+		}
+		fmt.Printf("%d %s (%s) [%s %s] %s %s\n", signature.Id, signature.Signer.Name, signature.Signer.Organization, status, signature.Version, signature.Server, signature.Message)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"strconv"
+)
+
+/* the admin methods need the client's key to be an admin key on the server */
+
+type AdminUser struct {
+	Id           int      `json:"id"`
+	Name         string   `json:"name"`
+	Organization string   `json:"organization"`
+	Public_key   string   `json:"public_key"`
+	Active       bool     `json:"active"`
+	Roles        []string `json:"roles"`
+}
+
+type AdminSession struct {
+	Id                  string `json:"id"`
+	User_id             int    `json:"user_id"`
+	Name                string `json:"name"`
+	Start_timestamp     int    `json:"start_timestamp"`
+	Lastcheck_timestamp int    `json:"lastcheck_timestamp"`
+	IP                  string `json:"ip"`
+	Observed_ip         string `json:"observed_ip"`
+	Claimed_ip          string `json:"claimed_ip"`
+	Port                int    `json:"port"`
+	Label               string `json:"label"`
+}
+
+type AdminChallenge struct {
+	Public_key       string `json:"public_key"`
+	Challenge_type   string `json:"challenge_type"`
+	Scheme           string `json:"scheme"`
+	Start_timestamp  int    `json:"start_timestamp"`
+	Expire_timestamp int    `json:"expire_timestamp"`
+}
+
+type AuditEntry struct {
+	Id               int    `json:"id"`
+	Timestamp        int    `json:"timestamp"`
+	Admin_public_key string `json:"admin_public_key"`
+	Action           string `json:"action"`
+	Target           string `json:"target"`
+	Details          string `json:"details"`
+}
+
+/* Status is "pending", "delivered" or "failed" */
+type WebhookDelivery struct {
+	Id                     int    `json:"id"`
+	Timestamp              int    `json:"timestamp"`
+	Url                    string `json:"url"`
+	Event_type             string `json:"event_type"`
+	Payload                string `json:"payload"`
+	Status                 string `json:"status"`
+	Attempts               int    `json:"attempts"`
+	Next_attempt_timestamp int    `json:"next_attempt_timestamp"`
+	Last_attempt_timestamp int    `json:"last_attempt_timestamp"`
+	Last_status_code       int    `json:"last_status_code"`
+	Last_error             string `json:"last_error"`
+}
+
+/* includes deactivated users, query may be empty */
+func (self *Client) AdminUsers(query string) ([]AdminUser, error) {
+	json_response := struct {
+		Users []AdminUser `json:"users"`
+	}{}
+	err := self.admin("GET", "/a/admin/users", "list_users", query, &json_response)
+	if err != nil {
+		return nil, err
+	}
+	return json_response.Users, nil
+}
+
+func (self *Client) AdminDeactivate(public_key string) error {
+	return self.admin("PUT", "/a/admin/deactivate", "deactivate", public_key, nil)
+}
+
+func (self *Client) AdminReactivate(public_key string) error {
+	return self.admin("PUT", "/a/admin/reactivate", "reactivate", public_key, nil)
+}
+
+func (self *Client) AdminGrantAdmin(public_key string) error {
+	return self.admin("PUT", "/a/admin/role/grant", "grant_admin", public_key, nil)
+}
+
+func (self *Client) AdminRevokeAdmin(public_key string) error {
+	return self.admin("PUT", "/a/admin/role/revoke", "revoke_admin", public_key, nil)
+}
+
+func (self *Client) AdminDeleteSignature(signature_id int) error {
+	return self.admin("DELETE", "/a/admin/signature", "delete_signature", strconv.Itoa(signature_id), nil)
+}
+
+func (self *Client) AdminRevokeSignature(signature_id int) error {
+	return self.admin("PUT", "/a/admin/signature/revoke", "revoke_signature", strconv.Itoa(signature_id), nil)
+}
+
+func (self *Client) AdminKillSession(session_id string) error {
+	return self.admin("DELETE", "/a/admin/session", "kill_session", session_id, nil)
+}
+
+func (self *Client) AdminSessions() ([]AdminSession, error) {
+	json_response := struct {
+		Sessions []AdminSession `json:"sessions"`
+	}{}
+	err := self.admin("GET", "/a/admin/sessions", "list_sessions", "", &json_response)
+	if err != nil {
+		return nil, err
+	}
+	return json_response.Sessions, nil
+}
+
+func (self *Client) AdminChallenges() ([]AdminChallenge, error) {
+	json_response := struct {
+		Challenges []AdminChallenge `json:"challenges"`
+	}{}
+	err := self.admin("GET", "/a/admin/challenges", "list_challenges", "", &json_response)
+	if err != nil {
+		return nil, err
+	}
+	return json_response.Challenges, nil
+}
+
+/* newest first, limit 0 for the server's default */
+func (self *Client) AdminAuditLog(limit int) ([]AuditEntry, error) {
+	target := ""
+	if limit > 0 {
+		target = strconv.Itoa(limit)
+	}
+	json_response := struct {
+		Entries []AuditEntry `json:"entries"`
+	}{}
+	err := self.admin("GET", "/a/admin/audit", "list_audit", target, &json_response)
+	if err != nil {
+		return nil, err
+	}
+	return json_response.Entries, nil
+}
+
+/* newest first, limit 0 for the server default */
+func (self *Client) AdminWebhookDeliveries(limit int) ([]WebhookDelivery, error) {
+	target := ""
+	if limit > 0 {
+		target = strconv.Itoa(limit)
+	}
+	json_response := struct {
+		Deliveries []WebhookDelivery `json:"deliveries"`
+	}{}
+	err := self.admin("GET", "/a/admin/webhooks", "list_webhooks", target, &json_response)
+	if err != nil {
+		return nil, err
+	}
+	return json_response.Deliveries, nil
+}
@@ -0,0 +1,616 @@
+/*
+ * client for the key server's challenge, session and signing protocol.
+ */
+package client
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/fivebillionmph/be227a/protocol"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type Client struct {
+	base_url          string
+	private_key       crypto.Signer
+	http_client       *http.Client
+	server_host_name  string
+	server_public_key crypto.PublicKey // when set, query responses must be signed by it
+}
+
+type Challenge struct {
+	Message          string `json:"message"`
+	Index            int    `json:"index"`
+	Scheme           string `json:"scheme"`
+	Signature_scheme string `json:"signature_scheme"`
+	Server_signature string `json:"server_signature"`
+}
+
+/* offered in preference order, the legacy schemes are left out */
+var CHALLENGE_SCHEMES = []string{"encrypted_oaep", "signed_nonce"}
+var SIGNATURE_SCHEMES = []string{protocol.SIGNATURE_SCHEME_PSS}
+
+/* signed responses further than this from the local clock are refused, so an old answer can't be replayed */
+const RESPONSE_MAX_AGE = 5 * 60 // seconds
+
+type User struct {
+	Name         string `json:"name"`
+	Organization string `json:"organization"`
+	Public_key   string `json:"public_key"`
+}
+
+/*
+ * Public_key is the key that made the signature. if the signer has rotated
+ * since, Succession holds the statements leading from it to Current_public_key.
+ */
+type Signer struct {
+	Public_key         string       `json:"public_key"`
+	Current_public_key string       `json:"current_public_key"`
+	Succession         []Succession `json:"succession"`
+	Name               string       `json:"name"`
+	Organization       string       `json:"organization"`
+}
+
+/* a succession statement and the old key's base64 signature of it */
+type Succession struct {
+	Message   protocol.SuccessionMessage `json:"message"`
+	Signature string                     `json:"signature"`
+}
+
+type Signature struct {
+	Id                int    `json:"id"`
+	Signature         string `json:"signature"`
+	Message           string `json:"message"`
+	Signer            Signer `json:"signer"`
+	Revoked           bool   `json:"revoked"`
+	Revoked_timestamp int    `json:"revoked_timestamp"`
+	Status            string `json:"status"`
+	Version           string `json:"version"`
+	Server            string `json:"server"`
+}
+
+type PeerSession struct {
+	Name         string                       `json:"name"`
+	Organization string                       `json:"organization"`
+	IP           string                       `json:"ip"`
+	Port         int                          `json:"port"`
+	Public_key   string                       `json:"public_key"`
+	Label        string                       `json:"label"`
+	Metadata     protocol.SessionMetadata     `json:"metadata"`
+	Attestation  *protocol.SessionAttestation `json:"attestation"` // checked with VerifyPeer
+}
+
+type PeerEndpoint struct {
+	IP          string                       `json:"ip"`
+	Port        int                          `json:"port"`
+	Label       string                       `json:"label"`
+	Metadata    protocol.SessionMetadata     `json:"metadata"`
+	Attestation *protocol.SessionAttestation `json:"attestation"`
+}
+
+/* a user with their sessions' endpoints, from SessionsByUser */
+type PeerUser struct {
+	Name         string         `json:"name"`
+	Organization string         `json:"organization"`
+	Public_key   string         `json:"public_key"`
+	Endpoints    []PeerEndpoint `json:"endpoints"`
+}
+
+/* private_key may be nil for the read only queries */
+func Client__new(base_url string, private_key crypto.Signer) *Client {
+	return &Client{
+		base_url:    strings.TrimRight(base_url, "/"),
+		private_key: private_key,
+		http_client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (self *Client) PublicKeyString() (string, error) {
+	if self.private_key == nil {
+		return "", errors.New("no private key loaded")
+	}
+	return protocol.PublicKeyToString(self.private_key.Public())
+}
+
+/* sends request_body as json and decodes the json response into response if it's not nil */
+func (self *Client) do(method string, path string, request_body interface{}, response interface{}) error {
+	_, _, res_body, err := self.send(method, path, request_body)
+	if err != nil {
+		return err
+	}
+
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(res_body, response)
+}
+
+/* like do, but if a server key is set the response must carry a valid signature from it */
+func (self *Client) doSigned(method string, path string, request_body interface{}, response interface{}) error {
+	request_uri, header, res_body, err := self.send(method, path, request_body)
+	if err != nil {
+		return err
+	}
+
+	if self.server_public_key != nil {
+		signed_timestamp, err := protocol.VerifyResponse(self.server_public_key, self.server_host_name, request_uri, header, res_body)
+		if err != nil {
+			return err
+		}
+		age := int(time.Now().Unix()) - signed_timestamp
+		if age > RESPONSE_MAX_AGE || age < -RESPONSE_MAX_AGE {
+			return errors.New("signed response is too old or from the future")
+		}
+	}
+
+	return json.Unmarshal(res_body, response)
+}
+
+func (self *Client) send(method string, path string, request_body interface{}) (string, http.Header, []byte, error) {
+	var body bytes.Buffer
+	if request_body != nil {
+		err := json.NewEncoder(&body).Encode(request_body)
+		if err != nil {
+			return "", nil, nil, err
+		}
+	}
+
+	request, err := http.NewRequest(method, self.base_url+path, &body)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	request.Header.Set("Content-type", "application/json")
+
+	res, err := self.http_client.Do(request)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	defer res.Body.Close()
+
+	res_body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if res.StatusCode != 200 {
+		return "", nil, nil, errors.New(res.Status + ": " + strings.TrimSpace(string(res_body)))
+	}
+
+	return request.URL.RequestURI(), res.Header, res_body, nil
+}
+
+/* the server's key as it reports it, compare it with a key obtained out of band before trusting it */
+func (self *Client) ServerKey() (*protocol.ServerKey, error) {
+	server_key := protocol.ServerKey{}
+	err := self.do("GET", "/.well-known/keyserver-key", nil, &server_key)
+	if err != nil {
+		return nil, err
+	}
+	return &server_key, nil
+}
+
+/* after this, Keys, Sessions and Signatures fail unless the response is signed with public_key */
+func (self *Client) SetServerKey(host_name string, public_key crypto.PublicKey) {
+	self.server_host_name = host_name
+	self.server_public_key = public_key
+}
+
+func (self *Client) sign(message string) (string, error) {
+	if self.private_key == nil {
+		return "", errors.New("no private key loaded")
+	}
+
+	signature, err := protocol.Sign(self.private_key, message)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+/*
+ * recovers the nonce from a challenge and returns it signed. nonces for another
+ * purpose are refused, and once a server key is set so are nonces it didn't issue.
+ */
+func (self *Client) answerChallenge(challenge *Challenge, challenge_type string) (string, error) {
+	message, err := base64.StdEncoding.DecodeString(challenge.Message)
+	if err != nil {
+		return "", err
+	}
+
+	var nonce []byte
+	switch challenge.Scheme {
+	case "encrypted", "encrypted_oaep":
+		rsa_private_key, ok := self.private_key.(*rsa.PrivateKey)
+		if !ok {
+			return "", errors.New("encrypted challenge needs an rsa key")
+		}
+		if challenge.Scheme == "encrypted_oaep" {
+			nonce, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, rsa_private_key, message, nil)
+		} else {
+			nonce, err = rsa.DecryptPKCS1v15(rand.Reader, rsa_private_key, message)
+		}
+		if err != nil {
+			return "", err
+		}
+	case "signed_nonce":
+		/* sent in the clear, so only the server's signature shows it came from the server */
+		if self.server_public_key != nil {
+			server_signature, err := base64.StdEncoding.DecodeString(challenge.Server_signature)
+			if err != nil || !protocol.Verify(self.server_public_key, string(message), server_signature) {
+				return "", errors.New("challenge is not signed by the server")
+			}
+		}
+		nonce = message
+	default:
+		return "", errors.New("unknown challenge scheme: " + challenge.Scheme)
+	}
+
+	challenge_nonce, err := protocol.ParseChallengeNonce(string(nonce))
+	if err != nil {
+		return "", err
+	}
+	if challenge_nonce.Challenge_type != challenge_type {
+		return "", errors.New("challenge was issued for " + challenge_nonce.Challenge_type)
+	}
+	if self.server_host_name != "" && challenge_nonce.Host_name != self.server_host_name {
+		return "", errors.New("challenge was issued by " + challenge_nonce.Host_name)
+	}
+
+	/* servers that don't negotiate expect pkcs1v15 from rsa keys */
+	signature_scheme := challenge.Signature_scheme
+	if signature_scheme == "" {
+		signature_scheme = protocol.SIGNATURE_SCHEME_PKCS1V15
+	}
+	signature, err := protocol.SignWithScheme(self.private_key, string(nonce), signature_scheme)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(signature), nil
+}
+
+func (self *Client) requestChallenge(method string, path string) (*Challenge, error) {
+	public_key_string, err := self.PublicKeyString()
+	if err != nil {
+		return nil, err
+	}
+
+	json_request := struct {
+		Public_key        string   `json:"public_key"`
+		Challenge_schemes []string `json:"challenge_schemes"`
+		Signature_schemes []string `json:"signature_schemes"`
+	}{
+		public_key_string,
+		CHALLENGE_SCHEMES,
+		SIGNATURE_SCHEMES,
+	}
+	challenge := Challenge{}
+	err = self.do(method, path, &json_request, &challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return &challenge, nil
+}
+
+/* runs the /a/register -> /a/register/challenge handshake */
+func (self *Client) Register(name string, organization string) error {
+	challenge, err := self.requestChallenge("PUT", "/a/register")
+	if err != nil {
+		return err
+	}
+
+	signature, err := self.answerChallenge(challenge, protocol.CHALLENGE_TYPE_REGISTER)
+	if err != nil {
+		return err
+	}
+
+	json_request := struct {
+		Signature    string `json:"signature"`
+		Index        int    `json:"index"`
+		Name         string `json:"name"`
+		Organization string `json:"organization"`
+	}{
+		signature,
+		challenge.Index,
+		name,
+		organization,
+	}
+
+	return self.do("PUT", "/a/register/challenge", &json_request, nil)
+}
+
+/*
+ * hands the user over from the current key to new_private_key. the current key
+ * signs a succession statement and the new key answers the challenge, after
+ * which the client uses the new key.
+ */
+func (self *Client) RotateKey(new_private_key crypto.Signer) error {
+	old_public_key, err := self.PublicKeyString()
+	if err != nil {
+		return err
+	}
+	new_public_key, err := protocol.PublicKeyToString(new_private_key.Public())
+	if err != nil {
+		return err
+	}
+
+	message := protocol.SuccessionMessage{
+		Version:        protocol.VERSION_CANONICAL,
+		Old_public_key: old_public_key,
+		New_public_key: new_public_key,
+		Timestamp:      int(time.Now().Unix()),
+	}
+	signing_string, err := message.SigningString()
+	if err != nil {
+		return err
+	}
+	signature, err := self.sign(signing_string)
+	if err != nil {
+		return err
+	}
+
+	json_request := struct {
+		Signature         string                     `json:"signature"`
+		Message           protocol.SuccessionMessage `json:"message"`
+		Challenge_schemes []string                   `json:"challenge_schemes"`
+		Signature_schemes []string                   `json:"signature_schemes"`
+	}{
+		signature,
+		message,
+		CHALLENGE_SCHEMES,
+		SIGNATURE_SCHEMES,
+	}
+	challenge := Challenge{}
+	err = self.do("PUT", "/a/rotate", &json_request, &challenge)
+	if err != nil {
+		return err
+	}
+
+	new_client := Client__new(self.base_url, new_private_key)
+	new_client.SetServerKey(self.server_host_name, self.server_public_key)
+	challenge_signature, err := new_client.answerChallenge(&challenge, protocol.CHALLENGE_TYPE_ROTATE)
+	if err != nil {
+		return err
+	}
+
+	challenge_request := struct {
+		Signature string `json:"signature"`
+		Index     int    `json:"index"`
+	}{
+		challenge_signature,
+		challenge.Index,
+	}
+	err = self.do("PUT", "/a/rotate/challenge", &challenge_request, nil)
+	if err != nil {
+		return err
+	}
+
+	self.private_key = new_private_key
+	return nil
+}
+
+/*
+ * vouches for signee_public_key, message.Public_key is filled in from it.
+ * an End_time of 0 never expires and an empty Version signs the canonical format.
+ */
+func (self *Client) Sign(signee_public_key string, message protocol.VerifyMessage) error {
+	signer_public_key, err := self.PublicKeyString()
+	if err != nil {
+		return err
+	}
+
+	message.Public_key = signee_public_key
+	if message.Version == "" {
+		message.Version = protocol.VERSION_CANONICAL
+	}
+	signing_string, err := message.SigningString()
+	if err != nil {
+		return err
+	}
+	signature, err := self.sign(signing_string)
+	if err != nil {
+		return err
+	}
+
+	json_request := struct {
+		Signature         string                 `json:"signature"`
+		Message           protocol.VerifyMessage `json:"message"`
+		Signer_public_key string                 `json:"signer_public_key"`
+		Signee_public_key string                 `json:"signee_public_key"`
+	}{
+		signature,
+		message,
+		signer_public_key,
+		signee_public_key,
+	}
+
+	return self.do("POST", "/a/sign", &json_request, nil)
+}
+
+func (self *Client) Revoke(signature_id int, reason string) error {
+	signer_public_key, err := self.PublicKeyString()
+	if err != nil {
+		return err
+	}
+
+	message := protocol.RevocationMessage{
+		Version:      protocol.VERSION_CANONICAL,
+		Signature_id: signature_id,
+		Timestamp:    int(time.Now().Unix()),
+		Reason:       reason,
+	}
+	signing_string, err := message.SigningString()
+	if err != nil {
+		return err
+	}
+	signature, err := self.sign(signing_string)
+	if err != nil {
+		return err
+	}
+
+	json_request := struct {
+		Signature         string                     `json:"signature"`
+		Message           protocol.RevocationMessage `json:"message"`
+		Signer_public_key string                     `json:"signer_public_key"`
+	}{
+		signature,
+		message,
+		signer_public_key,
+	}
+
+	return self.do("PUT", "/a/revoke", &json_request, nil)
+}
+
+/* deactivates this client's own user, which can't be undone by the user */
+func (self *Client) Deactivate() error {
+	challenge, err := self.requestChallenge("PUT", "/a/deactivate")
+	if err != nil {
+		return err
+	}
+
+	signature, err := self.answerChallenge(challenge, protocol.CHALLENGE_TYPE_DEACTIVATE)
+	if err != nil {
+		return err
+	}
+
+	json_request := struct {
+		Signature string `json:"signature"`
+		Index     int    `json:"index"`
+	}{
+		signature,
+		challenge.Index,
+	}
+
+	return self.do("PUT", "/a/deactivate/challenge", &json_request, nil)
+}
+
+/* signs an admin message for action on target with this client's key, which must be the admin key */
+func (self *Client) admin(method string, path string, action string, target string, response interface{}) error {
+	admin_public_key, err := self.PublicKeyString()
+	if err != nil {
+		return err
+	}
+
+	/* the message names the server it's for, ask it unless its key was set */
+	host_name := self.server_host_name
+	if host_name == "" {
+		server_key, err := self.ServerKey()
+		if err != nil {
+			return err
+		}
+		host_name = server_key.Host_name
+	}
+
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	message := protocol.AdminMessage{
+		Version:   protocol.VERSION_CANONICAL,
+		Host_name: host_name,
+		Action:    action,
+		Target:    target,
+		Timestamp: int(time.Now().Unix()),
+		Nonce:     hex.EncodeToString(nonce),
+	}
+	signing_string, err := message.SigningString()
+	if err != nil {
+		return err
+	}
+	signature, err := self.sign(signing_string)
+	if err != nil {
+		return err
+	}
+
+	json_request := struct {
+		Admin_public_key string                `json:"admin_public_key"`
+		Message          protocol.AdminMessage `json:"message"`
+		Signature        string                `json:"signature"`
+	}{
+		admin_public_key,
+		message,
+		signature,
+	}
+
+	return self.do(method, path, &json_request, response)
+}
+
+func (self *Client) Keys(query string) ([]User, error) {
+	json_response := struct {
+		Users []User `json:"users"`
+	}{}
+	err := self.doSigned("GET", "/a/keys?q="+url.QueryEscape(query), nil, &json_response)
+	if err != nil {
+		return nil, err
+	}
+	return json_response.Users, nil
+}
+
+func (self *Client) Sessions(query string) ([]PeerSession, error) {
+	json_response := struct {
+		Sessions []PeerSession `json:"sessions"`
+	}{}
+	err := self.doSigned("GET", "/a/sessions?q="+url.QueryEscape(query), nil, &json_response)
+	if err != nil {
+		return nil, err
+	}
+	return json_response.Sessions, nil
+}
+
+/* like Sessions, with each user's endpoints together */
+func (self *Client) SessionsByUser(query string) ([]PeerUser, error) {
+	json_response := struct {
+		Users []PeerUser `json:"users"`
+	}{}
+	err := self.doSigned("GET", "/a/sessions?group=user&q="+url.QueryEscape(query), nil, &json_response)
+	if err != nil {
+		return nil, err
+	}
+	return json_response.Users, nil
+}
+
+/* scope is a message key like "identity", or a prefix like "role:", empty for all */
+func (self *Client) Signatures(public_key string, federated bool, valid_only bool, scope string) ([]Signature, error) {
+	json_request := struct {
+		Key        string `json:"key"`
+		Federated  bool   `json:"federated"`
+		Valid_only bool   `json:"valid_only"`
+		Scope      string `json:"scope"`
+	}{
+		public_key,
+		federated,
+		valid_only,
+		scope,
+	}
+	json_response := struct {
+		Key        string      `json:"key"`
+		Federated  bool        `json:"federated"`
+		Valid_only bool        `json:"valid_only"`
+		Scope      string      `json:"scope"`
+		Signatures []Signature `json:"signatures"`
+	}{}
+	err := self.doSigned("GET", "/a/signatures", &json_request, &json_response)
+	if err != nil {
+		return nil, err
+	}
+	if self.server_public_key != nil {
+		if json_response.Key != public_key || json_response.Federated != federated || json_response.Valid_only != valid_only || json_response.Scope != scope {
+			return nil, errors.New("signed response is for a different query")
+		}
+	}
+	return json_response.Signatures, nil
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"encoding/base64"
+	"github.com/fivebillionmph/be227a/protocol"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testSignedNonceChallenge(t *testing.T, server_key *Client, challenge_type string) *Challenge {
+	nonce := protocol.ChallengeNonce{
+		Host_name:      "test",
+		Challenge_type: challenge_type,
+		Random:         "0123456789abcdef0123456789abcdef",
+	}.String()
+	server_signature, err := server_key.sign(nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Challenge{
+		Message:          base64.StdEncoding.EncodeToString([]byte(nonce)),
+		Scheme:           "signed_nonce",
+		Server_signature: server_signature,
+	}
+}
+
+func TestAnswerSignedNonceChallenge(t *testing.T) {
+	server_private_key, err := GenerateKey("rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other_private_key, err := GenerateKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user_private_key, err := GenerateKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := Client__new("", server_private_key)
+	other := Client__new("", other_private_key)
+	c := Client__new("", user_private_key)
+
+	/* without a server key the signature can't be checked and isn't */
+	challenge := testSignedNonceChallenge(t, other, protocol.CHALLENGE_TYPE_REGISTER)
+	_, err = c.answerChallenge(challenge, protocol.CHALLENGE_TYPE_REGISTER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetServerKey("test", server_private_key.Public())
+
+	challenge = testSignedNonceChallenge(t, server, protocol.CHALLENGE_TYPE_REGISTER)
+	answer, err := c.answerChallenge(challenge, protocol.CHALLENGE_TYPE_REGISTER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, _ := base64.StdEncoding.DecodeString(answer)
+	nonce, _ := base64.StdEncoding.DecodeString(challenge.Message)
+	if !protocol.Verify(user_private_key.Public(), string(nonce), signature) {
+		t.Fatal("answer doesn't verify")
+	}
+
+	if _, err := c.answerChallenge(testSignedNonceChallenge(t, other, protocol.CHALLENGE_TYPE_REGISTER), protocol.CHALLENGE_TYPE_REGISTER); err == nil {
+		t.Fatal("answered a challenge signed by another key")
+	}
+
+	unsigned := testSignedNonceChallenge(t, server, protocol.CHALLENGE_TYPE_REGISTER)
+	unsigned.Server_signature = ""
+	if _, err := c.answerChallenge(unsigned, protocol.CHALLENGE_TYPE_REGISTER); err == nil {
+		t.Fatal("answered an unsigned challenge")
+	}
+
+	/* the signature is over the nonce that was sent, not any nonce */
+	swapped := testSignedNonceChallenge(t, server, protocol.CHALLENGE_TYPE_REGISTER)
+	swapped.Server_signature = testSignedNonceChallenge(t, server, protocol.CHALLENGE_TYPE_START_SESSION).Server_signature
+	if _, err := c.answerChallenge(swapped, protocol.CHALLENGE_TYPE_REGISTER); err == nil {
+		t.Fatal("answered a challenge with another nonce's signature")
+	}
+}
+
+func TestSignedResponseAge(t *testing.T) {
+	server_private_key, err := GenerateKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed_timestamp := 0
+	http_server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := []byte(`{"users":[]}`)
+		signature, err := protocol.Sign(server_private_key, protocol.ResponseSigningString("test", r.URL.RequestURI(), signed_timestamp, body))
+		if err != nil {
+			t.Error(err)
+		}
+		w.Header().Set(protocol.RESPONSE_SIGNATURE_HEADER, base64.StdEncoding.EncodeToString(signature))
+		w.Header().Set(protocol.RESPONSE_TIMESTAMP_HEADER, strconv.Itoa(signed_timestamp))
+		w.Write(body)
+	}))
+	defer http_server.Close()
+
+	c := Client__new(http_server.URL, nil)
+	c.SetServerKey("test", server_private_key.Public())
+
+	now := int(time.Now().Unix())
+	tests := []struct {
+		timestamp int
+		ok        bool
+	}{
+		{now, true},
+		{now - RESPONSE_MAX_AGE + 60, true},
+		{now - RESPONSE_MAX_AGE - 60, false},
+		{now - 24*3600, false},
+		{now + RESPONSE_MAX_AGE + 60, false},
+	}
+	for _, test := range tests {
+		signed_timestamp = test.timestamp
+		_, err := c.Keys("")
+		if test.ok && err != nil {
+			t.Fatalf("timestamp %d: %v", test.timestamp, err)
+		}
+		if !test.ok && err == nil {
+			t.Fatalf("timestamp %d: accepted a signed response %d seconds old", test.timestamp, now-test.timestamp)
+		}
+	}
+}
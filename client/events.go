@@ -0,0 +1,93 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/fivebillionmph/be227a/protocol"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const SESSION_EVENT_START = "session_start"
+const SESSION_EVENT_STOP = "session_stop"
+const SESSION_EVENT_EXPIRE = "session_expire"
+
+/* Existing is set for the sessions that were already running when the stream started */
+type SessionEvent struct {
+	Event_type      string                       `json:"event_type"`
+	Timestamp       int                          `json:"timestamp"`
+	Existing        bool                         `json:"existing"`
+	Name            string                       `json:"name"`
+	Organization    string                       `json:"organization"`
+	Public_key      string                       `json:"public_key"`
+	IP              string                       `json:"ip"`
+	Port            int                          `json:"port"`
+	Label           string                       `json:"label"`
+	Metadata        protocol.SessionMetadata     `json:"metadata"`
+	Start_timestamp int                          `json:"start_timestamp"`
+	Attestation     *protocol.SessionAttestation `json:"attestation"`
+}
+
+/*
+ * follows /a/sessions/stream, calling on_event for every event until stop is
+ * closed or the server ends the stream. the events aren't signed, start events
+ * carry an attestation that can be checked with VerifyPeer.
+ */
+func (self *Client) WatchSessions(query string, stop chan bool, on_event func(SessionEvent)) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	request, err := http.NewRequestWithContext(ctx, "GET", self.base_url+"/a/sessions/stream?q="+url.QueryEscape(query), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "text/event-stream")
+
+	/* the stream outlives the usual request timeout */
+	stream_client := &http.Client{Transport: self.http_client.Transport}
+	res, err := stream_client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return errors.New("session stream failed: " + res.Status)
+	}
+
+	data := make([]string, 0, 1)
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				event := SessionEvent{}
+				err := json.Unmarshal([]byte(strings.Join(data, "\n")), &event)
+				if err != nil {
+					return err
+				}
+				on_event(event)
+				data = data[:0]
+			}
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+
+	select {
+	case <-stop:
+		return nil
+	default:
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+)
+
+/* algorithm is one of rsa, ecdsa or ed25519 */
+func GenerateKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ed25519":
+		_, private_key, err := ed25519.GenerateKey(rand.Reader)
+		return private_key, err
+	default:
+		return nil, errors.New("unknown key algorithm: " + algorithm)
+	}
+}
+
+/* writes a pkcs8 "PRIVATE KEY" pem file readable only by the owner */
+func SavePrivateKey(path string, private_key crypto.Signer) error {
+	der_bytes, err := x509.MarshalPKCS8PrivateKey(private_key)
+	if err != nil {
+		return err
+	}
+
+	pem_bytes := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der_bytes,
+	})
+
+	return ioutil.WriteFile(path, pem_bytes, os.FileMode(int(0600)))
+}
+
+/* reads pkcs8 "PRIVATE KEY" or pkcs1 "RSA PRIVATE KEY" pem files */
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid private key file")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private_key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := private_key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("unsupported private key")
+		}
+		return signer, nil
+	default:
+		return nil, errors.New("unsupported private key type: " + block.Type)
+	}
+}
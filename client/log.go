@@ -0,0 +1,121 @@
+package client
+
+import (
+	"errors"
+	"github.com/fivebillionmph/be227a/protocol"
+	"strconv"
+)
+
+/*
+ * the server's transparency log. the proofs are checked against the tree head
+ * returned with them, checking the head's signature needs the server's key.
+ */
+
+type UserLogProof struct {
+	Tree_head protocol.SignedTreeHead `json:"tree_head"`
+	User      protocol.LogProof       `json:"user"`
+}
+
+type SignatureLogProof struct {
+	Tree_head  protocol.SignedTreeHead `json:"tree_head"`
+	Signature  protocol.LogProof       `json:"signature"`
+	Revocation *protocol.LogProof      `json:"revocation"`
+}
+
+type LogConsistency struct {
+	First     int                     `json:"first"`
+	Tree_head protocol.SignedTreeHead `json:"tree_head"`
+	Proof     [][]byte                `json:"proof"`
+}
+
+/* size 0 for the current head */
+func (self *Client) LogHead(size int) (*protocol.SignedTreeHead, error) {
+	path := "/a/log/head"
+	if size > 0 {
+		path += "?size=" + strconv.Itoa(size)
+	}
+	tree_head := protocol.SignedTreeHead{}
+	err := self.do("GET", path, nil, &tree_head)
+	if err != nil {
+		return nil, err
+	}
+	return &tree_head, nil
+}
+
+func (self *Client) LogEntries(start int, end int) ([]protocol.LogEntry, error) {
+	json_response := struct {
+		Entries []protocol.LogEntry `json:"entries"`
+	}{}
+	err := self.do("GET", "/a/log/entries?start="+strconv.Itoa(start)+"&end="+strconv.Itoa(end), nil, &json_response)
+	if err != nil {
+		return nil, err
+	}
+	return json_response.Entries, nil
+}
+
+/* the proof is verified before it's returned */
+func (self *Client) LogUserProof(public_key string, size int) (*UserLogProof, error) {
+	json_request := struct {
+		Key       string `json:"key"`
+		Tree_size int    `json:"tree_size"`
+	}{
+		public_key,
+		size,
+	}
+	log_proof := UserLogProof{}
+	err := self.do("GET", "/a/log/proof/user", &json_request, &log_proof)
+	if err != nil {
+		return nil, err
+	}
+	if !log_proof.User.Verify(log_proof.Tree_head.TreeHead) {
+		return nil, errors.New("invalid inclusion proof for user")
+	}
+	return &log_proof, nil
+}
+
+/* the proofs are verified before they're returned */
+func (self *Client) LogSignatureProof(signature_id int, size int) (*SignatureLogProof, error) {
+	json_request := struct {
+		Id        int `json:"id"`
+		Tree_size int `json:"tree_size"`
+	}{
+		signature_id,
+		size,
+	}
+	log_proof := SignatureLogProof{}
+	err := self.do("GET", "/a/log/proof/signature", &json_request, &log_proof)
+	if err != nil {
+		return nil, err
+	}
+	if !log_proof.Signature.Verify(log_proof.Tree_head.TreeHead) {
+		return nil, errors.New("invalid inclusion proof for signature")
+	}
+	if log_proof.Revocation != nil && !log_proof.Revocation.Verify(log_proof.Tree_head.TreeHead) {
+		return nil, errors.New("invalid inclusion proof for revocation")
+	}
+	return &log_proof, nil
+}
+
+/*
+ * checks that the log still extends an older head the caller kept, returns
+ * the newer head. second 0 for the current size.
+ */
+func (self *Client) LogConsistency(old_head protocol.TreeHead, second int) (*protocol.SignedTreeHead, error) {
+	json_request := struct {
+		First  int `json:"first"`
+		Second int `json:"second"`
+	}{
+		old_head.Tree_size,
+		second,
+	}
+	consistency := LogConsistency{}
+	err := self.do("GET", "/a/log/consistency", &json_request, &consistency)
+	if err != nil {
+		return nil, err
+	}
+	new_head := consistency.Tree_head
+	if consistency.First != old_head.Tree_size || !protocol.VerifyConsistency(old_head.Tree_size, new_head.Tree_size, consistency.Proof, old_head.Root_hash, new_head.Root_hash) {
+		return nil, errors.New("log is not consistent with the old tree head")
+	}
+	return &new_head, nil
+}
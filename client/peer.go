@@ -0,0 +1,47 @@
+package client
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/fivebillionmph/be227a/protocol"
+	"net"
+	"time"
+)
+
+/*
+ * peer handshake: the connecting side sends random bytes, the listening side
+ * answers with its attestation and SignPeerNonce, and the connecting side
+ * checks both with VerifyPeer. the server isn't asked, so its key has to be
+ * set with SetServerKey.
+ */
+func (self *Client) VerifyPeer(attestation *protocol.SessionAttestation, ip net.IP, port int, random string, signature string) error {
+	if self.server_public_key == nil {
+		return errors.New("server key not set")
+	}
+	if attestation == nil {
+		return errors.New("no attestation")
+	}
+
+	err := attestation.VerifyPeer(self.server_public_key, self.server_host_name, ip, port, int(time.Now().Unix()))
+	if err != nil {
+		return err
+	}
+
+	signature_bytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	if !attestation.VerifyPeerSignature(random, signature_bytes) {
+		return errors.New("invalid peer signature")
+	}
+
+	return nil
+}
+
+/* proves to a peer that this client holds the key in its attestation */
+func (self *Client) SignPeerNonce(attestation *protocol.SessionAttestation, random string) (string, error) {
+	if attestation == nil {
+		return "", errors.New("no attestation")
+	}
+	return self.sign(protocol.PeerNonce(*attestation, random))
+}
@@ -0,0 +1,203 @@
+package client
+
+import (
+	"github.com/fivebillionmph/be227a/protocol"
+	"sync"
+	"time"
+)
+
+/* the server drops sessions that haven't been refreshed for an hour */
+const SESSION_REFRESH_INTERVAL = 10 * time.Minute
+
+/*
+ * Token is what the server checks on refresh and stop. it's bound to the ip
+ * the session was started from and replaced on every refresh, as is
+ * Attestation, which is shown to peers.
+ */
+type Session struct {
+	client       *Client
+	Id           string
+	Token        string
+	Attestation  *protocol.SessionAttestation
+	mutex        sync.Mutex
+	stop_channel chan bool
+}
+
+/* a session of the same user, as listed by Session.Mine */
+type OwnSession struct {
+	Id                  string                   `json:"id"`
+	Label               string                   `json:"label"`
+	Metadata            protocol.SessionMetadata `json:"metadata"`
+	IP                  string                   `json:"ip"`
+	Port                int                      `json:"port"`
+	Start_timestamp     int                      `json:"start_timestamp"`
+	Lastcheck_timestamp int                      `json:"lastcheck_timestamp"`
+	Current             bool                     `json:"current"`
+}
+
+/* runs the /a/session -> /a/session/challenge handshake, port is where this client listens */
+func (self *Client) StartSession(port int) (*Session, error) {
+	return self.StartLabeledSession(port, "", protocol.SessionMetadata{})
+}
+
+/*
+ * label names the device, starting a session with a label the user already
+ * has a session for replaces that session.
+ */
+func (self *Client) StartLabeledSession(port int, label string, metadata protocol.SessionMetadata) (*Session, error) {
+	challenge, err := self.requestChallenge("POST", "/a/session")
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := self.answerChallenge(challenge, protocol.CHALLENGE_TYPE_START_SESSION)
+	if err != nil {
+		return nil, err
+	}
+
+	json_request := struct {
+		Signature string                   `json:"signature"`
+		Index     int                      `json:"index"`
+		Port      int                      `json:"port"`
+		Label     string                   `json:"label"`
+		Metadata  protocol.SessionMetadata `json:"metadata"`
+	}{
+		signature,
+		challenge.Index,
+		port,
+		label,
+		metadata,
+	}
+	json_response := struct {
+		Session_id  string                       `json:"session_id"`
+		Token       string                       `json:"token"`
+		Attestation *protocol.SessionAttestation `json:"attestation"`
+	}{}
+	err = self.do("PUT", "/a/session/challenge", &json_request, &json_response)
+	if err != nil {
+		return nil, err
+	}
+
+	session := self.Session(json_response.Token)
+	session.Id = json_response.Session_id
+	session.Attestation = json_response.Attestation
+	return session, nil
+}
+
+/* for a session started earlier, possibly by another process, Id is left empty */
+func (self *Client) Session(token string) *Session {
+	return &Session{
+		client: self,
+		Token:  token,
+	}
+}
+
+func (self *Session) token() string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.Token
+}
+
+/* on success Token is replaced with the new one */
+func (self *Session) Refresh() error {
+	json_request := struct {
+		Token string `json:"token"`
+	}{
+		self.token(),
+	}
+	json_response := struct {
+		Token       string                       `json:"token"`
+		Attestation *protocol.SessionAttestation `json:"attestation"`
+	}{}
+	err := self.client.do("POST", "/a/session/refresh", &json_request, &json_response)
+	if err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	self.Token = json_response.Token
+	self.Attestation = json_response.Attestation
+	self.mutex.Unlock()
+
+	return nil
+}
+
+/* also stops the background refresh */
+func (self *Session) Stop() error {
+	self.StopRefreshing()
+
+	json_request := struct {
+		Token string `json:"token"`
+	}{
+		self.token(),
+	}
+	return self.client.do("DELETE", "/a/session", &json_request, nil)
+}
+
+/* all of the user's sessions, this one included */
+func (self *Session) Mine() ([]OwnSession, error) {
+	json_request := struct {
+		Token string `json:"token"`
+	}{
+		self.token(),
+	}
+	json_response := struct {
+		Sessions []OwnSession `json:"sessions"`
+	}{}
+	err := self.client.do("POST", "/a/session/mine", &json_request, &json_response)
+	if err != nil {
+		return nil, err
+	}
+	return json_response.Sessions, nil
+}
+
+/* ends another of the user's sessions by its id */
+func (self *Session) End(session_id string) error {
+	json_request := struct {
+		Token      string `json:"token"`
+		Session_id string `json:"session_id"`
+	}{
+		self.token(),
+		session_id,
+	}
+	return self.client.do("DELETE", "/a/session/mine", &json_request, nil)
+}
+
+/* refreshes every interval until StopRefreshing or Stop, errors go to on_error if it's not nil */
+func (self *Session) StartRefreshing(interval time.Duration, on_error func(error)) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.stop_channel != nil {
+		return
+	}
+	self.stop_channel = make(chan bool)
+
+	go func(stop_channel chan bool) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop_channel:
+				return
+			case <-ticker.C:
+				err := self.Refresh()
+				if err != nil && on_error != nil {
+					on_error(err)
+				}
+			}
+		}
+	}(self.stop_channel)
+}
+
+func (self *Session) StopRefreshing() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.stop_channel != nil {
+		close(self.stop_channel)
+		self.stop_channel = nil
+	}
+}
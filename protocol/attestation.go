@@ -0,0 +1,102 @@
+package protocol
+
+import (
+	"crypto"
+	"errors"
+	"net"
+	"strconv"
+)
+
+/*
+ * a session attestation is the server's signed statement that whoever started
+ * a session from ip and port proved they hold public_key. peers get it from
+ * /a/sessions or from each other and check it with the server's key, then
+ * have the other side sign a PeerNonce to show it holds the key too.
+ */
+type SessionAttestation struct {
+	Version          string `json:"version"`
+	Host_name        string `json:"host_name"`
+	Public_key       string `json:"public_key"`
+	IP               string `json:"ip"`
+	Port             int    `json:"port"`
+	Start_timestamp  int    `json:"start_timestamp"`
+	Expire_timestamp int    `json:"expire_timestamp"`
+	Signature        []byte `json:"signature"`
+}
+
+func (self SessionAttestation) SigningString() (string, error) {
+	if self.Version != VERSION_CANONICAL {
+		return "", errors.New("unknown message version: " + self.Version)
+	}
+
+	return canonicalString(
+		VERSION_CANONICAL,
+		"session_attestation",
+		self.Host_name,
+		self.Public_key,
+		self.IP,
+		strconv.Itoa(self.Port),
+		strconv.Itoa(self.Start_timestamp),
+		strconv.Itoa(self.Expire_timestamp),
+	), nil
+}
+
+/* checks the server's signature and that the attestation hasn't expired at now */
+func (self SessionAttestation) Verify(server_public_key crypto.PublicKey, host_name string, now int) error {
+	signing_string, err := self.SigningString()
+	if err != nil {
+		return err
+	}
+	if !Verify(server_public_key, signing_string, self.Signature) {
+		return errors.New("invalid attestation signature")
+	}
+	if self.Host_name != host_name {
+		return errors.New("attestation was issued by " + self.Host_name)
+	}
+	if now > self.Expire_timestamp {
+		return errors.New("attestation expired")
+	}
+
+	return nil
+}
+
+/* also checks that the attestation is for the address the peer is at, port 0 skips the port */
+func (self SessionAttestation) VerifyPeer(server_public_key crypto.PublicKey, host_name string, ip net.IP, port int, now int) error {
+	err := self.Verify(server_public_key, host_name, now)
+	if err != nil {
+		return err
+	}
+	if ip == nil || !ip.Equal(net.ParseIP(self.IP)) {
+		return errors.New("attestation is for another ip")
+	}
+	if port != 0 && port != self.Port {
+		return errors.New("attestation is for another port")
+	}
+
+	return nil
+}
+
+/*
+ * what a peer signs to prove it holds the attested key. random comes from the
+ * side doing the checking, and the attestation is named so the answer can't be
+ * replayed for another session.
+ */
+func PeerNonce(attestation SessionAttestation, random string) string {
+	return canonicalString(
+		VERSION_CANONICAL,
+		"peer",
+		attestation.Host_name,
+		attestation.Public_key,
+		strconv.Itoa(attestation.Start_timestamp),
+		random,
+	)
+}
+
+/* checks a peer's signature of PeerNonce with the attested key */
+func (self SessionAttestation) VerifyPeerSignature(random string, signature []byte) bool {
+	public_key, err := StringToPublicKey(self.Public_key)
+	if err != nil {
+		return false
+	}
+	return Verify(public_key, PeerNonce(self, random), signature)
+}
@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const CHALLENGE_TYPE_START_SESSION = "start_session"
+const CHALLENGE_TYPE_REGISTER = "register"
+const CHALLENGE_TYPE_DEACTIVATE = "deactivate"
+const CHALLENGE_TYPE_ROTATE = "rotate"
+
+/*
+ * the nonce a client signs to answer a challenge. it names the server and
+ * what the challenge is for, so an answer can't be used for another purpose
+ * or on another server.
+ */
+type ChallengeNonce struct {
+	Host_name      string
+	Challenge_type string
+	Random         string
+}
+
+func (self ChallengeNonce) String() string {
+	return canonicalString(
+		VERSION_CANONICAL,
+		"challenge",
+		self.Host_name,
+		self.Challenge_type,
+		self.Random,
+	)
+}
+
+func ParseChallengeNonce(nonce string) (*ChallengeNonce, error) {
+	fields, err := parseCanonicalString(nonce)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) != 5 || fields[0] != VERSION_CANONICAL || fields[1] != "challenge" {
+		return nil, errors.New("not a challenge nonce")
+	}
+
+	return &ChallengeNonce{
+		Host_name:      fields[2],
+		Challenge_type: fields[3],
+		Random:         fields[4],
+	}, nil
+}
+
+/* the inverse of canonicalString */
+func parseCanonicalString(s string) ([]string, error) {
+	fields := make([]string, 0, 8)
+	for len(s) > 0 {
+		colon := strings.IndexByte(s, ':')
+		if colon < 1 {
+			return nil, errors.New("malformed canonical string")
+		}
+		length, err := strconv.Atoi(s[:colon])
+		if err != nil || length < 0 || colon+1+length >= len(s) || s[colon+1+length] != ',' {
+			return nil, errors.New("malformed canonical string")
+		}
+		fields = append(fields, s[colon+1:colon+1+length])
+		s = s[colon+2+length:]
+	}
+	return fields, nil
+}
@@ -0,0 +1,198 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"strconv"
+)
+
+/*
+ * the transparency log is an RFC 6962 merkle tree. leaves and interior nodes
+ * are hashed with different prefixes so a leaf can't pass for a node.
+ */
+
+/*
+ * one entry in the log: a registration, a signature, a revocation, a key
+ * rotation, a deactivation or reactivation, or an admin deleting a signature
+ */
+type LogEntry struct {
+	Entry_type string   `json:"entry_type"`
+	Item_id    int      `json:"item_id"`
+	Timestamp  int      `json:"timestamp"`
+	Fields     []string `json:"fields"`
+}
+
+/* the server's signed statement of the log's size and root hash */
+type TreeHead struct {
+	Version   string `json:"version"`
+	Tree_size int    `json:"tree_size"`
+	Timestamp int    `json:"timestamp"`
+	Root_hash []byte `json:"root_hash"`
+}
+
+type SignedTreeHead struct {
+	TreeHead
+	Signature []byte `json:"signature"`
+}
+
+/* a log entry with the audit path from its leaf to the root of a tree head */
+type LogProof struct {
+	Entry      LogEntry `json:"entry"`
+	Leaf_index int      `json:"leaf_index"`
+	Proof      [][]byte `json:"proof"`
+}
+
+const LOG_ENTRY_USER = "user"
+const LOG_ENTRY_SIGNATURE = "signature"
+const LOG_ENTRY_REVOCATION = "revocation"
+const LOG_ENTRY_ROTATION = "rotation"
+const LOG_ENTRY_DEACTIVATION = "deactivation"
+const LOG_ENTRY_REACTIVATION = "reactivation"
+const LOG_ENTRY_SIGNATURE_DELETION = "signature_deletion"
+
+/* the bytes that are hashed into the leaf */
+func (self LogEntry) LeafData() string {
+	fields := []string{
+		VERSION_CANONICAL,
+		"log_entry",
+		self.Entry_type,
+		strconv.Itoa(self.Item_id),
+		strconv.Itoa(self.Timestamp),
+	}
+	return canonicalString(append(fields, self.Fields...)...)
+}
+
+func (self LogEntry) LeafHash() []byte {
+	return LeafHash([]byte(self.LeafData()))
+}
+
+func (self TreeHead) SigningString() (string, error) {
+	if self.Version != VERSION_CANONICAL {
+		return "", errors.New("unknown message version: " + self.Version)
+	}
+
+	return canonicalString(
+		VERSION_CANONICAL,
+		"tree_head",
+		strconv.Itoa(self.Tree_size),
+		strconv.Itoa(self.Timestamp),
+		string(self.Root_hash),
+	), nil
+}
+
+func (self SignedTreeHead) Verify(server_public_key crypto.PublicKey) bool {
+	signing_string, err := self.SigningString()
+	if err != nil {
+		return false
+	}
+	return Verify(server_public_key, signing_string, self.Signature)
+}
+
+func (self LogProof) Verify(tree_head TreeHead) bool {
+	return VerifyInclusion(self.Entry.LeafHash(), self.Leaf_index, tree_head.Tree_size, self.Proof, tree_head.Root_hash)
+}
+
+func LeafHash(data []byte) []byte {
+	hash := sha256.Sum256(append([]byte{0x00}, data...))
+	return hash[:]
+}
+
+func NodeHash(left []byte, right []byte) []byte {
+	buffer := make([]byte, 0, 1+len(left)+len(right))
+	buffer = append(buffer, 0x01)
+	buffer = append(buffer, left...)
+	buffer = append(buffer, right...)
+	hash := sha256.Sum256(buffer)
+	return hash[:]
+}
+
+/* the root of the empty tree */
+func EmptyRootHash() []byte {
+	hash := sha256.Sum256(nil)
+	return hash[:]
+}
+
+/* checks that leaf_hash is at index in the tree of size with root_hash (RFC 9162 2.1.3.2) */
+func VerifyInclusion(leaf_hash []byte, index int, size int, proof [][]byte, root_hash []byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+
+	fn := index
+	sn := size - 1
+	hash := leaf_hash
+	for _, p := range proof {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			hash = NodeHash(p, hash)
+			if fn&1 == 0 {
+				for fn&1 == 0 && fn != 0 {
+					fn >>= 1
+					sn >>= 1
+				}
+			}
+		} else {
+			hash = NodeHash(hash, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	return sn == 0 && bytes.Equal(hash, root_hash)
+}
+
+/* checks that the tree of size2 with root_hash2 extends the tree of size1 with root_hash1 (RFC 9162 2.1.4.2) */
+func VerifyConsistency(size1 int, size2 int, proof [][]byte, root_hash1 []byte, root_hash2 []byte) bool {
+	if size1 < 0 || size2 < size1 {
+		return false
+	}
+	if size1 == size2 {
+		return len(proof) == 0 && bytes.Equal(root_hash1, root_hash2)
+	}
+	if size1 == 0 {
+		return len(proof) == 0
+	}
+	if len(proof) == 0 {
+		return false
+	}
+
+	/* when size1 is a power of two the old root is the first node of the path */
+	if size1&(size1-1) == 0 {
+		proof = append([][]byte{root_hash1}, proof...)
+	}
+
+	fn := size1 - 1
+	sn := size2 - 1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	fr := proof[0]
+	sr := proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = NodeHash(c, fr)
+			sr = NodeHash(c, sr)
+			if fn&1 == 0 {
+				for fn&1 == 0 && fn != 0 {
+					fn >>= 1
+					sn >>= 1
+				}
+			}
+		} else {
+			sr = NodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	return sn == 0 && bytes.Equal(fr, root_hash1) && bytes.Equal(sr, root_hash2)
+}
@@ -0,0 +1,183 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+/* the test vectors of RFC 6962 implementations, leaf data and the roots of the trees of size 1 to 8 */
+var test_merkle_leaves = []string{
+	"",
+	"00",
+	"10",
+	"2021",
+	"3031",
+	"40414243",
+	"5051525354555657",
+	"606162636465666768696a6b6c6d6e6f",
+}
+
+var test_merkle_roots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+var test_inclusion_proofs = []struct {
+	index int
+	size  int
+	proof []string
+}{
+	{0, 1, []string{}},
+	{0, 8, []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}},
+	{5, 8, []string{
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}},
+	{2, 3, []string{
+		"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	}},
+	{1, 5, []string{
+		"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}},
+}
+
+var test_consistency_proofs = []struct {
+	size1 int
+	size2 int
+	proof []string
+}{
+	{1, 1, []string{}},
+	{1, 8, []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}},
+	{6, 8, []string{
+		"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}},
+	{2, 5, []string{
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}},
+}
+
+func testHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func testHexList(t *testing.T, list []string) [][]byte {
+	hashes := make([][]byte, 0, len(list))
+	for _, s := range list {
+		hashes = append(hashes, testHex(t, s))
+	}
+	return hashes
+}
+
+func testRoot(t *testing.T, size int) []byte {
+	return testHex(t, test_merkle_roots[size-1])
+}
+
+func TestEmptyRootHash(t *testing.T) {
+	if hex.EncodeToString(EmptyRootHash()) != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Fatal("wrong empty root hash")
+	}
+}
+
+func TestVerifyInclusion(t *testing.T) {
+	for _, vector := range test_inclusion_proofs {
+		leaf_hash := LeafHash(testHex(t, test_merkle_leaves[vector.index]))
+		proof := testHexList(t, vector.proof)
+		root_hash := testRoot(t, vector.size)
+
+		if !VerifyInclusion(leaf_hash, vector.index, vector.size, proof, root_hash) {
+			t.Fatalf("leaf %d in tree %d: valid proof refused", vector.index, vector.size)
+		}
+
+		other_leaf_hash := LeafHash(testHex(t, test_merkle_leaves[(vector.index+1)%len(test_merkle_leaves)]))
+		if VerifyInclusion(other_leaf_hash, vector.index, vector.size, proof, root_hash) {
+			t.Fatalf("leaf %d in tree %d: wrong leaf accepted", vector.index, vector.size)
+		}
+		if VerifyInclusion(leaf_hash, vector.index, vector.size, proof, testRoot(t, vector.size%8+1)) {
+			t.Fatalf("leaf %d in tree %d: wrong root accepted", vector.index, vector.size)
+		}
+		if vector.size > 1 && VerifyInclusion(leaf_hash, vector.index+1, vector.size, proof, root_hash) {
+			t.Fatalf("leaf %d in tree %d: wrong index accepted", vector.index, vector.size)
+		}
+		if len(proof) > 0 {
+			if VerifyInclusion(leaf_hash, vector.index, vector.size, proof[:len(proof)-1], root_hash) {
+				t.Fatalf("leaf %d in tree %d: truncated proof accepted", vector.index, vector.size)
+			}
+			if VerifyInclusion(leaf_hash, vector.index, vector.size, append(proof, proof[0]), root_hash) {
+				t.Fatalf("leaf %d in tree %d: extended proof accepted", vector.index, vector.size)
+			}
+			proof[0] = append([]byte{}, proof[0]...)
+			proof[0][0] ^= 1
+			if VerifyInclusion(leaf_hash, vector.index, vector.size, proof, root_hash) {
+				t.Fatalf("leaf %d in tree %d: altered proof accepted", vector.index, vector.size)
+			}
+		}
+	}
+
+	if VerifyInclusion(LeafHash(nil), -1, 1, [][]byte{}, testRoot(t, 1)) || VerifyInclusion(LeafHash(nil), 1, 1, [][]byte{}, testRoot(t, 1)) {
+		t.Fatal("index out of range accepted")
+	}
+}
+
+func TestVerifyConsistency(t *testing.T) {
+	for _, vector := range test_consistency_proofs {
+		proof := testHexList(t, vector.proof)
+		root_hash1 := testRoot(t, vector.size1)
+		root_hash2 := testRoot(t, vector.size2)
+
+		if !VerifyConsistency(vector.size1, vector.size2, proof, root_hash1, root_hash2) {
+			t.Fatalf("%d to %d: valid proof refused", vector.size1, vector.size2)
+		}
+		if vector.size1 == vector.size2 {
+			continue
+		}
+
+		if VerifyConsistency(vector.size1, vector.size2, proof, root_hash2, root_hash2) {
+			t.Fatalf("%d to %d: wrong old root accepted", vector.size1, vector.size2)
+		}
+		if VerifyConsistency(vector.size1, vector.size2, proof, root_hash1, root_hash1) {
+			t.Fatalf("%d to %d: wrong new root accepted", vector.size1, vector.size2)
+		}
+		if VerifyConsistency(vector.size1, vector.size2, proof[:len(proof)-1], root_hash1, root_hash2) {
+			t.Fatalf("%d to %d: truncated proof accepted", vector.size1, vector.size2)
+		}
+		proof[0] = append([]byte{}, proof[0]...)
+		proof[0][0] ^= 1
+		if VerifyConsistency(vector.size1, vector.size2, proof, root_hash1, root_hash2) {
+			t.Fatalf("%d to %d: altered proof accepted", vector.size1, vector.size2)
+		}
+	}
+
+	if !VerifyConsistency(0, 8, [][]byte{}, EmptyRootHash(), testRoot(t, 8)) {
+		t.Fatal("empty tree is consistent with every tree")
+	}
+	if VerifyConsistency(2, 1, [][]byte{}, testRoot(t, 2), testRoot(t, 1)) {
+		t.Fatal("shrinking tree accepted")
+	}
+	if VerifyConsistency(3, 3, [][]byte{}, testRoot(t, 3), testRoot(t, 4)) {
+		t.Fatal("same size with different roots accepted")
+	}
+}
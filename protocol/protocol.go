@@ -0,0 +1,283 @@
+/*
+ * message formats shared by the server and the client, so the bytes that get
+ * signed are built the same way on both ends.
+ */
+package protocol
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/*
+ * VERSION_LEGACY concatenates the fields with no separators, so different
+ * messages can sign the same bytes. it's kept so old signatures still verify.
+ * VERSION_CANONICAL writes every field as a netstring after a version and
+ * message type tag.
+ */
+const VERSION_LEGACY = "v0"
+const VERSION_CANONICAL = "v1"
+
+/* what a signer signs when vouching for a signee's key */
+type VerifyMessage struct {
+	Version      string `json:"version,omitempty"`
+	Public_key   string `json:"public_key"`
+	Start_time   int    `json:"start_time"`
+	End_time     int    `json:"end_time"`
+	Check_server string `json:"check_server"`
+	Message_key  string `json:"message_key"`
+	Modifiers    string `json:"modifiers"`
+}
+
+/* what a signer signs when taking back one of their signatures */
+type RevocationMessage struct {
+	Version      string `json:"version,omitempty"`
+	Signature_id int    `json:"signature_id"`
+	Timestamp    int    `json:"timestamp"`
+	Reason       string `json:"reason"`
+}
+
+/* messages stored before versioning have no version and are legacy */
+func EffectiveVersion(version string) string {
+	if version == "" {
+		return VERSION_LEGACY
+	}
+	return version
+}
+
+/* "<length>:<bytes>," for each field */
+func canonicalString(fields ...string) string {
+	var builder strings.Builder
+	for _, field := range fields {
+		builder.WriteString(strconv.Itoa(len(field)))
+		builder.WriteString(":")
+		builder.WriteString(field)
+		builder.WriteString(",")
+	}
+	return builder.String()
+}
+
+/* what a user's old key signs to hand over to a new key */
+type SuccessionMessage struct {
+	Version        string `json:"version,omitempty"`
+	Old_public_key string `json:"old_public_key"`
+	New_public_key string `json:"new_public_key"`
+	Timestamp      int    `json:"timestamp"`
+}
+
+/*
+ * what an admin signs to act on a target, such as a user's public key. the
+ * host name keeps it from being used on another server and the nonce lets the
+ * server refuse it a second time.
+ */
+type AdminMessage struct {
+	Version   string `json:"version,omitempty"`
+	Host_name string `json:"host_name"`
+	Action    string `json:"action"`
+	Target    string `json:"target"`
+	Timestamp int    `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+}
+
+func (self VerifyMessage) SigningString() (string, error) {
+	switch EffectiveVersion(self.Version) {
+	case VERSION_LEGACY:
+		return self.Public_key + strconv.Itoa(self.Start_time) + strconv.Itoa(self.End_time) + self.Check_server + self.Message_key + self.Modifiers, nil
+	case VERSION_CANONICAL:
+		return canonicalString(
+			VERSION_CANONICAL,
+			"signature",
+			self.Public_key,
+			strconv.Itoa(self.Start_time),
+			strconv.Itoa(self.End_time),
+			self.Check_server,
+			self.Message_key,
+			self.Modifiers,
+		), nil
+	default:
+		return "", errors.New("unknown message version: " + self.Version)
+	}
+}
+
+func (self RevocationMessage) SigningString() (string, error) {
+	switch EffectiveVersion(self.Version) {
+	case VERSION_LEGACY:
+		return "revoke" + strconv.Itoa(self.Signature_id) + strconv.Itoa(self.Timestamp) + self.Reason, nil
+	case VERSION_CANONICAL:
+		return canonicalString(
+			VERSION_CANONICAL,
+			"revocation",
+			strconv.Itoa(self.Signature_id),
+			strconv.Itoa(self.Timestamp),
+			self.Reason,
+		), nil
+	default:
+		return "", errors.New("unknown message version: " + self.Version)
+	}
+}
+
+/* rsa keys are pkcs1 "RSA PUBLIC KEY" blocks, everything else is pkix "PUBLIC KEY" */
+func PublicKeyToString(key crypto.PublicKey) (string, error) {
+	var block pem.Block
+
+	switch typed_key := key.(type) {
+	case *rsa.PublicKey:
+		block.Type = "RSA PUBLIC KEY"
+		block.Bytes = x509.MarshalPKCS1PublicKey(typed_key)
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		der_bytes, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return "", err
+		}
+		block.Type = "PUBLIC KEY"
+		block.Bytes = der_bytes
+	default:
+		return "", errors.New("unsupported public key algorithm")
+	}
+
+	return string(pem.EncodeToMemory(&block)), nil
+}
+
+/* the inverse of PublicKeyToString */
+func StringToPublicKey(key_str string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(key_str))
+	if block == nil {
+		return nil, errors.New("Invalid public key")
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		public_key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch public_key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+			return public_key, nil
+		default:
+			return nil, errors.New("Unsupported public key algorithm")
+		}
+	default:
+		return nil, errors.New("Invalid public key type")
+	}
+}
+
+/*
+ * rsa keys sign with pss, or pkcs1v15 which is kept for older clients. ecdsa
+ * signatures are asn1, both over sha256. ed25519 signs the message itself.
+ */
+const SIGNATURE_SCHEME_PSS = "pss"
+const SIGNATURE_SCHEME_PKCS1V15 = "pkcs1v15"
+
+/* rsa keys use pss */
+func Sign(private_key crypto.Signer, message string) ([]byte, error) {
+	return SignWithScheme(private_key, message, SIGNATURE_SCHEME_PSS)
+}
+
+/* scheme only matters for rsa keys */
+func SignWithScheme(private_key crypto.Signer, message string, scheme string) ([]byte, error) {
+	message_hash := sha256.Sum256([]byte(message))
+
+	switch private_key.Public().(type) {
+	case *rsa.PublicKey:
+		switch scheme {
+		case SIGNATURE_SCHEME_PSS:
+			return private_key.Sign(rand.Reader, message_hash[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+		case SIGNATURE_SCHEME_PKCS1V15:
+			return private_key.Sign(rand.Reader, message_hash[:], crypto.SHA256)
+		default:
+			return nil, errors.New("unknown signature scheme: " + scheme)
+		}
+	case *ecdsa.PublicKey:
+		return private_key.Sign(rand.Reader, message_hash[:], crypto.SHA256)
+	case ed25519.PublicKey:
+		return private_key.Sign(rand.Reader, []byte(message), crypto.Hash(0))
+	default:
+		return nil, errors.New("unsupported private key algorithm")
+	}
+}
+
+/* accepts either rsa scheme */
+func Verify(public_key crypto.PublicKey, message string, signature []byte) bool {
+	_, ok := VerifyScheme(public_key, message, signature)
+	return ok
+}
+
+/* also returns which rsa scheme the signature used, "" for other keys */
+func VerifyScheme(public_key crypto.PublicKey, message string, signature []byte) (string, bool) {
+	for _, scheme := range []string{SIGNATURE_SCHEME_PSS, SIGNATURE_SCHEME_PKCS1V15} {
+		if VerifyWithScheme(public_key, message, signature, scheme) {
+			_, is_rsa := public_key.(*rsa.PublicKey)
+			if !is_rsa {
+				return "", true
+			}
+			return scheme, true
+		}
+	}
+	return "", false
+}
+
+/* scheme only matters for rsa keys */
+func VerifyWithScheme(public_key crypto.PublicKey, message string, signature []byte, scheme string) bool {
+	message_hash := sha256.Sum256([]byte(message))
+
+	switch key := public_key.(type) {
+	case *rsa.PublicKey:
+		switch scheme {
+		case SIGNATURE_SCHEME_PSS:
+			return rsa.VerifyPSS(key, crypto.SHA256, message_hash[:], signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}) == nil
+		case SIGNATURE_SCHEME_PKCS1V15:
+			return rsa.VerifyPKCS1v15(key, crypto.SHA256, message_hash[:], signature) == nil
+		default:
+			return false
+		}
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, message_hash[:], signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, []byte(message), signature)
+	default:
+		return false
+	}
+}
+
+/* there was never a legacy succession format, so only the canonical version is accepted */
+func (self SuccessionMessage) SigningString() (string, error) {
+	if self.Version != VERSION_CANONICAL {
+		return "", errors.New("unknown message version: " + self.Version)
+	}
+
+	return canonicalString(
+		VERSION_CANONICAL,
+		"succession",
+		self.Old_public_key,
+		self.New_public_key,
+		strconv.Itoa(self.Timestamp),
+	), nil
+}
+
+func (self AdminMessage) SigningString() (string, error) {
+	if self.Version != VERSION_CANONICAL {
+		return "", errors.New("unknown message version: " + self.Version)
+	}
+
+	return canonicalString(
+		VERSION_CANONICAL,
+		"admin",
+		self.Host_name,
+		self.Action,
+		self.Target,
+		strconv.Itoa(self.Timestamp),
+		self.Nonce,
+	), nil
+}
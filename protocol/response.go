@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+/*
+ * servers can sign the json they send. the signature covers the server's host
+ * name, the request uri, a timestamp and the body, so a signed response can't
+ * be passed off as the answer to a different query.
+ */
+const RESPONSE_SIGNATURE_HEADER = "X-Signature"
+const RESPONSE_TIMESTAMP_HEADER = "X-Signature-Timestamp"
+
+/* what the server's well-known key endpoint returns */
+type ServerKey struct {
+	Host_name  string `json:"host_name"`
+	Public_key string `json:"public_key"`
+}
+
+func ResponseSigningString(host_name string, request_uri string, timestamp int, body []byte) string {
+	return canonicalString(
+		VERSION_CANONICAL,
+		"response",
+		host_name,
+		request_uri,
+		strconv.Itoa(timestamp),
+		string(body),
+	)
+}
+
+/* checks a signed response and returns the time it was signed */
+func VerifyResponse(server_public_key crypto.PublicKey, host_name string, request_uri string, header http.Header, body []byte) (int, error) {
+	signature_str := header.Get(RESPONSE_SIGNATURE_HEADER)
+	timestamp_str := header.Get(RESPONSE_TIMESTAMP_HEADER)
+	if signature_str == "" || timestamp_str == "" {
+		return 0, errors.New("response is not signed")
+	}
+
+	timestamp, err := strconv.Atoi(timestamp_str)
+	if err != nil {
+		return 0, errors.New("invalid response timestamp")
+	}
+	signature, err := base64.StdEncoding.DecodeString(signature_str)
+	if err != nil {
+		return 0, errors.New("invalid response signature")
+	}
+
+	if !Verify(server_public_key, ResponseSigningString(host_name, request_uri, timestamp, body), signature) {
+		return 0, errors.New("invalid response signature")
+	}
+
+	return timestamp, nil
+}
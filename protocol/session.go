@@ -0,0 +1,10 @@
+package protocol
+
+/*
+ * what a client says about the endpoint behind a session, so peers can pick
+ * one. the server only limits the sizes.
+ */
+type SessionMetadata struct {
+	Protocol     string   `json:"protocol"`
+	Capabilities []string `json:"capabilities"`
+}
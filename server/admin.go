@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"github.com/fivebillionmph/be227a/protocol"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+/* how far an admin message's timestamp may be from the server's clock */
+const ADMIN_TIME_WINDOW = 60 // seconds
+
+/*
+ * set from ADMIN_PUBLIC_KEY. this key is always an admin, even if it isn't
+ * registered, and can grant the admin role to registered users.
+ */
+var global_admin_public_key crypto.PublicKey
+
+/* admin messages already acted on, kept until they'd be too old to replay */
+var global_admin_replays *Registry
+
+/*
+ * global_admin_replays starts empty, so messages signed before it was
+ * created are refused rather than replayable after a restart.
+ */
+var global_admin_start_timestamp int
+
+/* the nonce is what makes two otherwise identical admin messages different */
+const ADMIN_NONCE_MIN_LENGTH = 16
+const ADMIN_NONCE_MAX_LENGTH = 128
+
+type AdminReplay struct {
+	expire_timestamp int
+}
+
+func (self *AdminReplay) expired(now int) bool {
+	return now > self.expire_timestamp
+}
+
+/* a verified admin message, kept so the action can be written to the audit log */
+type AdminRequest struct {
+	public_key crypto.PublicKey
+	message    protocol.AdminMessage
+	signature  string
+}
+
+func initAdmin() error {
+	global_admin_replays = Registry__new()
+	global_admin_start_timestamp = timestamp()
+
+	admin_key_str := os.Getenv("ADMIN_PUBLIC_KEY")
+	if admin_key_str == "" {
+		global_admin_public_key = nil
+		return nil
+	}
+
+	var err error
+	global_admin_public_key, err = stringToPublicKey(admin_key_str)
+	return err
+}
+
+/* the bootstrap key, or an active user with the admin role */
+func isAdmin(store Storage, public_key crypto.PublicKey) bool {
+	if global_admin_public_key != nil && publicKeyToDerString(public_key) == publicKeyToDerString(global_admin_public_key) {
+		return true
+	}
+
+	user, err := DBUser__getByPublicKey(store, public_key)
+	if err != nil || !user.active() {
+		return false
+	}
+
+	return DBRole__has(store, user, ROLE_ADMIN)
+}
+
+/*
+ * checks that message was signed by an admin key for action on this server,
+ * is recent and hasn't been used before. used messages are remembered by
+ * their content rather than the signature, since a signature can be altered
+ * and still verify.
+ */
+func verifyAdminMessage(store Storage, admin_public_key crypto.PublicKey, message protocol.AdminMessage, signature string, action string) error {
+	if !isAdmin(store, admin_public_key) {
+		return errors.New("not an admin key")
+	}
+
+	if message.Action != action {
+		return errors.New("wrong admin action")
+	}
+
+	if message.Host_name != global_host_name {
+		return errors.New("admin message is for another server")
+	}
+
+	if len(message.Nonce) < ADMIN_NONCE_MIN_LENGTH || len(message.Nonce) > ADMIN_NONCE_MAX_LENGTH {
+		return errors.New("invalid admin message nonce")
+	}
+
+	now := timestamp()
+	if message.Timestamp < now-ADMIN_TIME_WINDOW || message.Timestamp > now+ADMIN_TIME_WINDOW {
+		return errors.New("admin message timestamp out of range")
+	}
+	if message.Timestamp < global_admin_start_timestamp {
+		return errors.New("admin message is from before the server started")
+	}
+
+	signing_string, err := message.SigningString()
+	if err != nil {
+		return err
+	}
+	if !verifyNewPublicKeySignature(admin_public_key, signing_string, signature) {
+		return errors.New("invalid admin signature")
+	}
+
+	replay := AdminReplay{message.Timestamp + ADMIN_TIME_WINDOW}
+	if !global_admin_replays.add(signing_string, &replay) {
+		return errors.New("admin message already used")
+	}
+
+	return nil
+}
+
+/* decodes and authorizes an admin request, on failure the error response is sent and nil returned */
+func adminRequest(w http.ResponseWriter, r *http.Request, store Storage, action string) *AdminRequest {
+	type json_request_type struct {
+		Admin_public_key string                `json:"admin_public_key"`
+		Message          protocol.AdminMessage `json:"message"`
+		Signature        string                `json:"signature"`
+	}
+	json_request := json_request_type{}
+	err := requestJSONDecode(r, &json_request)
+	if err != nil {
+		errorResponse(w, 400, "Could not read request")
+		return nil
+	}
+
+	admin_public_key, err := stringToPublicKey(json_request.Admin_public_key)
+	if err != nil {
+		errorResponse(w, 400, "Invalid admin public key")
+		return nil
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(json_request.Signature)
+	if err != nil {
+		errorResponse(w, 400, "Could not decode signature")
+		return nil
+	}
+
+	err = verifyAdminMessage(store, admin_public_key, json_request.Message, string(signature), action)
+	if err != nil {
+		errorResponse(w, 403, "Not authorized")
+		return nil
+	}
+
+	return &AdminRequest{
+		public_key: admin_public_key,
+		message:    json_request.Message,
+		signature:  string(signature),
+	}
+}
+
+/* called before acting, so nothing is done that isn't in the audit log */
+func (self *AdminRequest) audit(w http.ResponseWriter, store Storage, details string) bool {
+	_, err := DBAuditLog__create(store, self, details)
+	if err != nil {
+		errorResponse(w, 500, "Could not write audit log")
+		return false
+	}
+	return true
+}
+
+/* the target of user actions is the user's public key */
+func (self *AdminRequest) targetUser(store Storage) (*DBUser, error) {
+	public_key, err := stringToPublicKey(self.message.Target)
+	if err != nil {
+		return nil, err
+	}
+	return DBUser__getByPublicKey(store, public_key)
+}
+
+/* the target of log listings is an optional entry count, capped at ADMIN_LIST_LIMIT_MAX */
+func (self *AdminRequest) targetLimit() (int, error) {
+	if self.message.Target == "" {
+		return ADMIN_LIST_LIMIT_DEFAULT, nil
+	}
+
+	limit, err := strconv.Atoi(self.message.Target)
+	if err != nil || limit < 1 {
+		return 0, errors.New("invalid limit")
+	}
+	if limit > ADMIN_LIST_LIMIT_MAX {
+		limit = ADMIN_LIST_LIMIT_MAX
+	}
+	return limit, nil
+}
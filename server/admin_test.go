@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"github.com/fivebillionmph/be227a/protocol"
+	"math/big"
+	"testing"
+)
+
+func testAdminMessage(t *testing.T, admin_private_key *ecdsa.PrivateKey, nonce string) (protocol.AdminMessage, string) {
+	return testAdminMessageAt(t, admin_private_key, nonce, timestamp())
+}
+
+func testAdminMessageAt(t *testing.T, admin_private_key *ecdsa.PrivateKey, nonce string, message_timestamp int) (protocol.AdminMessage, string) {
+	message := protocol.AdminMessage{
+		Version:   protocol.VERSION_CANONICAL,
+		Host_name: global_host_name,
+		Action:    "list_users",
+		Target:    "",
+		Timestamp: message_timestamp,
+		Nonce:     nonce,
+	}
+	signing_string, err := message.SigningString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := protocol.Sign(admin_private_key, signing_string)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message, string(signature)
+}
+
+func TestAdminMessageReplay(t *testing.T) {
+	testServer(t)
+	store := requestStorage(nil)
+	admin_private_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	global_admin_public_key = admin_private_key.Public()
+	defer initAdmin()
+
+	message, signature := testAdminMessage(t, admin_private_key, "0123456789abcdef")
+	err = verifyAdminMessage(store, admin_private_key.Public(), message, signature, "list_users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verifyAdminMessage(store, admin_private_key.Public(), message, signature, "list_users") == nil {
+		t.Fatal("replayed admin message accepted")
+	}
+
+	/* (r, n-s) is just as valid an ecdsa signature as (r, s) */
+	ecdsa_signature := struct {
+		R *big.Int
+		S *big.Int
+	}{}
+	_, err = asn1.Unmarshal([]byte(signature), &ecdsa_signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsa_signature.S.Sub(elliptic.P256().Params().N, ecdsa_signature.S)
+	malleated_signature, err := asn1.Marshal(ecdsa_signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signing_string, _ := message.SigningString()
+	if !protocol.Verify(admin_private_key.Public(), signing_string, malleated_signature) {
+		t.Fatal("malleated signature doesn't verify")
+	}
+	if verifyAdminMessage(store, admin_private_key.Public(), message, string(malleated_signature), "list_users") == nil {
+		t.Fatal("malleated replay accepted")
+	}
+
+	/* the same action in the same second is fine with another nonce */
+	message, signature = testAdminMessage(t, admin_private_key, "fedcba9876543210")
+	err = verifyAdminMessage(store, admin_private_key.Public(), message, signature, "list_users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, signature = testAdminMessage(t, admin_private_key, "short")
+	if verifyAdminMessage(store, admin_private_key.Public(), message, signature, "list_users") == nil {
+		t.Fatal("accepted a short nonce")
+	}
+}
+
+/* a restart forgets the used messages, so ones signed before it are refused */
+func TestAdminMessageReplayAfterRestart(t *testing.T) {
+	testServer(t)
+	store := requestStorage(nil)
+	admin_private_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	global_admin_public_key = admin_private_key.Public()
+	defer initAdmin()
+
+	global_admin_start_timestamp = timestamp() - 2*ADMIN_TIME_WINDOW
+	message, signature := testAdminMessageAt(t, admin_private_key, "0123456789abcdef", timestamp()-10)
+	err = verifyAdminMessage(store, admin_private_key.Public(), message, signature, "list_users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initAdmin()
+	global_admin_public_key = admin_private_key.Public()
+	if verifyAdminMessage(store, admin_private_key.Public(), message, signature, "list_users") == nil {
+		t.Fatal("admin message replayed after a restart")
+	}
+
+	message, signature = testAdminMessage(t, admin_private_key, "fedcba9876543210")
+	err = verifyAdminMessage(store, admin_private_key.Public(), message, signature, "list_users")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdminMessageHostName(t *testing.T) {
+	testServer(t)
+	store := requestStorage(nil)
+	admin_private_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	global_admin_public_key = admin_private_key.Public()
+	defer initAdmin()
+
+	message, signature := testAdminMessage(t, admin_private_key, "0123456789abcdef")
+	global_host_name = "other"
+	err = verifyAdminMessage(store, admin_private_key.Public(), message, signature, "list_users")
+	if err == nil {
+		t.Fatal("accepted an admin message for another server")
+	}
+
+	global_host_name = "test"
+	err = verifyAdminMessage(store, admin_private_key.Public(), message, signature, "list_users")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,30 +1,161 @@
 package main
 
 import (
+	"crypto"
 	crand "crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
-	"math/rand"
+	"github.com/fivebillionmph/be227a/protocol"
+	"math/big"
 	"net/http"
-	"strconv"
+	"os"
 )
 
+/*
+ * CHALLENGE_SCHEME_ENCRYPTED is rsa pkcs1v15 and kept for older clients,
+ * CHALLENGE_SCHEME_ENCRYPTED_OAEP is rsa oaep with sha256.
+ */
+const CHALLENGE_SCHEME_ENCRYPTED = "encrypted"
+const CHALLENGE_SCHEME_ENCRYPTED_OAEP = "encrypted_oaep"
+const CHALLENGE_SCHEME_SIGNED_NONCE = "signed_nonce"
+
+/*
+ * set with REFUSE_LEGACY_SCHEMES=1 once clients have moved to oaep and pss.
+ * pkcs1v15 challenges and newly submitted pkcs1v15 signatures are refused,
+ * signatures already stored still verify.
+ */
+var global_refuse_legacy_schemes bool
+
+func initLegacySchemes() {
+	global_refuse_legacy_schemes = os.Getenv("REFUSE_LEGACY_SCHEMES") == "1"
+}
+
+/* what a client sends to ask for a challenge, the scheme lists are in order of preference */
+type ChallengeRequest struct {
+	Public_key        string   `json:"public_key"`
+	Challenge_schemes []string `json:"challenge_schemes"`
+	Signature_schemes []string `json:"signature_schemes"`
+}
+
+/* random characters in a nonce, about 190 bits */
+const CHALLENGE_NONCE_LENGTH = 32
+
+/* indexes stay below 2^53 so javascript clients can hold them exactly */
+const CHALLENGE_INDEX_LIMIT = 1 << 53
+
 type UserChallenge struct {
-	public_key       *rsa.PublicKey
+	public_key       crypto.PublicKey
 	start_timestamp  int
 	expire_timestamp int
 	challenge_type   string
 	challenge_nonce  string
 	global_index     int
+	scheme           string
+	signature_scheme string     // how an rsa key must sign the answer, "" for other keys
+	rotation         *DBUserKey // set for rotate challenges
+}
+
+/*
+ * rsa keys sent as pem can have the nonce encrypted to them, if it fits. ssh
+ * keys usually live in ssh-agent, which can sign but not decrypt, so they only
+ * get a signed nonce. with no preference a client gets what older servers sent.
+ */
+func negotiateChallengeScheme(public_key crypto.PublicKey, challenge_request *ChallengeRequest, nonce_length int) (string, error) {
+	available := []string{CHALLENGE_SCHEME_SIGNED_NONCE}
+	rsa_public_key, is_rsa := public_key.(*rsa.PublicKey)
+	if is_rsa && !isSSHPublicKeyString(challenge_request.Public_key) {
+		available = rsaChallengeSchemes(rsa_public_key, nonce_length)
+		if len(challenge_request.Challenge_schemes) == 0 && !global_refuse_legacy_schemes && available[0] != CHALLENGE_SCHEME_SIGNED_NONCE {
+			return CHALLENGE_SCHEME_ENCRYPTED, nil
+		}
+	}
+
+	return negotiateScheme(available, challenge_request.Challenge_schemes, CHALLENGE_SCHEME_ENCRYPTED)
+}
+
+/* oaep with sha256 takes 2*32+2 bytes of the key for padding and pkcs1v15 takes 11, small keys can't fit the nonce */
+func rsaChallengeSchemes(public_key *rsa.PublicKey, nonce_length int) []string {
+	schemes := make([]string, 0, 3)
+	if nonce_length <= public_key.Size()-2*sha256.Size-2 {
+		schemes = append(schemes, CHALLENGE_SCHEME_ENCRYPTED_OAEP)
+	}
+	if nonce_length <= public_key.Size()-11 {
+		schemes = append(schemes, CHALLENGE_SCHEME_ENCRYPTED)
+	}
+	return append(schemes, CHALLENGE_SCHEME_SIGNED_NONCE)
 }
 
-func UserChallenge__new(public_key *rsa.PublicKey, challenge_type string) (*UserChallenge, error) {
-	if challenge_type != "start_session" && challenge_type != "register" {
+/* only rsa keys have a choice */
+func negotiateSignatureScheme(public_key crypto.PublicKey, challenge_request *ChallengeRequest) (string, error) {
+	_, is_rsa := public_key.(*rsa.PublicKey)
+	if !is_rsa {
+		return "", nil
+	}
+	if len(challenge_request.Signature_schemes) == 0 && !global_refuse_legacy_schemes {
+		return protocol.SIGNATURE_SCHEME_PKCS1V15, nil
+	}
+
+	return negotiateScheme([]string{protocol.SIGNATURE_SCHEME_PSS, protocol.SIGNATURE_SCHEME_PKCS1V15}, challenge_request.Signature_schemes, protocol.SIGNATURE_SCHEME_PKCS1V15)
+}
+
+/* the client's first offer the server supports, or the server's first choice if it made none */
+func negotiateScheme(available []string, offered []string, legacy string) (string, error) {
+	allowed := make([]string, 0, len(available))
+	for _, scheme := range available {
+		if scheme != legacy || !global_refuse_legacy_schemes {
+			allowed = append(allowed, scheme)
+		}
+	}
+
+	if len(offered) == 0 {
+		return allowed[0], nil
+	}
+	for _, offer := range offered {
+		for _, scheme := range allowed {
+			if offer == scheme {
+				return scheme, nil
+			}
+		}
+	}
+
+	return "", errors.New("no acceptable scheme")
+}
+
+func UserChallenge__new(public_key crypto.PublicKey, challenge_type string, challenge_request *ChallengeRequest) (*UserChallenge, error) {
+	if challenge_type != protocol.CHALLENGE_TYPE_START_SESSION && challenge_type != protocol.CHALLENGE_TYPE_REGISTER && challenge_type != protocol.CHALLENGE_TYPE_DEACTIVATE {
 		return nil, errors.New("invalid challenge type")
 	}
 
-	nonce := strconv.Itoa(rand.Int())
+	return userChallenge__create(public_key, challenge_type, challenge_request, nil)
+}
+
+/* public_key is the new key, which has to answer before rotation is stored */
+func UserChallenge__newRotation(public_key crypto.PublicKey, challenge_request *ChallengeRequest, rotation *DBUserKey) (*UserChallenge, error) {
+	return userChallenge__create(public_key, protocol.CHALLENGE_TYPE_ROTATE, challenge_request, rotation)
+}
+
+func userChallenge__create(public_key crypto.PublicKey, challenge_type string, challenge_request *ChallengeRequest, rotation *DBUserKey) (*UserChallenge, error) {
+	random, err := randomString(CHALLENGE_NONCE_LENGTH)
+	if err != nil {
+		return nil, err
+	}
+	nonce := protocol.ChallengeNonce{
+		Host_name:      global_host_name,
+		Challenge_type: challenge_type,
+		Random:         random,
+	}.String()
+
+	scheme, err := negotiateChallengeScheme(public_key, challenge_request, len(nonce))
+	if err != nil {
+		return nil, err
+	}
+	signature_scheme, err := negotiateSignatureScheme(public_key, challenge_request)
+	if err != nil {
+		return nil, err
+	}
+
 	now := timestamp()
 	expire := now + 5 // only 5 seconds to reply
 	user_challenge := UserChallenge{
@@ -34,49 +165,88 @@ func UserChallenge__new(public_key *rsa.PublicKey, challenge_type string) (*User
 		challenge_type,
 		nonce,
 		0, // global index default to 0
+		scheme,
+		signature_scheme,
+		rotation,
+	}
+	err = user_challenge.register()
+	if err != nil {
+		return nil, err
 	}
-	user_challenge.register()
 
 	return &user_challenge, nil
 }
 
-func (self *UserChallenge) register() {
-	if self.global_index == 0 {
-		for {
-			self.global_index = rand.Int()
-			_, ok := global_user_challenges[self.global_index]
-			if !ok {
-				global_user_challenges[self.global_index] = self
-				break
-			}
+func (self *UserChallenge) register() error {
+	if self.global_index != 0 {
+		return nil
+	}
+
+	for {
+		index, err := crand.Int(crand.Reader, big.NewInt(CHALLENGE_INDEX_LIMIT))
+		if err != nil {
+			return err
+		}
+		self.global_index = int(index.Int64())
+		if self.global_index != 0 && global_user_challenges.add(self.global_index, self) {
+			return nil
 		}
 	}
 }
 
-func (self *UserChallenge) unregister() {
-	_, ok := global_user_challenges[self.global_index]
-	if ok {
-		delete(global_user_challenges, self.global_index)
-	}
+/* false if the challenge was already used or expired, so only one answer gets through */
+func (self *UserChallenge) unregister() bool {
+	return global_user_challenges.remove(self.global_index)
+}
+
+func (self *UserChallenge) expired(now int) bool {
+	return now > self.expire_timestamp
 }
 
+/*
+ * the encrypted schemes send the nonce encrypted to the rsa key. the signed
+ * nonce scheme sends it in the clear along with the server's signature over
+ * it. either way the client proves ownership by signing the nonce back, with
+ * signature_scheme if the key is rsa.
+ */
 func (self *UserChallenge) sendJSONResponse(w http.ResponseWriter) error {
 	type response_type struct {
-		Message string `json:"message"`
-		Index   int    `json:"index"`
+		Message          string `json:"message"`
+		Index            int    `json:"index"`
+		Scheme           string `json:"scheme"`
+		Signature_scheme string `json:"signature_scheme,omitempty"`
+		Server_signature string `json:"server_signature,omitempty"`
 	}
 
 	message := []byte(self.challenge_nonce)
-	rng := crand.Reader
-
-	ciphertext, err := rsa.EncryptPKCS1v15(rng, self.public_key, message)
-	if err != nil {
-		return err
+	response := response_type{
+		Index:            self.global_index,
+		Signature_scheme: self.signature_scheme,
 	}
 
-	response := response_type{
-		base64.StdEncoding.EncodeToString(ciphertext),
-		self.global_index,
+	switch self.scheme {
+	case CHALLENGE_SCHEME_ENCRYPTED:
+		ciphertext, err := rsa.EncryptPKCS1v15(crand.Reader, self.public_key.(*rsa.PublicKey), message)
+		if err != nil {
+			return err
+		}
+		response.Message = base64.StdEncoding.EncodeToString(ciphertext)
+		response.Scheme = CHALLENGE_SCHEME_ENCRYPTED
+	case CHALLENGE_SCHEME_ENCRYPTED_OAEP:
+		ciphertext, err := rsa.EncryptOAEP(sha256.New(), crand.Reader, self.public_key.(*rsa.PublicKey), message, nil)
+		if err != nil {
+			return err
+		}
+		response.Message = base64.StdEncoding.EncodeToString(ciphertext)
+		response.Scheme = CHALLENGE_SCHEME_ENCRYPTED_OAEP
+	default:
+		server_signature, err := serverSign(message)
+		if err != nil {
+			return err
+		}
+		response.Message = base64.StdEncoding.EncodeToString(message)
+		response.Scheme = CHALLENGE_SCHEME_SIGNED_NONCE
+		response.Server_signature = base64.StdEncoding.EncodeToString(server_signature)
 	}
 
 	sendJSONResponse(w, &response)
@@ -84,15 +254,27 @@ func (self *UserChallenge) sendJSONResponse(w http.ResponseWriter) error {
 }
 
 func (self *UserChallenge) validate(signature string) bool {
-	now := timestamp()
-	if now > self.expire_timestamp {
+	if self.expired(timestamp()) {
 		return false
 	}
 
-	return verifyPublicKeySignature(self.public_key, self.challenge_nonce, signature)
+	return verifyPublicKeySignatureScheme(self.public_key, self.challenge_nonce, signature, self.signature_scheme)
 }
 
-func UserChallenge__getRegistered(index int) *UserChallenge {
-	challenge := global_user_challenges[index]
+/* nil unless the challenge at index was issued for challenge_type */
+func UserChallenge__getRegistered(index int, challenge_type string) *UserChallenge {
+	challenge, _ := global_user_challenges.get(index).(*UserChallenge)
+	if challenge == nil || challenge.challenge_type != challenge_type {
+		return nil
+	}
 	return challenge
 }
+
+func UserChallenge__getAllRegistered() []*UserChallenge {
+	entries := global_user_challenges.values()
+	challenges := make([]*UserChallenge, 0, len(entries))
+	for _, entry := range entries {
+		challenges = append(challenges, entry.(*UserChallenge))
+	}
+	return challenges
+}
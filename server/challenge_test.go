@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/fivebillionmph/be227a/client"
+	"github.com/fivebillionmph/be227a/protocol"
+	"strings"
+	"testing"
+)
+
+func testRSAKey(t *testing.T, bits int) *rsa.PrivateKey {
+	private_key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private_key
+}
+
+/* the nonce is only encrypted with schemes whose padding leaves room for it */
+func TestNegotiateChallengeSchemeKeySize(t *testing.T) {
+	testServer(t)
+	small_key := testRSAKey(t, 1024).Public()
+	large_key := testRSAKey(t, 2048).Public()
+	nonce_length := len(protocol.ChallengeNonce{
+		Host_name:      global_host_name,
+		Challenge_type: protocol.CHALLENGE_TYPE_START_SESSION,
+		Random:         strings.Repeat("x", CHALLENGE_NONCE_LENGTH),
+	}.String())
+
+	tests := []struct {
+		public_key   interface{}
+		nonce_length int
+		offered      []string
+		scheme       string
+	}{
+		{large_key, nonce_length, []string{CHALLENGE_SCHEME_ENCRYPTED_OAEP, CHALLENGE_SCHEME_SIGNED_NONCE}, CHALLENGE_SCHEME_ENCRYPTED_OAEP},
+		{small_key, nonce_length, []string{CHALLENGE_SCHEME_ENCRYPTED_OAEP, CHALLENGE_SCHEME_SIGNED_NONCE}, CHALLENGE_SCHEME_SIGNED_NONCE},
+		{small_key, nonce_length, []string{CHALLENGE_SCHEME_ENCRYPTED_OAEP, CHALLENGE_SCHEME_ENCRYPTED}, CHALLENGE_SCHEME_ENCRYPTED},
+		{small_key, nonce_length, []string{CHALLENGE_SCHEME_ENCRYPTED_OAEP}, ""},
+		{small_key, nonce_length, nil, CHALLENGE_SCHEME_ENCRYPTED},
+		{small_key, 120, nil, CHALLENGE_SCHEME_SIGNED_NONCE},
+		{small_key, 120, []string{CHALLENGE_SCHEME_ENCRYPTED, CHALLENGE_SCHEME_SIGNED_NONCE}, CHALLENGE_SCHEME_SIGNED_NONCE},
+	}
+	for i, test := range tests {
+		scheme, err := negotiateChallengeScheme(test.public_key, &ChallengeRequest{Challenge_schemes: test.offered}, test.nonce_length)
+		if scheme != test.scheme || (err == nil) != (test.scheme != "") {
+			t.Errorf("test %d: got %q %v, want %q", i, scheme, err, test.scheme)
+		}
+	}
+}
+
+/* the shipped client offers oaep first, a key too small for it still registers and starts sessions */
+func TestSmallRSAKeyChallenge(t *testing.T) {
+	test_server := testServer(t)
+	c := client.Client__new(test_server.URL, testRSAKey(t, 1024))
+
+	err := c.Register("small", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := c.StartSession(4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Stop()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	gss "github.com/fivebillionmph/gosimpleserver"
+)
+
+var DBAuditLog__table string = "audit_log"
+
+/* one row per admin action, with the signed admin message that authorized it */
+type DBAuditLog struct {
+	F_id               int
+	F_timestamp        int
+	F_admin_public_key string
+	F_action           string
+	F_target           string
+	F_details          string
+	F_message          string
+	F_signature        string
+}
+
+func (self *DBAuditLog) readRow(row gss.SQLRowInterface) error {
+	err := row.Scan(
+		&self.F_id,
+		&self.F_timestamp,
+		&self.F_admin_public_key,
+		&self.F_action,
+		&self.F_target,
+		&self.F_details,
+		&self.F_message,
+		&self.F_signature,
+	)
+
+	return err
+}
+
+func DBAuditLog__create(store Storage, admin_request *AdminRequest, details string) (*DBAuditLog, error) {
+	message_bytes, err := json.Marshal(&admin_request.message)
+	if err != nil {
+		return nil, err
+	}
+
+	audit_log := DBAuditLog{
+		F_timestamp:        timestamp(),
+		F_admin_public_key: publicKeyToDerString(admin_request.public_key),
+		F_action:           admin_request.message.Action,
+		F_target:           admin_request.message.Target,
+		F_details:          details,
+		F_message:          string(message_bytes),
+		F_signature:        admin_request.signature,
+	}
+
+	id, err := store.auditLogCreate(&audit_log)
+	if err != nil {
+		return nil, err
+	}
+	audit_log.F_id = id
+
+	return &audit_log, nil
+}
+
+/* newest first */
+func DBAuditLog__getRecent(store Storage, limit int) ([]*DBAuditLog, error) {
+	return store.auditLogGetRecent(limit)
+}
+
+func (self *DBAuditLog) adminPublicKeyString() (string, error) {
+	public_key, err := derStringToPublicKey(self.F_admin_public_key)
+	if err != nil {
+		return "", err
+	}
+	return publicKeyToString(public_key)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/fivebillionmph/be227a/protocol"
+	gss "github.com/fivebillionmph/gosimpleserver"
+)
+
+var DBLogEntry__table string = "log_entries"
+
+/* a leaf of the transparency log, F_fields is a json array of the entry's fields */
+type DBLogEntry struct {
+	F_id         int
+	F_leaf_index int
+	F_timestamp  int
+	F_entry_type string
+	F_item_id    int
+	F_fields     string
+}
+
+func (self *DBLogEntry) readRow(row gss.SQLRowInterface) error {
+	err := row.Scan(
+		&self.F_id,
+		&self.F_leaf_index,
+		&self.F_timestamp,
+		&self.F_entry_type,
+		&self.F_item_id,
+		&self.F_fields,
+	)
+
+	return err
+}
+
+func DBLogEntry__getAll(store Storage) ([]*DBLogEntry, error) {
+	return store.logEntryGetAll()
+}
+
+/*
+ * the first entry for the item. deactivations and reactivations are logged
+ * under the user's id, so a user can have several of them.
+ */
+func DBLogEntry__getByItem(store Storage, entry_type string, item_id int) (*DBLogEntry, error) {
+	return store.logEntryGetByItem(entry_type, item_id)
+}
+
+func (self *DBLogEntry) logEntry() (protocol.LogEntry, error) {
+	log_entry := protocol.LogEntry{
+		Entry_type: self.F_entry_type,
+		Item_id:    self.F_item_id,
+		Timestamp:  self.F_timestamp,
+	}
+	err := json.Unmarshal([]byte(self.F_fields), &log_entry.Fields)
+
+	return log_entry, err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/fivebillionmph/be227a/protocol"
+	gss "github.com/fivebillionmph/gosimpleserver"
+)
+
+var DBRevocation__table string = "revocations"
+
+/*
+ * revoked by the signer, or by an admin when F_admin is 1. admin revocations
+ * store the admin message and its signature instead of the signer's.
+ */
+type DBRevocation struct {
+	F_id           int
+	F_timestamp    int
+	F_signature_id int
+	F_message      string
+	F_signature    string
+	F_admin        int
+}
+
+type DBRevocation__VerifyMessage protocol.RevocationMessage
+
+func (self DBRevocation__VerifyMessage) toStorageString() (string, error) {
+	b_array, err := json.Marshal(&self)
+	if err != nil {
+		return "", err
+	}
+	return string(b_array), nil
+}
+
+func (self *DBRevocation) readRow(row gss.SQLRowInterface) error {
+	err := row.Scan(
+		&self.F_id,
+		&self.F_timestamp,
+		&self.F_signature_id,
+		&self.F_message,
+		&self.F_signature,
+		&self.F_admin,
+	)
+
+	return err
+}
+
+func DBRevocation__getByID(store Storage, id int) (*DBRevocation, error) {
+	return store.revocationGetByID(id)
+}
+
+func DBRevocation__getBySignatureID(store Storage, signature_id int) (*DBRevocation, error) {
+	return store.revocationGetBySignatureID(signature_id)
+}
+
+/*
+ * only the original signer may revoke a signature, and only once. legacy
+ * messages are refused, "revoke" + id + timestamp reads the same for
+ * different ids, so one could be replayed against another signature.
+ */
+func DBRevocation__create(store Storage, user_signer *DBUser, db_signature *DBSignature, message DBRevocation__VerifyMessage, signature string) (*DBRevocation, error) {
+	version := protocol.EffectiveVersion(message.Version)
+	if version != protocol.VERSION_CANONICAL {
+		return nil, errors.New("unsupported message version: " + version)
+	}
+
+	if db_signature.F_signer_id != user_signer.F_id {
+		return nil, errors.New("only the signer can revoke a signature")
+	}
+
+	if !DBRevocation__verifyMessage(user_signer, db_signature, message, signature) {
+		return nil, errors.New("invalid revocation message")
+	}
+
+	_, err := DBRevocation__getBySignatureID(store, db_signature.F_id)
+	if err == nil {
+		return nil, errors.New("signature already revoked")
+	}
+
+	message_string, err := message.toStorageString()
+	if err != nil {
+		return nil, err
+	}
+
+	revocation := DBRevocation{
+		F_timestamp:    timestamp(),
+		F_signature_id: db_signature.F_id,
+		F_message:      message_string,
+		F_signature:    signature,
+	}
+
+	id, err := store.revocationCreate(&revocation)
+	if err != nil {
+		return nil, err
+	}
+
+	created_revocation, err := DBRevocation__getByID(store, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = logRevocation(store, created_revocation)
+	if err != nil {
+		store.revocationDelete(created_revocation.F_id)
+		return nil, err
+	}
+
+	return created_revocation, nil
+}
+
+func DBRevocation__createByAdmin(store Storage, db_signature *DBSignature, admin_request *AdminRequest) (*DBRevocation, error) {
+	_, err := DBRevocation__getBySignatureID(store, db_signature.F_id)
+	if err == nil {
+		return nil, errors.New("signature already revoked")
+	}
+
+	message_bytes, err := json.Marshal(&admin_request.message)
+	if err != nil {
+		return nil, err
+	}
+
+	revocation := DBRevocation{
+		F_timestamp:    timestamp(),
+		F_signature_id: db_signature.F_id,
+		F_message:      string(message_bytes),
+		F_signature:    admin_request.signature,
+		F_admin:        1,
+	}
+
+	id, err := store.revocationCreate(&revocation)
+	if err != nil {
+		return nil, err
+	}
+
+	created_revocation, err := DBRevocation__getByID(store, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = logRevocation(store, created_revocation)
+	if err != nil {
+		store.revocationDelete(created_revocation.F_id)
+		return nil, err
+	}
+
+	return created_revocation, nil
+}
+
+func DBRevocation__verifyMessage(signer *DBUser, db_signature *DBSignature, message DBRevocation__VerifyMessage, signature string) bool {
+	if message.Signature_id != db_signature.F_id {
+		return false
+	}
+
+	signer_public_key, err := signer.publicKey()
+	if err != nil {
+		return false
+	}
+
+	signing_string, err := protocol.RevocationMessage(message).SigningString()
+	if err != nil {
+		return false
+	}
+
+	return verifyNewPublicKeySignature(signer_public_key, signing_string, signature)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	gss "github.com/fivebillionmph/gosimpleserver"
+)
+
+var DBRole__table string = "roles"
+
+const ROLE_ADMIN = "admin"
+
+type DBRole struct {
+	F_id        int
+	F_timestamp int
+	F_user_id   int
+	F_role      string
+}
+
+func (self *DBRole) readRow(row gss.SQLRowInterface) error {
+	err := row.Scan(
+		&self.F_id,
+		&self.F_timestamp,
+		&self.F_user_id,
+		&self.F_role,
+	)
+
+	return err
+}
+
+/* granting a role the user already has is not an error */
+func DBRole__grant(store Storage, user *DBUser, role string) error {
+	if DBRole__has(store, user, role) {
+		return nil
+	}
+
+	db_role := DBRole{
+		F_timestamp: timestamp(),
+		F_user_id:   user.F_id,
+		F_role:      role,
+	}
+	_, err := store.roleCreate(&db_role)
+
+	return err
+}
+
+func DBRole__revoke(store Storage, user *DBUser, role string) error {
+	return store.roleDelete(user.F_id, role)
+}
+
+func DBRole__has(store Storage, user *DBUser, role string) bool {
+	roles, err := DBRole__getByUser(store, user)
+	if err != nil {
+		return false
+	}
+	for _, db_role := range roles {
+		if db_role.F_role == role {
+			return true
+		}
+	}
+	return false
+}
+
+func DBRole__getByUser(store Storage, user *DBUser) ([]*DBRole, error) {
+	return store.roleGetByUser(user.F_id)
+}
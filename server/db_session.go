@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/fivebillionmph/be227a/protocol"
+	gss "github.com/fivebillionmph/gosimpleserver"
+	"net"
+	"os"
+)
+
+var DBSession__table string = "sessions"
+
+/* set from PERSIST_SESSIONS, sessions only live in global_user_sessions otherwise */
+var global_persist_sessions bool
+
+type DBSession struct {
+	F_id                  string
+	F_user_id             int
+	F_start_timestamp     int
+	F_lastcheck_timestamp int
+	F_ip                  string
+	F_port                int
+	F_observed_ip         string
+	F_claimed_ip          string
+	F_label               string
+	F_metadata            string // json
+}
+
+func (self *DBSession) readRow(row gss.SQLRowInterface) error {
+	err := row.Scan(
+		&self.F_id,
+		&self.F_user_id,
+		&self.F_start_timestamp,
+		&self.F_lastcheck_timestamp,
+		&self.F_ip,
+		&self.F_port,
+		&self.F_observed_ip,
+		&self.F_claimed_ip,
+		&self.F_label,
+		&self.F_metadata,
+	)
+
+	return err
+}
+
+func initSessionPersistence() {
+	global_persist_sessions = os.Getenv("PERSIST_SESSIONS") == "1"
+}
+
+func DBSession__save(store Storage, session *UserSession) error {
+	if !global_persist_sessions {
+		return nil
+	}
+
+	metadata_bytes, err := json.Marshal(&session.metadata)
+	if err != nil {
+		return err
+	}
+
+	session.mutex.Lock()
+	db_session := DBSession{
+		F_id:                  session.id,
+		F_user_id:             session.db_user.F_id,
+		F_start_timestamp:     session.start_timestamp,
+		F_lastcheck_timestamp: session.lastcheck_timestamp,
+		F_ip:                  session.ip.String(),
+		F_port:                session.port,
+		F_observed_ip:         ipString(session.observed_ip),
+		F_claimed_ip:          ipString(session.claimed_ip),
+		F_label:               session.label,
+		F_metadata:            string(metadata_bytes),
+	}
+	session.mutex.Unlock()
+
+	return store.sessionSave(&db_session)
+}
+
+func DBSession__delete(store Storage, id string) error {
+	if !global_persist_sessions {
+		return nil
+	}
+
+	return store.sessionDelete(id)
+}
+
+/*
+ * loads the saved sessions back into global_user_sessions.
+ * sessions that expired while the server was down, or whose user is gone or
+ * deactivated, are deleted.
+ */
+func DBSession__restoreAll(store Storage) error {
+	if !global_persist_sessions {
+		return nil
+	}
+
+	db_sessions, err := store.sessionGetAll()
+	if err != nil {
+		return err
+	}
+
+	now := timestamp()
+	for _, db_session := range db_sessions {
+		if now > db_session.F_lastcheck_timestamp+SESSION_TIME_LIMIT {
+			store.sessionDelete(db_session.F_id)
+			continue
+		}
+
+		user, err := DBUser__getByID(store, db_session.F_user_id)
+		if err != nil || !user.active() {
+			store.sessionDelete(db_session.F_id)
+			continue
+		}
+
+		metadata := protocol.SessionMetadata{}
+		json.Unmarshal([]byte(db_session.F_metadata), &metadata)
+
+		session := UserSession{
+			db_user:             user,
+			id:                  db_session.F_id,
+			start_timestamp:     db_session.F_start_timestamp,
+			lastcheck_timestamp: db_session.F_lastcheck_timestamp,
+			ip:                  net.ParseIP(db_session.F_ip),
+			observed_ip:         net.ParseIP(db_session.F_observed_ip),
+			claimed_ip:          net.ParseIP(db_session.F_claimed_ip),
+			port:                db_session.F_port,
+			label:               db_session.F_label,
+			metadata:            metadata,
+		}
+		global_user_sessions.add(session.id, &session)
+	}
+
+	return nil
+}
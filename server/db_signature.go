@@ -1,11 +1,12 @@
 package main
 
 import (
+	"crypto"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"github.com/fivebillionmph/be227a/protocol"
 	gss "github.com/fivebillionmph/gosimpleserver"
-	"strconv"
 )
 
 var DBSignature__table string = "signatures"
@@ -19,14 +20,12 @@ type DBSignature struct {
 	F_signature string
 }
 
-type DBSignature__VerifyMessage struct {
-	Public_key   string `json:"public_key"`
-	Start_time   int    `json:"start_time"`
-	End_time     int    `json:"end_time"`
-	Check_server string `json:"check_server"`
-	Message_key  string `json:"message_key"`
-	Modifiers    string `json:"modifiers"`
-}
+const SIGNATURE_STATUS_PENDING = "pending"
+const SIGNATURE_STATUS_VALID = "valid"
+const SIGNATURE_STATUS_EXPIRED = "expired"
+
+/* an End_time of 0 means the signature never expires */
+type DBSignature__VerifyMessage protocol.VerifyMessage
 
 func (self DBSignature__VerifyMessage) toStorageString() (string, error) {
 	b_array, err := json.Marshal(&self)
@@ -36,6 +35,34 @@ func (self DBSignature__VerifyMessage) toStorageString() (string, error) {
 	return string(b_array), nil
 }
 
+func (self DBSignature__VerifyMessage) signingString() (string, error) {
+	return protocol.VerifyMessage(self).SigningString()
+}
+
+func (self DBSignature__VerifyMessage) version() string {
+	return protocol.EffectiveVersion(self.Version)
+}
+
+func (self DBSignature__VerifyMessage) status(now int) string {
+	if now < self.Start_time {
+		return SIGNATURE_STATUS_PENDING
+	}
+	if self.End_time != 0 && now > self.End_time {
+		return SIGNATURE_STATUS_EXPIRED
+	}
+	return SIGNATURE_STATUS_VALID
+}
+
+func (self DBSignature__VerifyMessage) validateTimes(now int) error {
+	if self.End_time != 0 && self.End_time < self.Start_time {
+		return errors.New("end time is before start time")
+	}
+	if self.status(now) == SIGNATURE_STATUS_EXPIRED {
+		return errors.New("signature has already expired")
+	}
+	return nil
+}
+
 func (self DBSignature) message() (*DBSignature__VerifyMessage, error) {
 	verify_message := DBSignature__VerifyMessage{}
 	err := json.Unmarshal([]byte(self.F_message), &verify_message)
@@ -58,88 +85,201 @@ func (self *DBSignature) readRow(row gss.SQLRowInterface) error {
 	return err
 }
 
-func DBSignature__getByID(cxn *gss.DBConnection, id int) (*DBSignature, error) {
-	row := cxn.DB.QueryRow("select * from "+DBSignature__table+" where id = ?", id)
+func DBSignature__getByID(store Storage, id int) (*DBSignature, error) {
+	return store.signatureGetByID(id)
+}
 
-	signature := DBSignature{}
-	err := signature.readRow(row)
+/* new signatures have to use the canonical version, legacy ones are only verified when already stored */
+func DBSignature__create(store Storage, user_signer *DBUser, user_signee *DBUser, message DBSignature__VerifyMessage, signature string) (*DBSignature, error) {
+	if message.version() != protocol.VERSION_CANONICAL {
+		return nil, errors.New("unsupported message version: " + message.version())
+	}
 
-	return &signature, err
-}
+	if !user_signer.active() || !user_signee.active() {
+		return nil, errors.New("user is deactivated")
+	}
 
-func DBSignature__create(cxn *gss.DBConnection, user_signer *DBUser, user_signee *DBUser, message DBSignature__VerifyMessage, signature string) (*DBSignature, error) {
 	if !DBSignature__verifyMessage(user_signer, user_signee, message, signature) {
 		return nil, errors.New("invalid signing message")
 	}
 
-	timestamp := timestamp()
+	err := message.validateTimes(timestamp())
+	if err != nil {
+		return nil, err
+	}
 
-	stmt, err := cxn.DB.Prepare("insert into " + DBSignature__table + " values(NULL, ?, ?, ?, ?, ?)")
+	err = validateMessageKey(message.Message_key, message.Modifiers)
 	if err != nil {
 		return nil, err
 	}
-	defer stmt.Close()
 
 	message_string, err := message.toStorageString()
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := stmt.Exec(timestamp, user_signer.F_id, user_signee.F_id, message_string, signature)
+	db_signature := DBSignature{
+		F_timestamp: timestamp(),
+		F_signer_id: user_signer.F_id,
+		F_signee_id: user_signee.F_id,
+		F_message:   message_string,
+		F_signature: signature,
+	}
 
+	id, err := store.signatureCreate(&db_signature)
 	if err != nil {
 		return nil, err
 	}
 
-	id, err := res.LastInsertId()
+	created_signature, err := DBSignature__getByID(store, id)
 	if err != nil {
 		return nil, err
 	}
 
-	return DBSignature__getByID(cxn, int(id))
-}
-
-func DBSignature__getBySignee(cxn *gss.DBConnection, signee *DBUser) ([]*DBSignature, error) {
-	rows, err := cxn.DB.Query("select * from "+DBSignature__table+" where signee_id = ?", signee.F_id)
+	err = logSignature(store, created_signature, user_signer, user_signee)
 	if err != nil {
+		store.signatureDelete(created_signature.F_id)
 		return nil, err
 	}
 
-	signatures := make([]*DBSignature, 0, 8)
-	for rows.Next() {
-		sig := DBSignature{}
-		err := sig.readRow(rows)
-		if err == nil {
-			signatures = append(signatures, &sig)
-		}
-	}
+	webhookSignatureAdd(store, created_signature, user_signer, user_signee)
+	return created_signature, nil
+}
+
+func DBSignature__getBySignee(store Storage, signee *DBUser) ([]*DBSignature, error) {
+	return store.signatureGetBySignee(signee.F_id)
+}
+
+/* also removes its revocation */
+func DBSignature__delete(store Storage, db_signature *DBSignature) error {
+	return store.signatureDelete(db_signature.F_id)
+}
 
-	return signatures, nil
+func DBSignature__getBySigner(store Storage, signer *DBUser) ([]*DBSignature, error) {
+	return store.signatureGetBySigner(signer.F_id)
 }
 
+/* for signatures being submitted, which may not use a refused legacy scheme */
 func DBSignature__verifyMessage(signer *DBUser, signee *DBUser, message DBSignature__VerifyMessage, signature string) bool {
 	signee_public_key_string, err := signee.publicKeyString()
 	if err != nil {
 		return false
 	}
-	if signee_public_key_string != message.Public_key {
+
+	signer_public_key, err := signer.publicKey()
+	if err != nil {
 		return false
 	}
 
-	signer_public_key, err := signer.publicKey()
+	if !samePublicKeyString(signee_public_key_string, message.Public_key) {
+		return false
+	}
+
+	signing_string, err := message.signingString()
 	if err != nil {
 		return false
 	}
 
-	message_str := message.Public_key + strconv.Itoa(message.Start_time) + strconv.Itoa(message.End_time) + message.Check_server + message.Message_key + message.Modifiers
+	return verifyNewPublicKeySignature(signer_public_key, signing_string, signature)
+}
 
-	return verifyPublicKeySignature(signer_public_key, message_str, signature)
+/*
+ * for signatures made before a key rotation, where the signer may have signed
+ * with an older key or vouched for one of the signee's older keys.
+ */
+func DBSignature__verifyMessageLineage(store Storage, signer *DBUser, signee *DBUser, message DBSignature__VerifyMessage, signature string) bool {
+	return DBSignature__lineageSignerKey(store, signer, signee, message, signature) != nil
+}
+
+/* the key in the signer's lineage that made the signature, nil if none did */
+func DBSignature__lineageSignerKey(store Storage, signer *DBUser, signee *DBUser, message DBSignature__VerifyMessage, signature string) crypto.PublicKey {
+	signee_public_key_strings := make([]string, 0, 2)
+	for _, signee_public_key := range signee.lineagePublicKeys(store) {
+		signee_public_key_string, err := publicKeyToString(signee_public_key)
+		if err == nil {
+			signee_public_key_strings = append(signee_public_key_strings, signee_public_key_string)
+		}
+	}
+
+	for _, signer_public_key := range signer.lineagePublicKeys(store) {
+		for _, signee_public_key_string := range signee_public_key_strings {
+			if DBSignature__verifyMessageWithKeys(signer_public_key, signee_public_key_string, message, signature) {
+				return signer_public_key
+			}
+		}
+	}
+
+	return nil
+}
+
+/* for signatures whose signer or signee may not be registered locally */
+func DBSignature__verifyMessageWithKeys(signer_public_key crypto.PublicKey, signee_public_key_string string, message DBSignature__VerifyMessage, signature string) bool {
+	if !samePublicKeyString(signee_public_key_string, message.Public_key) {
+		return false
+	}
+
+	signing_string, err := message.signingString()
+	if err != nil {
+		return false
+	}
+
+	return verifyPublicKeySignature(signer_public_key, signing_string, signature)
 }
 
 func (self *DBSignature) base64Signature() string {
 	return base64.StdEncoding.EncodeToString([]byte(self.F_signature))
 }
 
-func (self *DBSignature) signer(cxn *gss.DBConnection) (*DBUser, error) {
-	return DBUser__getByID(cxn, self.F_signer_id)
+func (self *DBSignature) signer(store Storage) (*DBUser, error) {
+	return DBUser__getByID(store, self.F_signer_id)
+}
+
+func (self *DBSignature) signee(store Storage) (*DBUser, error) {
+	return DBUser__getByID(store, self.F_signee_id)
+}
+
+/* the status of an unreadable message is reported as expired */
+func (self *DBSignature) status(now int) string {
+	message, err := self.message()
+	if err != nil {
+		return SIGNATURE_STATUS_EXPIRED
+	}
+	return message.status(now)
+}
+
+/* unreadable messages report the legacy version */
+func (self *DBSignature) version() string {
+	message, err := self.message()
+	if err != nil {
+		return protocol.VERSION_LEGACY
+	}
+	return message.version()
+}
+
+/* an older key of the signer if the signature was made before they rotated */
+func (self *DBSignature) signerPublicKey(store Storage, signer *DBUser) (crypto.PublicKey, error) {
+	signee, err := self.signee(store)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := self.message()
+	if err != nil {
+		return nil, err
+	}
+
+	signer_public_key := DBSignature__lineageSignerKey(store, signer, signee, *message, self.F_signature)
+	if signer_public_key == nil {
+		return nil, errors.New("signature was not made by any of the signer's keys")
+	}
+	return signer_public_key, nil
+}
+
+/* returns nil if the signature has not been revoked */
+func (self *DBSignature) revocation(store Storage) *DBRevocation {
+	revocation, err := DBRevocation__getBySignatureID(store, self.F_id)
+	if err != nil {
+		return nil
+	}
+	return revocation
 }
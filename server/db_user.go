@@ -1,8 +1,9 @@
 package main
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"errors"
+	"github.com/fivebillionmph/be227a/protocol"
 	gss "github.com/fivebillionmph/gosimpleserver"
 )
 
@@ -15,7 +16,7 @@ type DBUser struct {
 	F_organization string
 	F_public_key   string
 	F_active       int
-	public_key     *rsa.PublicKey
+	public_key     crypto.PublicKey
 }
 
 func (self *DBUser) readRow(row gss.SQLRowInterface) error {
@@ -31,90 +32,79 @@ func (self *DBUser) readRow(row gss.SQLRowInterface) error {
 	return err
 }
 
-func DBUser__getByID(cxn *gss.DBConnection, id int) (*DBUser, error) {
-	row := cxn.DB.QueryRow("select * from "+DBUser__table+" where id = ?", id)
-
-	user := DBUser{}
-	err := user.readRow(row)
-
-	return &user, err
+func DBUser__getByID(store Storage, id int) (*DBUser, error) {
+	return store.userGetByID(id)
 }
 
-func DBUser__create(cxn *gss.DBConnection, name string, organization string, public_key *rsa.PublicKey) (*DBUser, error) {
-	timestamp := timestamp()
-	active := 1
-
+func DBUser__create(store Storage, name string, organization string, public_key crypto.PublicKey) (*DBUser, error) {
 	if name == "" {
 		return nil, errors.New("name cannot be empty")
 	}
 
-	stmt, err := cxn.DB.Prepare("insert into " + DBUser__table + " values(NULL, ?, ?, ?, ?, ?)")
+	public_key_der := publicKeyToDerString(public_key)
+	if public_key_der == "" {
+		return nil, errors.New("unsupported public key")
+	}
+	if DBUserKey__keyInUse(store, public_key) {
+		return nil, errors.New("public key is already in use")
+	}
+
+	user := DBUser{
+		F_timestamp:    timestamp(),
+		F_name:         name,
+		F_organization: organization,
+		F_public_key:   public_key_der,
+		F_active:       1,
+	}
+
+	id, err := store.userCreate(&user)
 	if err != nil {
 		return nil, err
 	}
-	defer stmt.Close()
 
-	res, err := stmt.Exec(timestamp, name, organization, publicKeyToDerString(public_key), active)
+	db_user, err := DBUser__getByID(store, id)
 	if err != nil {
 		return nil, err
 	}
 
-	id, err := res.LastInsertId()
+	err = logUser(store, db_user)
 	if err != nil {
+		store.userDelete(db_user.F_id)
 		return nil, err
 	}
 
-	return DBUser__getByID(cxn, int(id))
+	webhookUserRegister(store, db_user)
+	return db_user, nil
 }
 
-func DBUser__getByPublicKey(cxn *gss.DBConnection, public_key *rsa.PublicKey) (*DBUser, error) {
-	public_key_der := publicKeyToDerString(public_key)
-	row := cxn.DB.QueryRow("select * from "+DBUser__table+" where public_key = ?", public_key_der)
-
-	user := DBUser{}
-	err := user.readRow(row)
-
-	return &user, err
+func DBUser__getByPublicKey(store Storage, public_key crypto.PublicKey) (*DBUser, error) {
+	return store.userGetByPublicKey(publicKeyToDerString(public_key))
 }
 
-func DBUser__getAll(cxn *gss.DBConnection) ([]*DBUser, error) {
-	rows, err := cxn.DB.Query("select * from " + DBUser__table)
-	if err != nil {
-		return nil, err
+/* also finds users by keys they have rotated away from */
+func DBUser__getByAnyPublicKey(store Storage, public_key crypto.PublicKey) (*DBUser, error) {
+	user, err := DBUser__getByPublicKey(store, public_key)
+	if err == nil {
+		return user, nil
 	}
 
-	users := make([]*DBUser, 0, 8)
-	for rows.Next() {
-		user := DBUser{}
-		err := user.readRow(rows)
-		if err == nil {
-			users = append(users, &user)
-		}
+	user_key, err := store.userKeyGetByPublicKey(publicKeyToDerString(public_key))
+	if err != nil {
+		return user, err
 	}
 
-	return users, nil
+	return DBUser__getByID(store, user_key.F_user_id)
 }
 
-func DBUser__getByQuery(cxn *gss.DBConnection, query string) ([]*DBUser, error) {
-	sql_query := "%" + query + "%"
-	rows, err := cxn.DB.Query("select * from "+DBUser__table+" where name like ? or organization like ?", sql_query, sql_query)
-	if err != nil {
-		return nil, err
-	}
-
-	users := make([]*DBUser, 0, 8)
-	for rows.Next() {
-		user := DBUser{}
-		err := user.readRow(rows)
-		if err == nil {
-			users = append(users, &user)
-		}
-	}
+func DBUser__getAll(store Storage) ([]*DBUser, error) {
+	return store.userGetAll()
+}
 
-	return users, nil
+func DBUser__getByQuery(store Storage, query string) ([]*DBUser, error) {
+	return store.userGetByQuery(query)
 }
 
-func (self *DBUser) publicKey() (*rsa.PublicKey, error) {
+func (self *DBUser) publicKey() (crypto.PublicKey, error) {
 	if self.public_key == nil {
 		var err error
 		self.public_key, err = derStringToPublicKey(self.F_public_key)
@@ -134,3 +124,71 @@ func (self *DBUser) publicKeyString() (string, error) {
 
 	return publicKeyToString(public_key)
 }
+
+func (self *DBUser) active() bool {
+	return self.F_active != 0
+}
+
+/* also ends the user's sessions and stops them from starting new ones */
+func DBUser__deactivate(store Storage, user *DBUser) error {
+	if !user.active() {
+		return errors.New("user is already deactivated")
+	}
+
+	err := store.userSetActive(user.F_id, 0)
+	if err != nil {
+		return err
+	}
+	err = logUserActive(store, user, protocol.LOG_ENTRY_DEACTIVATION)
+	if err != nil {
+		store.userSetActive(user.F_id, user.F_active)
+		return err
+	}
+	user.F_active = 0
+
+	UserSession__deleteByUser(store, user.F_id)
+
+	return nil
+}
+
+func DBUser__reactivate(store Storage, user *DBUser) error {
+	if user.active() {
+		return errors.New("user is already active")
+	}
+
+	err := store.userSetActive(user.F_id, 1)
+	if err != nil {
+		return err
+	}
+	err = logUserActive(store, user, protocol.LOG_ENTRY_REACTIVATION)
+	if err != nil {
+		store.userSetActive(user.F_id, user.F_active)
+		return err
+	}
+	user.F_active = 1
+
+	return nil
+}
+
+/* the current key first, then the keys rotated away from, newest first */
+func (self *DBUser) lineagePublicKeys(store Storage) []crypto.PublicKey {
+	public_keys := make([]crypto.PublicKey, 0, 2)
+
+	public_key, err := self.publicKey()
+	if err == nil {
+		public_keys = append(public_keys, public_key)
+	}
+
+	user_keys, err := DBUserKey__getByUser(store, self)
+	if err != nil {
+		return public_keys
+	}
+	for i := len(user_keys) - 1; i >= 0; i-- {
+		old_public_key, err := derStringToPublicKey(user_keys[i].F_public_key)
+		if err == nil {
+			public_keys = append(public_keys, old_public_key)
+		}
+	}
+
+	return public_keys
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"github.com/fivebillionmph/be227a/protocol"
+	gss "github.com/fivebillionmph/gosimpleserver"
+)
+
+var DBUserKey__table string = "user_keys"
+
+/* how far the succession statement's timestamp may be from the server's clock */
+const ROTATION_TIME_WINDOW = 300 // seconds
+
+/*
+ * a key a user held before rotating to F_new_public_key, along with the
+ * succession statement the old key signed to hand over to the new one.
+ */
+type DBUserKey struct {
+	F_id             int
+	F_timestamp      int
+	F_user_id        int
+	F_public_key     string
+	F_new_public_key string
+	F_message        string
+	F_signature      string
+}
+
+type DBUserKey__VerifyMessage protocol.SuccessionMessage
+
+func (self DBUserKey__VerifyMessage) toStorageString() (string, error) {
+	b_array, err := json.Marshal(&self)
+	if err != nil {
+		return "", err
+	}
+	return string(b_array), nil
+}
+
+func (self *DBUserKey) readRow(row gss.SQLRowInterface) error {
+	err := row.Scan(
+		&self.F_id,
+		&self.F_timestamp,
+		&self.F_user_id,
+		&self.F_public_key,
+		&self.F_new_public_key,
+		&self.F_message,
+		&self.F_signature,
+	)
+
+	return err
+}
+
+func DBUserKey__getByUser(store Storage, user *DBUser) ([]*DBUserKey, error) {
+	return store.userKeyGetByUser(user.F_id)
+}
+
+/* the rotations from public_key to the user's current key, oldest first, none if it's the current key */
+func DBUserKey__getSuccessionFrom(store Storage, user *DBUser, public_key crypto.PublicKey) ([]*DBUserKey, error) {
+	user_keys, err := DBUserKey__getByUser(store, user)
+	if err != nil {
+		return nil, err
+	}
+
+	public_key_der := publicKeyToDerString(public_key)
+	if public_key_der == user.F_public_key {
+		return user_keys[:0], nil
+	}
+	for i, user_key := range user_keys {
+		if user_key.F_public_key == public_key_der {
+			return user_keys[i:], nil
+		}
+	}
+
+	return nil, errors.New("key is not in the user's history")
+}
+
+/* true if the key is anyone's current key or was ever rotated away from */
+func DBUserKey__keyInUse(store Storage, public_key crypto.PublicKey) bool {
+	public_key_der := publicKeyToDerString(public_key)
+
+	_, err := store.userGetByPublicKey(public_key_der)
+	if err == nil {
+		return true
+	}
+	_, err = store.userKeyGetByPublicKey(public_key_der)
+	return err == nil
+}
+
+/*
+ * checks the succession statement signed by the user's current key and returns
+ * the record to store once the new key has passed its challenge.
+ */
+func DBUserKey__prepareRotation(store Storage, user *DBUser, message DBUserKey__VerifyMessage, signature string) (*DBUserKey, crypto.PublicKey, error) {
+	if message.Version != protocol.VERSION_CANONICAL {
+		return nil, nil, errors.New("succession statements must use the canonical version")
+	}
+
+	if !user.active() {
+		return nil, nil, errors.New("user is deactivated")
+	}
+
+	now := timestamp()
+	if message.Timestamp < now-ROTATION_TIME_WINDOW || message.Timestamp > now+ROTATION_TIME_WINDOW {
+		return nil, nil, errors.New("succession statement timestamp out of range")
+	}
+
+	old_public_key_string, err := user.publicKeyString()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !samePublicKeyString(old_public_key_string, message.Old_public_key) {
+		return nil, nil, errors.New("old key is not the user's current key")
+	}
+
+	new_public_key, err := stringToPublicKey(message.New_public_key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if DBUserKey__keyInUse(store, new_public_key) {
+		return nil, nil, errors.New("new key is already in use")
+	}
+
+	old_public_key, err := user.publicKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	signing_string, err := protocol.SuccessionMessage(message).SigningString()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !verifyNewPublicKeySignature(old_public_key, signing_string, signature) {
+		return nil, nil, errors.New("invalid succession signature")
+	}
+
+	message_string, err := message.toStorageString()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	user_key := DBUserKey{
+		F_user_id:        user.F_id,
+		F_public_key:     user.F_public_key,
+		F_new_public_key: publicKeyToDerString(new_public_key),
+		F_message:        message_string,
+		F_signature:      signature,
+	}
+
+	return &user_key, new_public_key, nil
+}
+
+/* moves the user onto the new key and keeps the old one in the history */
+func DBUserKey__rotate(store Storage, user_key *DBUserKey) (*DBUser, error) {
+	user, err := DBUser__getByID(store, user_key.F_user_id)
+	if err != nil {
+		return nil, err
+	}
+	if user.F_public_key != user_key.F_public_key {
+		return nil, errors.New("key was already rotated")
+	}
+
+	/* the user or the new key may have changed while the challenge was out */
+	if !user.active() {
+		return nil, errors.New("user is deactivated")
+	}
+	new_public_key, err := derStringToPublicKey(user_key.F_new_public_key)
+	if err != nil {
+		return nil, err
+	}
+	if DBUserKey__keyInUse(store, new_public_key) {
+		return nil, errors.New("new key is already in use")
+	}
+
+	user_key.F_timestamp = timestamp()
+	id, err := store.userKeyCreate(user_key)
+	if err != nil {
+		return nil, err
+	}
+	user_key.F_id = id
+
+	err = store.userUpdatePublicKey(user.F_id, user_key.F_new_public_key)
+	if err != nil {
+		store.userKeyDelete(id)
+		return nil, err
+	}
+
+	err = logRotation(store, user_key)
+	if err != nil {
+		store.userUpdatePublicKey(user.F_id, user.F_public_key)
+		store.userKeyDelete(id)
+		return nil, err
+	}
+
+	return DBUser__getByID(store, user.F_id)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	gss "github.com/fivebillionmph/gosimpleserver"
+)
+
+var DBWebhookDelivery__table string = "webhook_deliveries"
+
+const WEBHOOK_STATUS_PENDING = "pending"
+const WEBHOOK_STATUS_DELIVERED = "delivered"
+const WEBHOOK_STATUS_FAILED = "failed"
+
+/*
+ * one event for one webhook url. pending rows are the delivery queue, they
+ * stay in the table once delivered or given up on as the delivery log.
+ */
+type DBWebhookDelivery struct {
+	F_id                     int
+	F_timestamp              int
+	F_url                    string
+	F_event_type             string
+	F_payload                string
+	F_status                 string
+	F_attempts               int
+	F_next_attempt_timestamp int
+	F_last_attempt_timestamp int
+	F_last_status_code       int
+	F_last_error             string
+}
+
+func (self *DBWebhookDelivery) readRow(row gss.SQLRowInterface) error {
+	err := row.Scan(
+		&self.F_id,
+		&self.F_timestamp,
+		&self.F_url,
+		&self.F_event_type,
+		&self.F_payload,
+		&self.F_status,
+		&self.F_attempts,
+		&self.F_next_attempt_timestamp,
+		&self.F_last_attempt_timestamp,
+		&self.F_last_status_code,
+		&self.F_last_error,
+	)
+
+	return err
+}
+
+func DBWebhookDelivery__create(store Storage, url string, event_type string, payload string) (*DBWebhookDelivery, error) {
+	now := timestamp()
+	delivery := DBWebhookDelivery{
+		F_timestamp:              now,
+		F_url:                    url,
+		F_event_type:             event_type,
+		F_payload:                payload,
+		F_status:                 WEBHOOK_STATUS_PENDING,
+		F_next_attempt_timestamp: now,
+	}
+
+	id, err := store.webhookDeliveryCreate(&delivery)
+	if err != nil {
+		return nil, err
+	}
+	delivery.F_id = id
+
+	return &delivery, nil
+}
+
+/* pending deliveries whose next attempt is due at now, oldest first */
+func DBWebhookDelivery__getDue(store Storage, now int, limit int) ([]*DBWebhookDelivery, error) {
+	return store.webhookDeliveryGetDue(now, limit)
+}
+
+/* newest first */
+func DBWebhookDelivery__getRecent(store Storage, limit int) ([]*DBWebhookDelivery, error) {
+	return store.webhookDeliveryGetRecent(limit)
+}
+
+func (self *DBWebhookDelivery) update(store Storage) error {
+	return store.webhookDeliveryUpdate(self)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/fivebillionmph/be227a/protocol"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+ * other instances of this server that are trusted to vouch for their users' keys.
+ * configured with FEDERATION_PEERS as a comma separated list of base urls.
+ */
+type FederationPeer struct {
+	base_url string
+	host     string
+}
+
+/* wire format of a signature in /a/signatures, shared with peers */
+type FederationSignature struct {
+	Id                int              `json:"id"`
+	Signature         string           `json:"signature"`
+	Message           string           `json:"message"`
+	Signer            FederationSigner `json:"signer"`
+	Revoked           bool             `json:"revoked"`
+	Revoked_timestamp int              `json:"revoked_timestamp,omitempty"`
+	Status            string           `json:"status"`
+	Version           string           `json:"version"`
+	Server            string           `json:"server"`
+}
+
+/*
+ * Public_key is the key that made the signature. if the signer has rotated
+ * since, Succession holds the statements leading from it to Current_public_key.
+ */
+type FederationSigner struct {
+	Public_key         string                 `json:"public_key"`
+	Current_public_key string                 `json:"current_public_key"`
+	Succession         []FederationSuccession `json:"succession,omitempty"`
+	Name               string                 `json:"name"`
+	Organization       string                 `json:"organization"`
+	Active             bool                   `json:"active"`
+}
+
+/* a succession statement and the old key's base64 signature of it */
+type FederationSuccession struct {
+	Message   protocol.SuccessionMessage `json:"message"`
+	Signature string                     `json:"signature"`
+}
+
+/* peers that send more than this are cut off */
+const FEDERATION_MAX_RESPONSE_SIZE = 4 << 20 // bytes
+
+/*
+ * the users a peer listed for a name, by peer and name, so verifying many
+ * signatures from one signer asks the peer once. only kept for one request.
+ */
+type FederationKeyCache map[string][]FederationSigner
+
+var global_federation_peers []*FederationPeer
+
+var federation_http_client = &http.Client{Timeout: 5 * time.Second}
+
+func initFederationPeers() error {
+	global_federation_peers = make([]*FederationPeer, 0)
+
+	peers_str := os.Getenv("FEDERATION_PEERS")
+	if peers_str == "" {
+		return nil
+	}
+
+	for _, peer_str := range strings.Split(peers_str, ",") {
+		peer_str = strings.TrimRight(strings.TrimSpace(peer_str), "/")
+		if peer_str == "" {
+			continue
+		}
+		peer_url, err := url.Parse(peer_str)
+		if err != nil || peer_url.Host == "" {
+			return errors.New("invalid federation peer: " + peer_str)
+		}
+		peer := FederationPeer{
+			base_url: peer_str,
+			host:     peer_url.Hostname(),
+		}
+		global_federation_peers = append(global_federation_peers, &peer)
+	}
+
+	return nil
+}
+
+/* check_server may be a peer's host name or its base url, returns nil for untrusted servers */
+func FederationPeer__find(check_server string) *FederationPeer {
+	check_server = strings.TrimRight(check_server, "/")
+	if check_server == "" {
+		return nil
+	}
+
+	for _, peer := range global_federation_peers {
+		if peer.base_url == check_server || peer.host == check_server {
+			return peer
+		}
+	}
+
+	return nil
+}
+
+func (self *FederationPeer) getJSON(path string, request_body interface{}, response interface{}) error {
+	var body bytes.Buffer
+	if request_body != nil {
+		err := json.NewEncoder(&body).Encode(request_body)
+		if err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequest("GET", self.base_url+path, &body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-type", "application/json")
+
+	res, err := federation_http_client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return errors.New("peer " + self.host + " returned " + res.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(res.Body, FEDERATION_MAX_RESPONSE_SIZE)).Decode(response)
+}
+
+func (self *FederationPeer) getSignatures(public_key_string string) ([]FederationSignature, error) {
+	json_request := struct {
+		Key        string `json:"key"`
+		Local_only bool   `json:"local_only"`
+	}{
+		public_key_string,
+		true,
+	}
+	json_response := struct {
+		Signatures []FederationSignature `json:"signatures"`
+	}{}
+
+	err := self.getJSON("/a/signatures", &json_request, &json_response)
+	if err != nil {
+		return nil, err
+	}
+
+	return json_response.Signatures, nil
+}
+
+/* true if the peer lists public_key_string under a user matching name */
+func (self *FederationPeer) hasKey(public_key_string string, name string, cache FederationKeyCache) bool {
+	cache_key := self.base_url + "\n" + name
+	users, ok := cache[cache_key]
+	if !ok {
+		json_response := struct {
+			Users []FederationSigner `json:"users"`
+		}{}
+
+		err := self.getJSON("/a/keys?q="+url.QueryEscape(name), nil, &json_response)
+		if err != nil {
+			return false
+		}
+		users = json_response.Users
+		cache[cache_key] = users
+	}
+
+	/* peers only list active users */
+	for _, user := range users {
+		if samePublicKeyString(user.Public_key, public_key_string) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+ * asks every peer for the signatures on public_key_string and keeps the ones that verify.
+ * a signer must either be registered locally or be listed in /a/keys of the trusted
+ * peer named by the message's Check_server.
+ */
+func federatedSignatures(store Storage, public_key_string string) []FederationSignature {
+	signatures := make([]FederationSignature, 0)
+	cache := make(FederationKeyCache)
+
+	for _, peer := range global_federation_peers {
+		peer_signatures, err := peer.getSignatures(public_key_string)
+		if err != nil {
+			continue
+		}
+
+		for _, peer_signature := range peer_signatures {
+			if !verifyFederationSignature(store, public_key_string, peer_signature, cache) {
+				continue
+			}
+			peer_signature.Status = federationSignatureStatus(peer_signature, timestamp())
+			peer_signature.Version = federationSignatureVersion(peer_signature)
+			peer_signature.Server = peer.host
+			signatures = append(signatures, peer_signature)
+		}
+	}
+
+	return signatures
+}
+
+func verifyFederationSignature(store Storage, public_key_string string, fsig FederationSignature, cache FederationKeyCache) bool {
+	message := DBSignature__VerifyMessage{}
+	err := json.Unmarshal([]byte(fsig.Message), &message)
+	if err != nil {
+		return false
+	}
+
+	if !samePublicKeyString(message.Public_key, public_key_string) {
+		return false
+	}
+
+	signer_public_key, err := stringToPublicKey(fsig.Signer.Public_key)
+	if err != nil {
+		return false
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(fsig.Signature)
+	if err != nil {
+		return false
+	}
+
+	if !DBSignature__verifyMessageWithKeys(signer_public_key, message.Public_key, message, string(signature)) {
+		return false
+	}
+
+	/* the local key history is trusted over what the peer sent */
+	signer, err := DBUser__getByAnyPublicKey(store, signer_public_key)
+	if err == nil {
+		return signer.active()
+	}
+
+	current_public_key_string, ok := fsig.Signer.followSuccession()
+	if !ok {
+		return false
+	}
+
+	peer := FederationPeer__find(message.Check_server)
+	if peer == nil {
+		return false
+	}
+
+	return peer.hasKey(current_public_key_string, fsig.Signer.Name, cache)
+}
+
+/*
+ * checks every succession statement was signed by the key before it and
+ * returns the key they lead to, which must be Current_public_key if it's set.
+ */
+func (self FederationSigner) followSuccession() (string, bool) {
+	public_key_string := self.Public_key
+	for _, succession := range self.Succession {
+		if !samePublicKeyString(succession.Message.Old_public_key, public_key_string) {
+			return "", false
+		}
+
+		old_public_key, err := stringToPublicKey(public_key_string)
+		if err != nil {
+			return "", false
+		}
+		signing_string, err := succession.Message.SigningString()
+		if err != nil {
+			return "", false
+		}
+		signature, err := base64.StdEncoding.DecodeString(succession.Signature)
+		if err != nil {
+			return "", false
+		}
+		if !verifyPublicKeySignature(old_public_key, signing_string, string(signature)) {
+			return "", false
+		}
+
+		public_key_string = succession.Message.New_public_key
+	}
+
+	/* peers from before key rotation don't send the current key */
+	if self.Current_public_key != "" && !samePublicKeyString(self.Current_public_key, public_key_string) {
+		return "", false
+	}
+
+	return public_key_string, true
+}
+
+/* the signer as listed with a signature made by signer_public_key */
+func FederationSigner__new(store Storage, signer *DBUser, signer_public_key crypto.PublicKey) (*FederationSigner, error) {
+	public_key_string, err := publicKeyToString(signer_public_key)
+	if err != nil {
+		return nil, err
+	}
+	current_public_key_string, err := signer.publicKeyString()
+	if err != nil {
+		return nil, err
+	}
+
+	user_keys, err := DBUserKey__getSuccessionFrom(store, signer, signer_public_key)
+	if err != nil {
+		return nil, err
+	}
+	succession := make([]FederationSuccession, 0, len(user_keys))
+	for _, user_key := range user_keys {
+		message := protocol.SuccessionMessage{}
+		err := json.Unmarshal([]byte(user_key.F_message), &message)
+		if err != nil {
+			return nil, err
+		}
+		succession = append(succession, FederationSuccession{
+			Message:   message,
+			Signature: base64.StdEncoding.EncodeToString([]byte(user_key.F_signature)),
+		})
+	}
+
+	return &FederationSigner{
+		Public_key:         public_key_string,
+		Current_public_key: current_public_key_string,
+		Succession:         succession,
+		Name:               signer.F_name,
+		Organization:       signer.F_organization,
+		Active:             signer.active(),
+	}, nil
+}
+
+func (self FederationSignature) inScope(scope string) bool {
+	message := DBSignature__VerifyMessage{}
+	err := json.Unmarshal([]byte(self.Message), &message)
+	if err != nil {
+		return false
+	}
+	return messageKeyInScope(message.Message_key, scope)
+}
+
+/* recomputed locally rather than trusting the peer's clock */
+func federationSignatureStatus(fsig FederationSignature, now int) string {
+	message := DBSignature__VerifyMessage{}
+	err := json.Unmarshal([]byte(fsig.Message), &message)
+	if err != nil {
+		return SIGNATURE_STATUS_EXPIRED
+	}
+	return message.status(now)
+}
+
+func federationSignatureVersion(fsig FederationSignature) string {
+	message := DBSignature__VerifyMessage{}
+	err := json.Unmarshal([]byte(fsig.Message), &message)
+	if err != nil {
+		return protocol.VERSION_LEGACY
+	}
+	return message.version()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/fivebillionmph/be227a/client"
+	"github.com/fivebillionmph/be227a/protocol"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+/* a peer listing signatures on signee_public_key by a signer it vouches for, counting /a/keys requests */
+func testFederationPeer(t *testing.T, signee_public_key string, signature_count int) (*httptest.Server, *int32) {
+	signer_private_key, _ := client.GenerateKey("ed25519")
+	signer_public_key, _ := protocol.PublicKeyToString(signer_private_key.Public())
+	signer := FederationSigner{Public_key: signer_public_key, Name: "peer signer", Active: true}
+
+	key_requests := new(int32)
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a/keys":
+			atomic.AddInt32(key_requests, 1)
+			json.NewEncoder(w).Encode(map[string]interface{}{"users": []FederationSigner{signer}})
+		case "/a/signatures":
+			signatures := make([]FederationSignature, 0)
+			for i := 0; i < signature_count; i++ {
+				message := DBSignature__VerifyMessage{
+					Version:      protocol.VERSION_CANONICAL,
+					Public_key:   signee_public_key,
+					Start_time:   timestamp() - 10 - i,
+					Check_server: "http://" + r.Host,
+					Message_key:  "identity",
+				}
+				signing_string, _ := message.signingString()
+				signature, _ := protocol.Sign(signer_private_key, signing_string)
+				message_string, _ := message.toStorageString()
+				signatures = append(signatures, FederationSignature{
+					Id:        i + 1,
+					Signature: base64.StdEncoding.EncodeToString(signature),
+					Message:   message_string,
+					Signer:    signer,
+				})
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"signatures": signatures})
+		case "/a/huge":
+			w.Write([]byte("[" + strings.Repeat(" ", FEDERATION_MAX_RESPONSE_SIZE) + "]"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(peer.Close)
+
+	t.Cleanup(func() { initFederationPeers() })
+	t.Setenv("FEDERATION_PEERS", peer.URL)
+	err := initFederationPeers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return peer, key_requests
+}
+
+/* a peer's signer is looked up once per request, not once per signature */
+func TestFederatedSignaturesKeyCache(t *testing.T) {
+	testServer(t)
+	_, signee_public_key := testClient(t, "", "ed25519", "")
+	_, key_requests := testFederationPeer(t, signee_public_key, 5)
+
+	signatures := federatedSignatures(requestStorage(nil), signee_public_key)
+	if len(signatures) != 5 {
+		t.Fatal("got", len(signatures), "federated signatures")
+	}
+	if n := atomic.LoadInt32(key_requests); n != 1 {
+		t.Fatal("asked the peer for its keys", n, "times")
+	}
+
+	/* the cache doesn't outlive the request */
+	federatedSignatures(requestStorage(nil), signee_public_key)
+	if n := atomic.LoadInt32(key_requests); n != 2 {
+		t.Fatal("asked the peer for its keys", n, "times over two requests")
+	}
+}
+
+func TestFederationResponseSizeLimit(t *testing.T) {
+	testServer(t)
+	_, signee_public_key := testClient(t, "", "ed25519", "")
+	testFederationPeer(t, signee_public_key, 0)
+
+	response := []interface{}{}
+	err := global_federation_peers[0].getJSON("/a/huge", nil, &response)
+	if err == nil {
+		t.Fatal("read a response larger than FEDERATION_MAX_RESPONSE_SIZE")
+	}
+}
@@ -2,45 +2,59 @@ package main
 
 import (
 	"encoding/base64"
+	"github.com/fivebillionmph/be227a/protocol"
 	gss "github.com/fivebillionmph/gosimpleserver"
-	"net"
 	"net/http"
 	"strings"
 )
 
 func handlerStartSession(w http.ResponseWriter, r *http.Request, server *gss.Server) {
-	user, err := publicKeyToUserRequest(r, server)
+	user, challenge_request, err := publicKeyToUserRequest(r, server)
 	if err != nil {
 		errorResponse(w, 400, "Invalid request")
 		return
 	}
 
+	if !user.active() {
+		errorResponse(w, 403, "User is deactivated")
+		return
+	}
+
 	public_key, err := user.publicKey()
 	if err != nil {
 		errorResponse(w, 500, "Public key error")
 		return
 	}
-	userChallengeResponse(w, public_key, "start_session")
+	userChallengeResponse(w, public_key, protocol.CHALLENGE_TYPE_START_SESSION, challenge_request)
 }
 
 func handlerStopSession(w http.ResponseWriter, r *http.Request, server *gss.Server) {
 	json_request := struct {
-		Session_id string `json:"session_id"`
+		Token string `json:"token"`
 	}{}
 	err := requestJSONDecode(r, &json_request)
 	if err != nil {
 		errorResponse(w, 400, "Invalid request")
 		return
 	}
-	UserSession__delete(json_request.Session_id)
+
+	session, err := UserSession__getByToken(json_request.Token, requestIP(r))
+	if err != nil {
+		errorResponse(w, 403, "Invalid session token")
+		return
+	}
+
+	UserSession__delete(requestStorage(server), session.id)
 	sendJSONResponseSuccess(w)
 }
 
 func handlerSessionChallenge(w http.ResponseWriter, r *http.Request, server *gss.Server) {
 	type json_request_type struct {
-		Signature string `json:"signature"`
-		Index     int    `json:"index"`
-		Port      int    `json:"port"`
+		Signature string                   `json:"signature"`
+		Index     int                      `json:"index"`
+		Port      int                      `json:"port"`
+		Label     string                   `json:"label"`
+		Metadata  protocol.SessionMetadata `json:"metadata"`
 	}
 	json_request := json_request_type{}
 	err := requestJSONDecode(r, &json_request)
@@ -49,7 +63,7 @@ func handlerSessionChallenge(w http.ResponseWriter, r *http.Request, server *gss
 		return
 	}
 
-	challenge := UserChallenge__getRegistered(json_request.Index)
+	challenge := UserChallenge__getRegistered(json_request.Index, protocol.CHALLENGE_TYPE_START_SESSION)
 	if challenge == nil {
 		errorResponse(w, 400, "Challenge does not exist")
 		return
@@ -65,40 +79,70 @@ func handlerSessionChallenge(w http.ResponseWriter, r *http.Request, server *gss
 		errorResponse(w, 400, "Challenge failed")
 		return
 	}
+	if !challenge.unregister() {
+		errorResponse(w, 400, "Challenge does not exist")
+		return
+	}
 
-	user, err := DBUser__getByPublicKey(server.RequestDBConnection(), challenge.public_key)
+	store := requestStorage(server)
+	user, err := DBUser__getByPublicKey(store, challenge.public_key)
 	if err != nil {
 		errorResponse(w, 400, "Invalid user")
 		return
 	}
 
-	ip_str := r.Header.Get("X-Forwarded-For")
-	ip := net.ParseIP(ip_str)
-	if ip == nil {
+	if !user.active() {
+		errorResponse(w, 403, "User is deactivated")
+		return
+	}
+
+	address := requestAddress(r)
+	if address.ip == nil {
 		errorResponse(w, 400, "Invalid IP")
 		return
 	}
 
-	session, err := UserSession__new(user, ip, json_request.Port)
+	if !UserSession__canStart(user, json_request.Label) {
+		errorResponse(w, 409, "Session limit reached")
+		return
+	}
+
+	session, err := UserSession__new(store, user, address, json_request.Port, json_request.Label, json_request.Metadata)
 	if err != nil {
 		errorResponse(w, 400, "Could not create session")
 		return
 	}
 
+	token, err := session.token()
+	if err != nil {
+		UserSession__delete(store, session.id)
+		errorResponse(w, 500, "Could not issue session token")
+		return
+	}
+
+	attestation, err := session.attestation()
+	if err != nil {
+		UserSession__delete(store, session.id)
+		errorResponse(w, 500, "Could not issue session attestation")
+		return
+	}
+
 	json_response := struct {
-		Session_id string `json:"session_id"`
+		Session_id  string                       `json:"session_id"`
+		Token       string                       `json:"token"`
+		Attestation *protocol.SessionAttestation `json:"attestation"`
 	}{
 		session.id,
+		token,
+		attestation,
 	}
 
 	sendJSONResponse(w, &json_response)
-
-	challenge.unregister()
 }
 
 func handlerSessionRefresh(w http.ResponseWriter, r *http.Request, server *gss.Server) {
 	json_request := struct {
-		Session_id string `json"session_id"`
+		Token string `json:"token"`
 	}{}
 	err := requestJSONDecode(r, &json_request)
 	if err != nil {
@@ -106,14 +150,119 @@ func handlerSessionRefresh(w http.ResponseWriter, r *http.Request, server *gss.S
 		return
 	}
 
-	session := UserSession__getRegistered(json_request.Session_id)
-	if session == nil {
-		errorResponse(w, 400, "Invalid session")
+	session, err := UserSession__getByToken(json_request.Token, requestIP(r))
+	if err != nil {
+		errorResponse(w, 403, "Invalid session token")
+		return
+	}
+
+	err = session.refresh(requestStorage(server))
+	if err != nil {
+		errorResponse(w, 500, "Could not refresh session")
 		return
 	}
 
-	session.lastcheck_timestamp = timestamp()
+	/* the old token stays valid until it expires, the new one lasts until the session would */
+	token, err := session.token()
+	if err != nil {
+		errorResponse(w, 500, "Could not issue session token")
+		return
+	}
+
+	attestation, err := session.attestation()
+	if err != nil {
+		errorResponse(w, 500, "Could not issue session attestation")
+		return
+	}
+
+	json_response := struct {
+		Token       string                       `json:"token"`
+		Attestation *protocol.SessionAttestation `json:"attestation"`
+	}{
+		token,
+		attestation,
+	}
 
+	sendJSONResponse(w, &json_response)
+}
+
+/* the sessions of the user the token's session belongs to */
+func handlerGetMySessions(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	json_request := struct {
+		Token string `json:"token"`
+	}{}
+	err := requestJSONDecode(r, &json_request)
+	if err != nil {
+		errorResponse(w, 400, "Could not read message")
+		return
+	}
+
+	current_session, err := UserSession__getByToken(json_request.Token, requestIP(r))
+	if err != nil {
+		errorResponse(w, 403, "Invalid session token")
+		return
+	}
+
+	type json_session struct {
+		Id                  string                   `json:"id"`
+		Label               string                   `json:"label"`
+		Metadata            protocol.SessionMetadata `json:"metadata"`
+		IP                  string                   `json:"ip"`
+		Port                int                      `json:"port"`
+		Start_timestamp     int                      `json:"start_timestamp"`
+		Lastcheck_timestamp int                      `json:"lastcheck_timestamp"`
+		Current             bool                     `json:"current"`
+	}
+	json_response := struct {
+		Sessions []json_session `json:"sessions"`
+	}{
+		Sessions: make([]json_session, 0, 4),
+	}
+
+	for _, gus := range UserSession__getByUser(current_session.db_user.F_id) {
+		gus.mutex.Lock()
+		js := json_session{
+			Id:                  gus.id,
+			Label:               gus.label,
+			Metadata:            gus.metadata,
+			IP:                  gus.ip.String(),
+			Port:                gus.port,
+			Start_timestamp:     gus.start_timestamp,
+			Lastcheck_timestamp: gus.lastcheck_timestamp,
+			Current:             gus == current_session,
+		}
+		gus.mutex.Unlock()
+		json_response.Sessions = append(json_response.Sessions, js)
+	}
+
+	sendJSONResponse(w, &json_response)
+}
+
+/* ends another of the user's sessions, or the current one */
+func handlerEndMySession(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	json_request := struct {
+		Token      string `json:"token"`
+		Session_id string `json:"session_id"`
+	}{}
+	err := requestJSONDecode(r, &json_request)
+	if err != nil {
+		errorResponse(w, 400, "Could not read message")
+		return
+	}
+
+	current_session, err := UserSession__getByToken(json_request.Token, requestIP(r))
+	if err != nil {
+		errorResponse(w, 403, "Invalid session token")
+		return
+	}
+
+	session := UserSession__getRegistered(json_request.Session_id)
+	if session == nil || session.db_user.F_id != current_session.db_user.F_id {
+		errorResponse(w, 400, "Session does not exist")
+		return
+	}
+
+	UserSession__delete(requestStorage(server), session.id)
 	sendJSONResponseSuccess(w)
 }
 
@@ -131,7 +280,7 @@ func handlerRegisterChallenge(w http.ResponseWriter, r *http.Request, server *gs
 		return
 	}
 
-	challenge := UserChallenge__getRegistered(json_request.Index)
+	challenge := UserChallenge__getRegistered(json_request.Index, protocol.CHALLENGE_TYPE_REGISTER)
 	if challenge == nil {
 		errorResponse(w, 400, "Challenge does not exist")
 		return
@@ -147,8 +296,12 @@ func handlerRegisterChallenge(w http.ResponseWriter, r *http.Request, server *gs
 		errorResponse(w, 400, "Challenge failed")
 		return
 	}
+	if !challenge.unregister() {
+		errorResponse(w, 400, "Challenge does not exist")
+		return
+	}
 
-	_, err = DBUser__create(server.RequestDBConnection(), json_request.Name, json_request.Organization, challenge.public_key)
+	_, err = DBUser__create(requestStorage(server), json_request.Name, json_request.Organization, challenge.public_key)
 	if err != nil {
 		errorResponse(w, 400, "Could not register user")
 		return
@@ -158,22 +311,196 @@ func handlerRegisterChallenge(w http.ResponseWriter, r *http.Request, server *gs
 }
 
 func handlerRegister(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	challenge_request := ChallengeRequest{}
+	err := requestJSONDecode(r, &challenge_request)
+	if err != nil {
+		errorResponse(w, 400, "Could not parse request")
+		return
+	}
+
+	public_key, err := stringToPublicKey(challenge_request.Public_key)
+	if err != nil {
+		errorResponse(w, 400, "Could not read public key")
+		return
+	}
+	userChallengeResponse(w, public_key, protocol.CHALLENGE_TYPE_REGISTER, &challenge_request)
+}
+
+func handlerDeactivate(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	user, challenge_request, err := publicKeyToUserRequest(r, server)
+	if err != nil {
+		errorResponse(w, 400, "Invalid request")
+		return
+	}
+
+	if !user.active() {
+		errorResponse(w, 400, "User is already deactivated")
+		return
+	}
+
+	public_key, err := user.publicKey()
+	if err != nil {
+		errorResponse(w, 500, "Public key error")
+		return
+	}
+	userChallengeResponse(w, public_key, protocol.CHALLENGE_TYPE_DEACTIVATE, challenge_request)
+}
+
+func handlerDeactivateChallenge(w http.ResponseWriter, r *http.Request, server *gss.Server) {
 	type json_request_type struct {
-		Public_key string `json:"public_key"`
+		Signature string `json:"signature"`
+		Index     int    `json:"index"`
 	}
 	json_request := json_request_type{}
 	err := requestJSONDecode(r, &json_request)
 	if err != nil {
-		errorResponse(w, 400, "Could not parse request")
+		errorResponse(w, 400, "Could not read message")
+		return
+	}
+
+	challenge := UserChallenge__getRegistered(json_request.Index, protocol.CHALLENGE_TYPE_DEACTIVATE)
+	if challenge == nil {
+		errorResponse(w, 400, "Challenge does not exist")
 		return
 	}
 
-	public_key, err := stringToPublicKey(json_request.Public_key)
+	signature, err := base64.StdEncoding.DecodeString(json_request.Signature)
 	if err != nil {
-		errorResponse(w, 400, "Could not read public key")
+		errorResponse(w, 400, "Could not read signature")
+		return
+	}
+
+	if !challenge.validate(string(signature)) {
+		errorResponse(w, 400, "Challenge failed")
+		return
+	}
+	if !challenge.unregister() {
+		errorResponse(w, 400, "Challenge does not exist")
+		return
+	}
+
+	store := requestStorage(server)
+	user, err := DBUser__getByPublicKey(store, challenge.public_key)
+	if err != nil {
+		errorResponse(w, 400, "Invalid user")
+		return
+	}
+
+	if !user.active() {
+		errorResponse(w, 400, "User is already deactivated")
+		return
+	}
+
+	err = DBUser__deactivate(store, user)
+	if err != nil {
+		errorResponse(w, 500, "Could not deactivate user")
+		return
+	}
+
+	sendJSONResponseSuccess(w)
+}
+
+func handlerRotateKey(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	type json_request_type struct {
+		Signature         string                   `json:"signature"`
+		Message           DBUserKey__VerifyMessage `json:"message"`
+		Challenge_schemes []string                 `json:"challenge_schemes"`
+		Signature_schemes []string                 `json:"signature_schemes"`
+	}
+	json_request := json_request_type{}
+	err := requestJSONDecode(r, &json_request)
+	if err != nil {
+		errorResponse(w, 400, "Could not read request")
+		return
+	}
+
+	store := requestStorage(server)
+
+	old_public_key, err := stringToPublicKey(json_request.Message.Old_public_key)
+	if err != nil {
+		errorResponse(w, 400, "Invalid old public key")
+		return
+	}
+
+	user, err := DBUser__getByPublicKey(store, old_public_key)
+	if err != nil {
+		errorResponse(w, 400, "User not found")
+		return
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(json_request.Signature)
+	if err != nil {
+		errorResponse(w, 400, "Could not decode signature")
+		return
+	}
+
+	rotation, new_public_key, err := DBUserKey__prepareRotation(store, user, json_request.Message, string(signature))
+	if err != nil {
+		errorResponse(w, 400, "Invalid succession statement")
+		return
+	}
+
+	challenge_request := ChallengeRequest{
+		Public_key:        json_request.Message.New_public_key,
+		Challenge_schemes: json_request.Challenge_schemes,
+		Signature_schemes: json_request.Signature_schemes,
+	}
+	challenge, err := UserChallenge__newRotation(new_public_key, &challenge_request, rotation)
+	if err != nil {
+		errorResponse(w, 400, "No acceptable challenge scheme")
+		return
+	}
+	err = challenge.sendJSONResponse(w)
+	if err != nil {
+		errorResponse(w, 500, "Error sending challenge")
+		return
+	}
+}
+
+func handlerRotateKeyChallenge(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	type json_request_type struct {
+		Signature string `json:"signature"`
+		Index     int    `json:"index"`
+	}
+	json_request := json_request_type{}
+	err := requestJSONDecode(r, &json_request)
+	if err != nil {
+		errorResponse(w, 400, "Could not read message")
+		return
+	}
+
+	challenge := UserChallenge__getRegistered(json_request.Index, protocol.CHALLENGE_TYPE_ROTATE)
+	if challenge == nil || challenge.rotation == nil {
+		errorResponse(w, 400, "Challenge does not exist")
+		return
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(json_request.Signature)
+	if err != nil {
+		errorResponse(w, 400, "Could not read signature")
+		return
+	}
+
+	if !challenge.validate(string(signature)) {
+		errorResponse(w, 400, "Challenge failed")
+		return
+	}
+	if !challenge.unregister() {
+		errorResponse(w, 400, "Challenge does not exist")
+		return
+	}
+
+	store := requestStorage(server)
+	user, err := DBUserKey__rotate(store, challenge.rotation)
+	if err != nil {
+		errorResponse(w, 400, "Could not rotate key")
 		return
 	}
-	userChallengeResponse(w, public_key, "register")
+
+	/* sessions were started with the old key */
+	UserSession__deleteByUser(store, user.F_id)
+
+	sendJSONResponseSuccess(w)
 }
 
 func handlerAddSignature(w http.ResponseWriter, r *http.Request, server *gss.Server) {
@@ -190,7 +517,7 @@ func handlerAddSignature(w http.ResponseWriter, r *http.Request, server *gss.Ser
 		return
 	}
 
-	cxn := server.RequestDBConnection()
+	store := requestStorage(server)
 
 	signer_public_key, err := stringToPublicKey(json_request.Signer_public_key)
 	if err != nil {
@@ -198,7 +525,7 @@ func handlerAddSignature(w http.ResponseWriter, r *http.Request, server *gss.Ser
 		return
 	}
 
-	signer, err := DBUser__getByPublicKey(cxn, signer_public_key)
+	signer, err := DBUser__getByPublicKey(store, signer_public_key)
 	if err != nil {
 		errorResponse(w, 400, "Signer not found")
 		return
@@ -210,7 +537,7 @@ func handlerAddSignature(w http.ResponseWriter, r *http.Request, server *gss.Ser
 		return
 	}
 
-	signee, err := DBUser__getByPublicKey(cxn, signee_public_key)
+	signee, err := DBUser__getByPublicKey(store, signee_public_key)
 	if err != nil {
 		errorResponse(w, 400, "Signee is not found")
 		return
@@ -222,7 +549,7 @@ func handlerAddSignature(w http.ResponseWriter, r *http.Request, server *gss.Ser
 		return
 	}
 
-	_, err = DBSignature__create(cxn, signer, signee, json_request.Message, string(signature))
+	_, err = DBSignature__create(store, signer, signee, json_request.Message, string(signature))
 
 	if err != nil {
 		errorResponse(w, 400, "Could not create signature")
@@ -232,13 +559,61 @@ func handlerAddSignature(w http.ResponseWriter, r *http.Request, server *gss.Ser
 	sendJSONResponseSuccess(w)
 }
 
-//func handlerRevokeSignature(w http.ResponseWriter, r *http.Request, server *gss.Server) {
-//
-//}
+func handlerRevokeSignature(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	type json_request_type struct {
+		Signature         string                      `json:"signature"`
+		Message           DBRevocation__VerifyMessage `json:"message"`
+		Signer_public_key string                      `json:"signer_public_key"`
+	}
+	json_request := json_request_type{}
+	err := requestJSONDecode(r, &json_request)
+	if err != nil {
+		errorResponse(w, 400, "Could not read request")
+		return
+	}
+
+	store := requestStorage(server)
+
+	signer_public_key, err := stringToPublicKey(json_request.Signer_public_key)
+	if err != nil {
+		errorResponse(w, 400, "Invalid signer public key")
+		return
+	}
+
+	signer, err := DBUser__getByPublicKey(store, signer_public_key)
+	if err != nil {
+		errorResponse(w, 400, "Signer not found")
+		return
+	}
+
+	db_signature, err := DBSignature__getByID(store, json_request.Message.Signature_id)
+	if err != nil {
+		errorResponse(w, 400, "Signature not found")
+		return
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(json_request.Signature)
+	if err != nil {
+		errorResponse(w, 400, "Could not decode signature")
+		return
+	}
+
+	_, err = DBRevocation__create(store, signer, db_signature, json_request.Message, string(signature))
+	if err != nil {
+		errorResponse(w, 400, "Could not revoke signature")
+		return
+	}
+
+	sendJSONResponseSuccess(w)
+}
 
 func handlerGetSignatures(w http.ResponseWriter, r *http.Request, server *gss.Server) {
 	json_request := struct {
-		Key string `json:"key"`
+		Key        string `json:"key"`
+		Federated  bool   `json:"federated"`
+		Local_only bool   `json:"local_only"`
+		Valid_only bool   `json:"valid_only"`
+		Scope      string `json:"scope"`
 	}{}
 	err := requestJSONDecode(r, &json_request)
 
@@ -254,114 +629,320 @@ func handlerGetSignatures(w http.ResponseWriter, r *http.Request, server *gss.Se
 		return
 	}
 
-	cxn := server.RequestDBConnection()
-	signee, err := DBUser__getByPublicKey(cxn, public_key)
-	if err != nil {
+	/* the query is echoed so a signed response can't be relayed as the answer to another one */
+	json_response := struct {
+		Key        string                `json:"key"`
+		Federated  bool                  `json:"federated"`
+		Valid_only bool                  `json:"valid_only"`
+		Scope      string                `json:"scope"`
+		Signatures []FederationSignature `json:"signatures"`
+	}{
+		Key:        json_request.Key,
+		Federated:  json_request.Federated,
+		Valid_only: json_request.Valid_only,
+		Scope:      json_request.Scope,
+		Signatures: make([]FederationSignature, 0, 8),
+	}
+
+	/* peers set local_only so lookups don't bounce between servers */
+	ask_peers := !json_request.Local_only && len(global_federation_peers) > 0
+
+	store := requestStorage(server)
+	signee, err := DBUser__getByAnyPublicKey(store, public_key)
+	signee_found := err == nil
+	if !signee_found && !ask_peers {
 		errorResponse(w, 400, "Invalid public key")
 		return
 	}
 
-	signatures, err := DBSignature__getBySignee(cxn, signee)
+	now := timestamp()
+	if signee_found {
+		signatures, err := DBSignature__getBySignee(store, signee)
+		if err != nil {
+			errorResponse(w, 500, "Unexpected error")
+			return
+		}
+
+		for _, signature := range signatures {
+			signer, err := signature.signer(store)
+			if err != nil {
+				continue
+			}
+
+			/* listed under the key that made it, which is older if the signer has rotated since */
+			signer_public_key, err := signature.signerPublicKey(store, signer)
+			if err != nil {
+				continue
+			}
+
+			signer_info, err := FederationSigner__new(store, signer, signer_public_key)
+			if err != nil {
+				continue
+			}
+			jsig := FederationSignature{
+				Id:        signature.F_id,
+				Signature: signature.base64Signature(),
+				Message:   signature.F_message,
+				Signer:    *signer_info,
+				Status:    signature.status(now),
+				Version:   signature.version(),
+				Server:    global_host_name,
+			}
+			revocation := signature.revocation(store)
+			if revocation != nil {
+				jsig.Revoked = true
+				jsig.Revoked_timestamp = revocation.F_timestamp
+			}
+			json_response.Signatures = append(json_response.Signatures, jsig)
+		}
+	}
+
+	if ask_peers && (json_request.Federated || !signee_found) {
+		seen := make(map[string]bool)
+		for _, jsig := range json_response.Signatures {
+			seen[jsig.Signature] = true
+		}
+		for _, fsig := range federatedSignatures(store, json_request.Key) {
+			if seen[fsig.Signature] {
+				continue
+			}
+			seen[fsig.Signature] = true
+			json_response.Signatures = append(json_response.Signatures, fsig)
+		}
+	}
+
+	if json_request.Valid_only || json_request.Scope != "" {
+		filtered_signatures := make([]FederationSignature, 0, len(json_response.Signatures))
+		for _, jsig := range json_response.Signatures {
+			if json_request.Valid_only && (jsig.Status != SIGNATURE_STATUS_VALID || jsig.Revoked || !jsig.Signer.Active) {
+				continue
+			}
+			if json_request.Scope != "" && !jsig.inScope(json_request.Scope) {
+				continue
+			}
+			filtered_signatures = append(filtered_signatures, jsig)
+		}
+		json_response.Signatures = filtered_signatures
+	}
+
+	sendSignedJSONResponse(w, r, &json_response)
+}
+
+func handlerGetTrustPath(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	json_request := struct {
+		Root      string `json:"root"`
+		Target    string `json:"target"`
+		Max_depth int    `json:"max_depth"`
+	}{}
+	err := requestJSONDecode(r, &json_request)
+	if err != nil {
+		errorResponse(w, 400, "Could not read request")
+		return
+	}
+
+	max_depth := json_request.Max_depth
+	if max_depth == 0 {
+		max_depth = TRUST_PATH_DEFAULT_DEPTH
+	}
+	if max_depth < 1 || max_depth > TRUST_PATH_MAX_DEPTH {
+		errorResponse(w, 400, "Invalid max depth")
+		return
+	}
+
+	store := requestStorage(server)
+
+	root_public_key, err := stringToPublicKey(json_request.Root)
 	if err != nil {
-		errorResponse(w, 500, "Unexpected error")
+		errorResponse(w, 400, "Invalid root public key")
+		return
+	}
+	root, err := DBUser__getByPublicKey(store, root_public_key)
+	if err != nil {
+		errorResponse(w, 400, "Root not found")
 		return
 	}
 
-	type json_signer_info struct {
-		Public_key   string `json:"public_key"`
-		Name         string `json:"name"`
-		Organization string `json"organization"`
+	target_public_key, err := stringToPublicKey(json_request.Target)
+	if err != nil {
+		errorResponse(w, 400, "Invalid target public key")
+		return
 	}
-	type json_signature struct {
-		Signature string           `json:"signature"`
-		Message   string           `json:"message"`
-		Signer    json_signer_info `json:"signer"`
+	target, err := DBUser__getByAnyPublicKey(store, target_public_key)
+	if err != nil {
+		errorResponse(w, 400, "Target not found")
+		return
 	}
 
+	paths, err := trustPaths(store, root, target, max_depth)
+	if err != nil {
+		errorResponse(w, 500, "Unexpected error")
+		return
+	}
+
+	type json_hop struct {
+		Id                int    `json:"id"`
+		Signer_public_key string `json:"signer_public_key"`
+		Signee_public_key string `json:"signee_public_key"`
+		Signature         string `json:"signature"`
+		Message           string `json:"message"`
+	}
 	json_response := struct {
-		Signatures []json_signature `json:"signatures"`
+		Found bool         `json:"found"`
+		Depth int          `json:"depth"`
+		Paths [][]json_hop `json:"paths"`
 	}{
-		Signatures: make([]json_signature, 0, len(signatures)),
+		Found: paths != nil,
+		Paths: make([][]json_hop, 0, len(paths)),
 	}
 
-	for _, signature := range signatures {
-		signer, err := signature.signer(cxn)
-		if err != nil {
-			continue
+	key_strings := make(map[int]string)
+	keyString := func(user_id int) string {
+		key_string, ok := key_strings[user_id]
+		if !ok {
+			user, err := DBUser__getByID(store, user_id)
+			if err == nil {
+				key_string, _ = user.publicKeyString()
+			}
+			key_strings[user_id] = key_string
 		}
-
-		signer_key_string, err := signer.publicKeyString()
-		if err != nil {
-			continue
+		return key_string
+	}
+
+	for _, path := range paths {
+		json_path := make([]json_hop, 0, len(path))
+		for _, signature := range path {
+			hop := json_hop{
+				Id:                signature.F_id,
+				Signer_public_key: keyString(signature.F_signer_id),
+				Signee_public_key: keyString(signature.F_signee_id),
+				Signature:         signature.base64Signature(),
+				Message:           signature.F_message,
+			}
+			json_path = append(json_path, hop)
 		}
+		json_response.Depth = len(json_path)
+		json_response.Paths = append(json_response.Paths, json_path)
+	}
 
-		signer_info := json_signer_info{
-			Public_key:   signer_key_string,
-			Name:         signer.F_name,
-			Organization: signer.F_organization,
-		}
-		jsig := json_signature{
-			Signature: signature.base64Signature(),
-			Message:   signature.F_message,
-			Signer:    signer_info,
-		}
-		json_response.Signatures = append(json_response.Signatures, jsig)
+	sendJSONResponse(w, &json_response)
+}
+
+func handlerGetMessageKeys(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	json_response := struct {
+		Message_keys []MessageKeySchema `json:"message_keys"`
+	}{
+		global_message_keys,
 	}
 
 	sendJSONResponse(w, &json_response)
 }
 
+/* with group=user the endpoints are listed under each user instead of one row per session */
 func handlerGetSessions(w http.ResponseWriter, r *http.Request, server *gss.Server) {
 	query := strings.ToLower(r.URL.Query().Get("q"))
+	group := r.URL.Query().Get("group")
+	if group != "" && group != "user" {
+		errorResponse(w, 400, "Invalid group")
+		return
+	}
+
+	type json_endpoint struct {
+		IP          string                       `json:"ip"`
+		Port        int                          `json:"port"`
+		Label       string                       `json:"label"`
+		Metadata    protocol.SessionMetadata     `json:"metadata"`
+		Attestation *protocol.SessionAttestation `json:"attestation"`
+	}
 	type json_session struct {
 		Name         string `json:"name"`
 		Organization string `json:"organization"`
-		IP           string `json:"ip"`
-		Port         int    `json:"port"`
 		Public_key   string `json:"public_key"`
+		json_endpoint
 	}
-	json_response := struct {
-		Sessions []json_session `json:"sessions"`
-	}{
-		Sessions: make([]json_session, 0, len(global_user_sessions)),
+	type json_user struct {
+		Name         string          `json:"name"`
+		Organization string          `json:"organization"`
+		Public_key   string          `json:"public_key"`
+		Endpoints    []json_endpoint `json:"endpoints"`
 	}
+	sessions := make([]json_session, 0, global_user_sessions.len())
+	users := make([]*json_user, 0, 8)
+	users_by_id := make(map[int]*json_user)
 
-	for _, gus := range global_user_sessions {
-		if query != "" {
-			if !strings.Contains(strings.ToLower(gus.db_user.F_name), query) && !strings.Contains(strings.ToLower(gus.db_user.F_organization), query) {
-				continue
-			}
+	for _, gus := range UserSession__getAllRegistered() {
+		if !gus.db_user.active() || !sessionMatchesQuery(gus, query) {
+			continue
 		}
 		public_key_string, err := gus.db_user.publicKeyString()
 		if err != nil {
 			continue
 		}
-		js := json_session{
-			Name:         gus.db_user.F_name,
-			Organization: gus.db_user.F_organization,
-			IP:           gus.ip.String(),
-			Port:         gus.port,
-			Public_key:   public_key_string,
+		attestation, err := gus.attestation()
+		if err != nil {
+			continue
 		}
-		json_response.Sessions = append(json_response.Sessions, js)
+		endpoint := json_endpoint{
+			IP:          gus.ip.String(),
+			Port:        gus.port,
+			Label:       gus.label,
+			Metadata:    gus.metadata,
+			Attestation: attestation,
+		}
+
+		if group == "" {
+			sessions = append(sessions, json_session{
+				Name:          gus.db_user.F_name,
+				Organization:  gus.db_user.F_organization,
+				Public_key:    public_key_string,
+				json_endpoint: endpoint,
+			})
+			continue
+		}
+
+		user, ok := users_by_id[gus.db_user.F_id]
+		if !ok {
+			user = &json_user{
+				Name:         gus.db_user.F_name,
+				Organization: gus.db_user.F_organization,
+				Public_key:   public_key_string,
+				Endpoints:    make([]json_endpoint, 0, 1),
+			}
+			users_by_id[gus.db_user.F_id] = user
+			users = append(users, user)
+		}
+		user.Endpoints = append(user.Endpoints, endpoint)
 	}
 
-	sendJSONResponse(w, &json_response)
+	if group == "" {
+		json_response := struct {
+			Sessions []json_session `json:"sessions"`
+		}{
+			sessions,
+		}
+		sendSignedJSONResponse(w, r, &json_response)
+	} else {
+		json_response := struct {
+			Users []*json_user `json:"users"`
+		}{
+			users,
+		}
+		sendSignedJSONResponse(w, r, &json_response)
+	}
 }
 
 func handlerGetKeys(w http.ResponseWriter, r *http.Request, server *gss.Server) {
 	query := r.URL.Query().Get("q")
-	cxn := server.RequestDBConnection()
+	store := requestStorage(server)
 	var users []*DBUser
 	var err error
 	if query == "" {
-		users, err = DBUser__getAll(cxn)
+		users, err = DBUser__getAll(store)
 		if err != nil {
 			errorResponse(w, 500, "Could not get users")
 			return
 		}
 	} else {
-		users, err = DBUser__getByQuery(cxn, query)
+		users, err = DBUser__getByQuery(store, query)
 		if err != nil {
 			errorResponse(w, 500, "Could not query users")
 			return
@@ -379,6 +960,9 @@ func handlerGetKeys(w http.ResponseWriter, r *http.Request, server *gss.Server)
 		make([]user_response_type, 0, len(users)),
 	}
 	for _, user := range users {
+		if !user.active() {
+			continue
+		}
 		public_key_string, err := user.publicKeyString()
 		if err != nil {
 			continue
@@ -390,7 +974,7 @@ func handlerGetKeys(w http.ResponseWriter, r *http.Request, server *gss.Server)
 		}
 		json_response.Users = append(json_response.Users, urt)
 	}
-	sendJSONResponse(w, &json_response)
+	sendSignedJSONResponse(w, r, &json_response)
 }
 
 func handler404(w http.ResponseWriter, r *http.Request, server *gss.Server) {
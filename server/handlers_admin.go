@@ -0,0 +1,499 @@
+package main
+
+import (
+	gss "github.com/fivebillionmph/gosimpleserver"
+	"net/http"
+	"strconv"
+)
+
+/*
+ * every admin request carries an AdminMessage signed by an admin key. the
+ * message's action must match the endpoint and its target names what is
+ * acted on: a public key for user actions, an id for signatures and sessions.
+ */
+
+const ADMIN_LIST_LIMIT_DEFAULT = 100
+const ADMIN_LIST_LIMIT_MAX = 1000
+
+func handlerAdminGetUsers(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	store := requestStorage(server)
+	admin_request := adminRequest(w, r, store, "list_users")
+	if admin_request == nil {
+		return
+	}
+	if !admin_request.audit(w, store, "") {
+		return
+	}
+
+	var users []*DBUser
+	var err error
+	if admin_request.message.Target == "" {
+		users, err = DBUser__getAll(store)
+	} else {
+		users, err = DBUser__getByQuery(store, admin_request.message.Target)
+	}
+	if err != nil {
+		errorResponse(w, 500, "Could not get users")
+		return
+	}
+
+	type user_response_type struct {
+		Id           int      `json:"id"`
+		Name         string   `json:"name"`
+		Organization string   `json:"organization"`
+		Public_key   string   `json:"public_key"`
+		Active       bool     `json:"active"`
+		Roles        []string `json:"roles"`
+	}
+	json_response := struct {
+		Users []user_response_type `json:"users"`
+	}{
+		make([]user_response_type, 0, len(users)),
+	}
+	for _, user := range users {
+		public_key_string, err := user.publicKeyString()
+		if err != nil {
+			continue
+		}
+		roles := make([]string, 0, 1)
+		db_roles, err := DBRole__getByUser(store, user)
+		if err == nil {
+			for _, db_role := range db_roles {
+				roles = append(roles, db_role.F_role)
+			}
+		}
+		urt := user_response_type{
+			Id:           user.F_id,
+			Name:         user.F_name,
+			Organization: user.F_organization,
+			Public_key:   public_key_string,
+			Active:       user.active(),
+			Roles:        roles,
+		}
+		json_response.Users = append(json_response.Users, urt)
+	}
+
+	sendJSONResponse(w, &json_response)
+}
+
+func handlerAdminDeactivate(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	store := requestStorage(server)
+	admin_request := adminRequest(w, r, store, "deactivate")
+	if admin_request == nil {
+		return
+	}
+
+	user, err := admin_request.targetUser(store)
+	if err != nil {
+		errorResponse(w, 400, "User not found")
+		return
+	}
+
+	if !user.active() {
+		errorResponse(w, 400, "User is already deactivated")
+		return
+	}
+
+	if !admin_request.audit(w, store, "user "+strconv.Itoa(user.F_id)) {
+		return
+	}
+
+	err = DBUser__deactivate(store, user)
+	if err != nil {
+		errorResponse(w, 500, "Could not deactivate user")
+		return
+	}
+
+	sendJSONResponseSuccess(w)
+}
+
+func handlerAdminReactivate(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	store := requestStorage(server)
+	admin_request := adminRequest(w, r, store, "reactivate")
+	if admin_request == nil {
+		return
+	}
+
+	user, err := admin_request.targetUser(store)
+	if err != nil {
+		errorResponse(w, 400, "User not found")
+		return
+	}
+
+	if user.active() {
+		errorResponse(w, 400, "User is already active")
+		return
+	}
+
+	if !admin_request.audit(w, store, "user "+strconv.Itoa(user.F_id)) {
+		return
+	}
+
+	err = DBUser__reactivate(store, user)
+	if err != nil {
+		errorResponse(w, 500, "Could not reactivate user")
+		return
+	}
+
+	sendJSONResponseSuccess(w)
+}
+
+func handlerAdminGrantAdmin(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	store := requestStorage(server)
+	admin_request := adminRequest(w, r, store, "grant_admin")
+	if admin_request == nil {
+		return
+	}
+
+	user, err := admin_request.targetUser(store)
+	if err != nil {
+		errorResponse(w, 400, "User not found")
+		return
+	}
+
+	if !admin_request.audit(w, store, "user "+strconv.Itoa(user.F_id)) {
+		return
+	}
+
+	err = DBRole__grant(store, user, ROLE_ADMIN)
+	if err != nil {
+		errorResponse(w, 500, "Could not grant role")
+		return
+	}
+
+	sendJSONResponseSuccess(w)
+}
+
+func handlerAdminRevokeAdmin(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	store := requestStorage(server)
+	admin_request := adminRequest(w, r, store, "revoke_admin")
+	if admin_request == nil {
+		return
+	}
+
+	user, err := admin_request.targetUser(store)
+	if err != nil {
+		errorResponse(w, 400, "User not found")
+		return
+	}
+
+	if !admin_request.audit(w, store, "user "+strconv.Itoa(user.F_id)) {
+		return
+	}
+
+	err = DBRole__revoke(store, user, ROLE_ADMIN)
+	if err != nil {
+		errorResponse(w, 500, "Could not revoke role")
+		return
+	}
+
+	sendJSONResponseSuccess(w)
+}
+
+func handlerAdminDeleteSignature(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	store := requestStorage(server)
+	admin_request := adminRequest(w, r, store, "delete_signature")
+	if admin_request == nil {
+		return
+	}
+
+	db_signature := adminTargetSignature(w, store, admin_request)
+	if db_signature == nil {
+		return
+	}
+
+	if !admin_request.audit(w, store, "signer "+strconv.Itoa(db_signature.F_signer_id)+" signee "+strconv.Itoa(db_signature.F_signee_id)) {
+		return
+	}
+
+	/* a deletion can't be undone to match a failed append, so it's logged first */
+	err := logSignatureDeletion(store, db_signature, admin_request)
+	if err != nil {
+		errorResponse(w, 500, "Could not log signature deletion")
+		return
+	}
+
+	err = DBSignature__delete(store, db_signature)
+	if err != nil {
+		errorResponse(w, 500, "Could not delete signature")
+		return
+	}
+
+	sendJSONResponseSuccess(w)
+}
+
+func handlerAdminRevokeSignature(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	store := requestStorage(server)
+	admin_request := adminRequest(w, r, store, "revoke_signature")
+	if admin_request == nil {
+		return
+	}
+
+	db_signature := adminTargetSignature(w, store, admin_request)
+	if db_signature == nil {
+		return
+	}
+
+	if db_signature.revocation(store) != nil {
+		errorResponse(w, 400, "Signature already revoked")
+		return
+	}
+
+	if !admin_request.audit(w, store, "signer "+strconv.Itoa(db_signature.F_signer_id)+" signee "+strconv.Itoa(db_signature.F_signee_id)) {
+		return
+	}
+
+	_, err := DBRevocation__createByAdmin(store, db_signature, admin_request)
+	if err != nil {
+		errorResponse(w, 500, "Could not revoke signature")
+		return
+	}
+
+	sendJSONResponseSuccess(w)
+}
+
+/* on failure the error response is sent and nil returned */
+func adminTargetSignature(w http.ResponseWriter, store Storage, admin_request *AdminRequest) *DBSignature {
+	id, err := strconv.Atoi(admin_request.message.Target)
+	if err != nil {
+		errorResponse(w, 400, "Invalid signature id")
+		return nil
+	}
+
+	db_signature, err := DBSignature__getByID(store, id)
+	if err != nil {
+		errorResponse(w, 400, "Signature not found")
+		return nil
+	}
+
+	return db_signature
+}
+
+func handlerAdminKillSession(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	store := requestStorage(server)
+	admin_request := adminRequest(w, r, store, "kill_session")
+	if admin_request == nil {
+		return
+	}
+
+	user_session := UserSession__getRegistered(admin_request.message.Target)
+	if user_session == nil {
+		errorResponse(w, 400, "Session not found")
+		return
+	}
+
+	if !admin_request.audit(w, store, "user "+strconv.Itoa(user_session.db_user.F_id)) {
+		return
+	}
+
+	UserSession__delete(store, user_session.id)
+
+	sendJSONResponseSuccess(w)
+}
+
+func handlerAdminGetSessions(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	store := requestStorage(server)
+	admin_request := adminRequest(w, r, store, "list_sessions")
+	if admin_request == nil {
+		return
+	}
+	if !admin_request.audit(w, store, "") {
+		return
+	}
+
+	type json_session struct {
+		Id                  string `json:"id"`
+		User_id             int    `json:"user_id"`
+		Name                string `json:"name"`
+		Start_timestamp     int    `json:"start_timestamp"`
+		Lastcheck_timestamp int    `json:"lastcheck_timestamp"`
+		IP                  string `json:"ip"`
+		Observed_ip         string `json:"observed_ip"`
+		Claimed_ip          string `json:"claimed_ip"`
+		Port                int    `json:"port"`
+		Label               string `json:"label"`
+	}
+	json_response := struct {
+		Sessions []json_session `json:"sessions"`
+	}{
+		Sessions: make([]json_session, 0, global_user_sessions.len()),
+	}
+
+	for _, gus := range UserSession__getAllRegistered() {
+		gus.mutex.Lock()
+		js := json_session{
+			Id:                  gus.id,
+			User_id:             gus.db_user.F_id,
+			Name:                gus.db_user.F_name,
+			Start_timestamp:     gus.start_timestamp,
+			Lastcheck_timestamp: gus.lastcheck_timestamp,
+			IP:                  gus.ip.String(),
+			Observed_ip:         ipString(gus.observed_ip),
+			Claimed_ip:          ipString(gus.claimed_ip),
+			Port:                gus.port,
+			Label:               gus.label,
+		}
+		gus.mutex.Unlock()
+		json_response.Sessions = append(json_response.Sessions, js)
+	}
+
+	sendJSONResponse(w, &json_response)
+}
+
+func handlerAdminGetChallenges(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	store := requestStorage(server)
+	admin_request := adminRequest(w, r, store, "list_challenges")
+	if admin_request == nil {
+		return
+	}
+	if !admin_request.audit(w, store, "") {
+		return
+	}
+
+	type json_challenge struct {
+		Public_key       string `json:"public_key"`
+		Challenge_type   string `json:"challenge_type"`
+		Scheme           string `json:"scheme"`
+		Start_timestamp  int    `json:"start_timestamp"`
+		Expire_timestamp int    `json:"expire_timestamp"`
+	}
+	json_response := struct {
+		Challenges []json_challenge `json:"challenges"`
+	}{
+		Challenges: make([]json_challenge, 0, global_user_challenges.len()),
+	}
+
+	for _, challenge := range UserChallenge__getAllRegistered() {
+		public_key_string, err := publicKeyToString(challenge.public_key)
+		if err != nil {
+			continue
+		}
+		jc := json_challenge{
+			Public_key:       public_key_string,
+			Challenge_type:   challenge.challenge_type,
+			Scheme:           challenge.scheme,
+			Start_timestamp:  challenge.start_timestamp,
+			Expire_timestamp: challenge.expire_timestamp,
+		}
+		json_response.Challenges = append(json_response.Challenges, jc)
+	}
+
+	sendJSONResponse(w, &json_response)
+}
+
+/* the target is the number of entries to return, newest first */
+func handlerAdminGetAuditLog(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	store := requestStorage(server)
+	admin_request := adminRequest(w, r, store, "list_audit")
+	if admin_request == nil {
+		return
+	}
+
+	limit, err := admin_request.targetLimit()
+	if err != nil {
+		errorResponse(w, 400, "Invalid limit")
+		return
+	}
+
+	if !admin_request.audit(w, store, "") {
+		return
+	}
+
+	audit_logs, err := DBAuditLog__getRecent(store, limit)
+	if err != nil {
+		errorResponse(w, 500, "Could not get audit log")
+		return
+	}
+
+	type json_audit_log struct {
+		Id               int    `json:"id"`
+		Timestamp        int    `json:"timestamp"`
+		Admin_public_key string `json:"admin_public_key"`
+		Action           string `json:"action"`
+		Target           string `json:"target"`
+		Details          string `json:"details"`
+	}
+	json_response := struct {
+		Entries []json_audit_log `json:"entries"`
+	}{
+		Entries: make([]json_audit_log, 0, len(audit_logs)),
+	}
+	for _, audit_log := range audit_logs {
+		admin_public_key_string, err := audit_log.adminPublicKeyString()
+		if err != nil {
+			continue
+		}
+		jal := json_audit_log{
+			Id:               audit_log.F_id,
+			Timestamp:        audit_log.F_timestamp,
+			Admin_public_key: admin_public_key_string,
+			Action:           audit_log.F_action,
+			Target:           audit_log.F_target,
+			Details:          audit_log.F_details,
+		}
+		json_response.Entries = append(json_response.Entries, jal)
+	}
+
+	sendJSONResponse(w, &json_response)
+}
+
+/* newest first, with the payload that was or will be sent */
+func handlerAdminGetWebhookDeliveries(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	store := requestStorage(server)
+	admin_request := adminRequest(w, r, store, "list_webhooks")
+	if admin_request == nil {
+		return
+	}
+
+	limit, err := admin_request.targetLimit()
+	if err != nil {
+		errorResponse(w, 400, "Invalid limit")
+		return
+	}
+
+	if !admin_request.audit(w, store, "") {
+		return
+	}
+
+	deliveries, err := DBWebhookDelivery__getRecent(store, limit)
+	if err != nil {
+		errorResponse(w, 500, "Could not get webhook deliveries")
+		return
+	}
+
+	type json_delivery struct {
+		Id                     int    `json:"id"`
+		Timestamp              int    `json:"timestamp"`
+		Url                    string `json:"url"`
+		Event_type             string `json:"event_type"`
+		Payload                string `json:"payload"`
+		Status                 string `json:"status"`
+		Attempts               int    `json:"attempts"`
+		Next_attempt_timestamp int    `json:"next_attempt_timestamp"`
+		Last_attempt_timestamp int    `json:"last_attempt_timestamp"`
+		Last_status_code       int    `json:"last_status_code"`
+		Last_error             string `json:"last_error"`
+	}
+	json_response := struct {
+		Deliveries []json_delivery `json:"deliveries"`
+	}{
+		Deliveries: make([]json_delivery, 0, len(deliveries)),
+	}
+	for _, delivery := range deliveries {
+		json_response.Deliveries = append(json_response.Deliveries, json_delivery{
+			Id:                     delivery.F_id,
+			Timestamp:              delivery.F_timestamp,
+			Url:                    delivery.F_url,
+			Event_type:             delivery.F_event_type,
+			Payload:                delivery.F_payload,
+			Status:                 delivery.F_status,
+			Attempts:               delivery.F_attempts,
+			Next_attempt_timestamp: delivery.F_next_attempt_timestamp,
+			Last_attempt_timestamp: delivery.F_last_attempt_timestamp,
+			Last_status_code:       delivery.F_last_status_code,
+			Last_error:             delivery.F_last_error,
+		})
+	}
+
+	sendJSONResponse(w, &json_response)
+}
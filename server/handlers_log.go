@@ -0,0 +1,213 @@
+package main
+
+import (
+	"github.com/fivebillionmph/be227a/protocol"
+	gss "github.com/fivebillionmph/gosimpleserver"
+	"net/http"
+	"strconv"
+)
+
+const LOG_ENTRIES_LIMIT = 1000
+
+/*
+ * tree sizes in requests are optional, 0 or missing means the current size.
+ * proofs are returned with a signed head for the same size so they can be
+ * checked in one request.
+ */
+func requestTreeSize(tree_size int) int {
+	if tree_size == 0 {
+		return global_transparency_log.size()
+	}
+	return tree_size
+}
+
+func handlerGetLogHead(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	tree_size := 0
+	size_str := r.URL.Query().Get("size")
+	if size_str != "" {
+		var err error
+		tree_size, err = strconv.Atoi(size_str)
+		if err != nil {
+			errorResponse(w, 400, "Invalid tree size")
+			return
+		}
+	}
+
+	tree_head, err := global_transparency_log.treeHead(requestTreeSize(tree_size))
+	if err != nil {
+		errorResponse(w, 400, "Invalid tree size")
+		return
+	}
+
+	sendJSONResponse(w, tree_head)
+}
+
+/* entries from start up to but not including end */
+func handlerGetLogEntries(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	start, err := strconv.Atoi(r.URL.Query().Get("start"))
+	if err != nil || start < 0 {
+		errorResponse(w, 400, "Invalid start")
+		return
+	}
+	end, err := strconv.Atoi(r.URL.Query().Get("end"))
+	if err != nil || end < start {
+		errorResponse(w, 400, "Invalid end")
+		return
+	}
+	if end-start > LOG_ENTRIES_LIMIT {
+		end = start + LOG_ENTRIES_LIMIT
+	}
+
+	db_log_entries, err := DBLogEntry__getAll(requestStorage(server))
+	if err != nil {
+		errorResponse(w, 500, "Could not get log entries")
+		return
+	}
+	if end > len(db_log_entries) {
+		end = len(db_log_entries)
+	}
+
+	json_response := struct {
+		Entries []protocol.LogEntry `json:"entries"`
+	}{
+		Entries: make([]protocol.LogEntry, 0, 8),
+	}
+	for i := start; i < end; i++ {
+		log_entry, err := db_log_entries[i].logEntry()
+		if err != nil {
+			errorResponse(w, 500, "Could not read log entry")
+			return
+		}
+		json_response.Entries = append(json_response.Entries, log_entry)
+	}
+
+	sendJSONResponse(w, &json_response)
+}
+
+func handlerGetLogUserProof(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	json_request := struct {
+		Key       string `json:"key"`
+		Tree_size int    `json:"tree_size"`
+	}{}
+	err := requestJSONDecode(r, &json_request)
+	if err != nil {
+		errorResponse(w, 400, "Could not read request")
+		return
+	}
+
+	public_key, err := stringToPublicKey(json_request.Key)
+	if err != nil {
+		errorResponse(w, 400, "Invalid public key")
+		return
+	}
+
+	store := requestStorage(server)
+	user, err := DBUser__getByAnyPublicKey(store, public_key)
+	if err != nil {
+		errorResponse(w, 400, "User not found")
+		return
+	}
+
+	tree_size := requestTreeSize(json_request.Tree_size)
+	tree_head, err := global_transparency_log.treeHead(tree_size)
+	if err != nil {
+		errorResponse(w, 400, "Invalid tree size")
+		return
+	}
+
+	log_proof, err := global_transparency_log.itemProof(store, protocol.LOG_ENTRY_USER, user.F_id, tree_size)
+	if err != nil {
+		errorResponse(w, 400, "User not in tree")
+		return
+	}
+
+	json_response := struct {
+		Tree_head *protocol.SignedTreeHead `json:"tree_head"`
+		User      *protocol.LogProof       `json:"user"`
+	}{
+		tree_head,
+		log_proof,
+	}
+
+	sendJSONResponse(w, &json_response)
+}
+
+/* if the signature is revoked and the revocation is in the tree, its proof is included */
+func handlerGetLogSignatureProof(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	json_request := struct {
+		Id        int `json:"id"`
+		Tree_size int `json:"tree_size"`
+	}{}
+	err := requestJSONDecode(r, &json_request)
+	if err != nil {
+		errorResponse(w, 400, "Could not read request")
+		return
+	}
+
+	store := requestStorage(server)
+	tree_size := requestTreeSize(json_request.Tree_size)
+	tree_head, err := global_transparency_log.treeHead(tree_size)
+	if err != nil {
+		errorResponse(w, 400, "Invalid tree size")
+		return
+	}
+
+	log_proof, err := global_transparency_log.itemProof(store, protocol.LOG_ENTRY_SIGNATURE, json_request.Id, tree_size)
+	if err != nil {
+		errorResponse(w, 400, "Signature not in tree")
+		return
+	}
+
+	json_response := struct {
+		Tree_head  *protocol.SignedTreeHead `json:"tree_head"`
+		Signature  *protocol.LogProof       `json:"signature"`
+		Revocation *protocol.LogProof       `json:"revocation,omitempty"`
+	}{
+		Tree_head: tree_head,
+		Signature: log_proof,
+	}
+
+	revocation, err := DBRevocation__getBySignatureID(store, json_request.Id)
+	if err == nil {
+		json_response.Revocation, _ = global_transparency_log.itemProof(store, protocol.LOG_ENTRY_REVOCATION, revocation.F_id, tree_size)
+	}
+
+	sendJSONResponse(w, &json_response)
+}
+
+func handlerGetLogConsistency(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	json_request := struct {
+		First  int `json:"first"`
+		Second int `json:"second"`
+	}{}
+	err := requestJSONDecode(r, &json_request)
+	if err != nil {
+		errorResponse(w, 400, "Could not read request")
+		return
+	}
+
+	second := requestTreeSize(json_request.Second)
+	proof, err := global_transparency_log.consistencyProof(json_request.First, second)
+	if err != nil {
+		errorResponse(w, 400, "Invalid tree size")
+		return
+	}
+
+	tree_head, err := global_transparency_log.treeHead(second)
+	if err != nil {
+		errorResponse(w, 500, "Could not sign tree head")
+		return
+	}
+
+	json_response := struct {
+		First     int                      `json:"first"`
+		Tree_head *protocol.SignedTreeHead `json:"tree_head"`
+		Proof     [][]byte                 `json:"proof"`
+	}{
+		json_request.First,
+		tree_head,
+		proof,
+	}
+
+	sendJSONResponse(w, &json_response)
+}
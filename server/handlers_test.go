@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/fivebillionmph/be227a/client"
+	"github.com/fivebillionmph/be227a/protocol"
+	"net/http"
+	"testing"
+)
+
+func testClient(t *testing.T, base_url string, algorithm string, name string) (*client.Client, string) {
+	private_key, err := client.GenerateKey(algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := client.Client__new(base_url, private_key)
+	if name != "" {
+		err = c.Register(name, "org")
+		if err != nil {
+			t.Fatal(name, err)
+		}
+	}
+	public_key_string, err := c.PublicKeyString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, public_key_string
+}
+
+func testSign(t *testing.T, signer *client.Client, signee_public_key string) {
+	err := signer.Sign(signee_public_key, protocol.VerifyMessage{
+		Start_time:  timestamp() - 10,
+		Message_key: "identity",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	test_server := testServer(t)
+
+	for _, algorithm := range []string{"rsa", "ecdsa", "ed25519"} {
+		_, public_key_string := testClient(t, test_server.URL, algorithm, "user-"+algorithm)
+
+		public_key, err := stringToPublicKey(public_key_string)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db_user, err := DBUser__getByPublicKey(requestStorage(nil), public_key)
+		if err != nil {
+			t.Fatal(algorithm, err)
+		}
+		if db_user.F_name != "user-"+algorithm || !db_user.active() {
+			t.Fatalf("%s: registered %+v", algorithm, db_user)
+		}
+	}
+
+	users, err := client.Client__new(test_server.URL, nil).Keys("user-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 {
+		t.Fatalf("listed %d users, want 3", len(users))
+	}
+
+	c, _ := testClient(t, test_server.URL, "ed25519", "twice")
+	if c.Register("twice", "org") == nil {
+		t.Fatal("registered the same key twice")
+	}
+}
+
+func TestSignAndRevoke(t *testing.T) {
+	test_server := testServer(t)
+	signer, _ := testClient(t, test_server.URL, "ed25519", "signer")
+	_, signee_public_key := testClient(t, test_server.URL, "rsa", "signee")
+	other, _ := testClient(t, test_server.URL, "ecdsa", "other")
+
+	testSign(t, signer, signee_public_key)
+
+	signatures, err := signer.Signatures(signee_public_key, false, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signatures) != 1 || signatures[0].Status != SIGNATURE_STATUS_VALID || signatures[0].Version != protocol.VERSION_CANONICAL {
+		t.Fatalf("signatures %+v", signatures)
+	}
+	signature_id := signatures[0].Id
+
+	_, unregistered_public_key := testClient(t, test_server.URL, "ed25519", "")
+	if signer.Sign(unregistered_public_key, protocol.VerifyMessage{Message_key: "identity"}) == nil {
+		t.Fatal("signed an unregistered key")
+	}
+
+	if other.Revoke(signature_id, "not mine") == nil {
+		t.Fatal("revoked another signer's signature")
+	}
+
+	err = signer.Revoke(signature_id, "mistake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signer.Revoke(signature_id, "again") == nil {
+		t.Fatal("revoked twice")
+	}
+
+	signatures, err = signer.Signatures(signee_public_key, false, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signatures) != 1 || !signatures[0].Revoked {
+		t.Fatalf("signatures after revoking %+v", signatures)
+	}
+
+	signatures, err = signer.Signatures(signee_public_key, false, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signatures) != 0 {
+		t.Fatalf("valid only listed a revoked signature %+v", signatures)
+	}
+}
+
+func TestSession(t *testing.T) {
+	test_server := testServer(t)
+	c, public_key_string := testClient(t, test_server.URL, "ed25519", "peer")
+	reader := client.Client__new(test_server.URL, nil)
+
+	session, err := c.StartSession(4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err := reader.Sessions("peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Port != 4000 || sessions[0].IP != "127.0.0.1" || sessions[0].Public_key != public_key_string {
+		t.Fatalf("sessions %+v", sessions)
+	}
+
+	err = session.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = session.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Refresh() == nil {
+		t.Fatal("refreshed a stopped session")
+	}
+
+	sessions, err = reader.Sessions("peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Fatalf("stopped session still listed %+v", sessions)
+	}
+
+	unregistered, _ := testClient(t, test_server.URL, "ed25519", "")
+	if _, err := unregistered.StartSession(4001); err == nil {
+		t.Fatal("started a session for an unregistered key")
+	}
+}
+
+/* in-memory storage that holds the first user lookup made while the test waits on entered */
+type testBlockingStorage struct {
+	*StorageMemory
+	entered chan bool
+	release chan bool
+}
+
+func (self *testBlockingStorage) userGetByPublicKey(public_key_der string) (*DBUser, error) {
+	select {
+	case self.entered <- true:
+		<-self.release
+	default:
+	}
+	return self.StorageMemory.userGetByPublicKey(public_key_der)
+}
+
+func testAnswerSessionChallenge(t *testing.T, base_url string, request_body []byte) int {
+	request, _ := http.NewRequest("PUT", base_url+"/a/session/challenge", bytes.NewReader(request_body))
+	res, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+/* a second answer to a challenge is refused while the first is still being handled */
+func TestSessionChallengeOnce(t *testing.T) {
+	test_server := testServer(t)
+	store := &testBlockingStorage{
+		StorageMemory: global_storage.(*StorageMemory),
+		entered:       make(chan bool),
+		release:       make(chan bool),
+	}
+	global_storage = store
+
+	private_key, err := client.GenerateKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Client__new(test_server.URL, private_key).Register("peer", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge, err := UserChallenge__new(private_key.Public(), protocol.CHALLENGE_TYPE_START_SESSION, &ChallengeRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := protocol.Sign(private_key, challenge.challenge_nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request_body, _ := json.Marshal(map[string]interface{}{
+		"signature": base64.StdEncoding.EncodeToString(signature),
+		"index":     challenge.global_index,
+		"port":      4000,
+	})
+
+	first_status_code := make(chan int)
+	go func() {
+		first_status_code <- testAnswerSessionChallenge(t, test_server.URL, request_body)
+	}()
+	<-store.entered
+
+	second_status_code := testAnswerSessionChallenge(t, test_server.URL, request_body)
+	close(store.release)
+	if <-first_status_code != 200 {
+		t.Fatal("first answer refused")
+	}
+	if second_status_code != 400 {
+		t.Fatal("second answer got", second_status_code)
+	}
+
+	sessions, err := client.Client__new(test_server.URL, nil).Sessions("peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("%d sessions listed", len(sessions))
+	}
+}
+
+/* legacy messages are ambiguous, so new signatures and revocations have to be canonical */
+func TestLegacyMessagesRefused(t *testing.T) {
+	test_server := testServer(t)
+	signer_private_key, err := client.GenerateKey("ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := client.Client__new(test_server.URL, signer_private_key)
+	err = signer.Register("signer", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer_public_key, _ := signer.PublicKeyString()
+	_, signee_public_key := testClient(t, test_server.URL, "ed25519", "signee")
+
+	err = signer.Sign(signee_public_key, protocol.VerifyMessage{
+		Version:     protocol.VERSION_LEGACY,
+		Start_time:  timestamp() - 10,
+		Message_key: "identity",
+	})
+	if err == nil {
+		t.Fatal("accepted a legacy signature")
+	}
+
+	testSign(t, signer, signee_public_key)
+	signatures, err := signer.Signatures(signee_public_key, false, false, "")
+	if err != nil || len(signatures) != 1 {
+		t.Fatal(err, signatures)
+	}
+
+	message := protocol.RevocationMessage{
+		Version:      protocol.VERSION_LEGACY,
+		Signature_id: signatures[0].Id,
+		Timestamp:    timestamp(),
+		Reason:       "legacy",
+	}
+	signing_string, _ := message.SigningString()
+	signature, err := protocol.Sign(signer_private_key, signing_string)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request_body, _ := json.Marshal(map[string]interface{}{
+		"signature":         base64.StdEncoding.EncodeToString(signature),
+		"message":           message,
+		"signer_public_key": signer_public_key,
+	})
+	request, _ := http.NewRequest("PUT", test_server.URL+"/a/revoke", bytes.NewReader(request_body))
+	res, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatal("legacy revocation got", res.Status)
+	}
+
+	signatures, _ = signer.Signatures(signee_public_key, false, false, "")
+	if signatures[0].Revoked {
+		t.Fatal("legacy revocation was stored")
+	}
+}
+
+/* a rotation prepared before the user was deactivated or the new key was taken isn't stored */
+func TestRotateRechecksBeforeWriting(t *testing.T) {
+	test_server := testServer(t)
+	store := requestStorage(nil)
+
+	prepare := func(name string) (*DBUser, *DBUserKey, *client.Client) {
+		private_key, _ := client.GenerateKey("ed25519")
+		c := client.Client__new(test_server.URL, private_key)
+		err := c.Register(name, "org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, _ := DBUser__getByPublicKey(store, private_key.Public())
+
+		new_private_key, _ := client.GenerateKey("ed25519")
+		old_public_key_string, _ := c.PublicKeyString()
+		new_public_key_string, _ := protocol.PublicKeyToString(new_private_key.Public())
+		message := DBUserKey__VerifyMessage{
+			Version:        protocol.VERSION_CANONICAL,
+			Old_public_key: old_public_key_string,
+			New_public_key: new_public_key_string,
+			Timestamp:      timestamp(),
+		}
+		signing_string, _ := protocol.SuccessionMessage(message).SigningString()
+		signature, _ := protocol.Sign(private_key, signing_string)
+		user_key, _, err := DBUserKey__prepareRotation(store, user, message, string(signature))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user, user_key, client.Client__new(test_server.URL, new_private_key)
+	}
+
+	user, user_key, _ := prepare("deactivated")
+	err := DBUser__deactivate(store, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DBUserKey__rotate(store, user_key); err == nil {
+		t.Fatal("rotated a deactivated user")
+	}
+
+	user, user_key, new_client := prepare("taken")
+	err = new_client.Register("other", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DBUserKey__rotate(store, user_key); err == nil {
+		t.Fatal("rotated onto a key registered by another user")
+	}
+	user_keys, _ := DBUserKey__getByUser(store, user)
+	if len(user_keys) != 0 {
+		t.Fatal("refused rotation left", len(user_keys), "history entries")
+	}
+
+	_, user_key, _ = prepare("rotated")
+	if _, err := DBUserKey__rotate(store, user_key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/* signatures made before the signer rotated are listed under the key that made them */
+func TestSignaturesAfterRotation(t *testing.T) {
+	test_server := testServer(t)
+	signer, old_public_key_string := testClient(t, test_server.URL, "ed25519", "signer")
+	_, signee_public_key := testClient(t, test_server.URL, "rsa", "signee")
+	testSign(t, signer, signee_public_key)
+
+	new_private_key, _ := client.GenerateKey("ecdsa")
+	err := signer.RotateKey(new_private_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	new_public_key_string, _ := signer.PublicKeyString()
+	testSign(t, signer, signee_public_key)
+
+	signatures, err := signer.Signatures(signee_public_key, false, false, "")
+	if err != nil || len(signatures) != 2 {
+		t.Fatal(err, signatures)
+	}
+
+	for i, signature := range signatures {
+		want_public_key_string := []string{old_public_key_string, new_public_key_string}[i]
+		if !samePublicKeyString(signature.Signer.Public_key, want_public_key_string) || !samePublicKeyString(signature.Signer.Current_public_key, new_public_key_string) {
+			t.Fatalf("signature %d listed with %+v", i, signature.Signer)
+		}
+		if len(signature.Signer.Succession) != 1-i {
+			t.Fatalf("signature %d has %d succession statements", i, len(signature.Signer.Succession))
+		}
+
+		signer_public_key, _ := stringToPublicKey(signature.Signer.Public_key)
+		message := DBSignature__VerifyMessage{}
+		json.Unmarshal([]byte(signature.Message), &message)
+		raw_signature, _ := base64.StdEncoding.DecodeString(signature.Signature)
+		if !DBSignature__verifyMessageWithKeys(signer_public_key, signee_public_key, message, string(raw_signature)) {
+			t.Fatalf("signature %d doesn't verify with the listed signer key", i)
+		}
+
+		fsig := FederationSignature{}
+		signature_json, _ := json.Marshal(&signature)
+		json.Unmarshal(signature_json, &fsig)
+		current_public_key_string, ok := fsig.Signer.followSuccession()
+		if !ok || !samePublicKeyString(current_public_key_string, new_public_key_string) {
+			t.Fatalf("signature %d succession doesn't lead to the current key", i)
+		}
+		if !verifyFederationSignature(requestStorage(nil), signee_public_key, fsig, FederationKeyCache{}) {
+			t.Fatalf("signature %d dropped by federation verification", i)
+		}
+	}
+
+	/* a succession statement that wasn't signed by the old key is refused */
+	fsig := FederationSignature{}
+	signature_json, _ := json.Marshal(&signatures[0])
+	json.Unmarshal(signature_json, &fsig)
+	forged_private_key, _ := client.GenerateKey("ed25519")
+	forged_public_key_string, _ := protocol.PublicKeyToString(forged_private_key.Public())
+	fsig.Signer.Succession[0].Message.New_public_key = forged_public_key_string
+	fsig.Signer.Current_public_key = forged_public_key_string
+	if _, ok := fsig.Signer.followSuccession(); ok {
+		t.Fatal("followed a forged succession statement")
+	}
+}
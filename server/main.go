@@ -10,11 +10,12 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"time"
 )
 
 var global_private_key *rsa.PrivateKey
-var global_user_challenges map[int]*UserChallenge
-var global_user_sessions map[string]*UserSession
+var global_user_challenges *Registry
+var global_user_sessions *Registry
 var global_host_name string
 
 func main() {
@@ -23,6 +24,11 @@ func main() {
 		log.Fatal(err)
 	}
 
+	err = initStorage()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	err = loadKeys()
 	if err != nil {
 		log.Fatal(err)
@@ -38,21 +44,60 @@ func main() {
 		log.Fatal(err)
 	}
 
-	go maintainer()
+	err = DBSession__restoreAll(requestStorage(server))
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = global_transparency_log.load(requestStorage(server))
+	if err != nil {
+		log.Fatal(err)
+	}
+	global_user_sessions.setExpireCallback(func(key interface{}, entry RegistryEntry) {
+		UserSession__expired(requestStorage(server), entry.(*UserSession))
+	})
+
+	global_user_challenges.startMaintainer(5 * time.Second)
+	global_admin_replays.startMaintainer(5 * time.Second)
+	global_user_sessions.startMaintainer(5 * time.Second)
+	startWebhookDispatcher(server, 5*time.Second)
 	fmt.Println("server starting...")
 	server.Start()
 }
 
 func initGlobals() error {
-	var global_host_name = os.Getenv("HOST_NAME")
+	global_host_name = os.Getenv("HOST_NAME")
 	if global_host_name == "" {
 		return errors.New("host name not specified")
 	}
 
-	global_user_challenges = make(map[int]*UserChallenge)
-	global_user_sessions = make(map[string]*UserSession)
+	global_user_challenges = Registry__new()
+	global_user_sessions = Registry__new()
+	initSessionPersistence()
+	initResponseSigning()
+	initLegacySchemes()
+	global_transparency_log = TransparencyLog__new()
 
-	return nil
+	err := initTrustedProxies()
+	if err != nil {
+		return err
+	}
+
+	err = initSessionLimit()
+	if err != nil {
+		return err
+	}
+
+	err = initWebhooks()
+	if err != nil {
+		return err
+	}
+
+	err = initAdmin()
+	if err != nil {
+		return err
+	}
+
+	return initFederationPeers()
 }
 
 func loadKeys() error {
@@ -86,6 +131,11 @@ func addServerPaths(server *gss.Server) error {
 		return err
 	}
 
+	err = server.AddRouterPath("/.well-known/keyserver-key", "GET", false, handlerGetServerKey)
+	if err != nil {
+		return err
+	}
+
 	err = server.AddRouterPath("/a/session", "POST", false, handlerStartSession)
 	if err != nil {
 		return err
@@ -106,6 +156,16 @@ func addServerPaths(server *gss.Server) error {
 		return err
 	}
 
+	err = server.AddRouterPath("/a/session/mine", "POST", false, handlerGetMySessions)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/session/mine", "DELETE", false, handlerEndMySession)
+	if err != nil {
+		return err
+	}
+
 	err = server.AddRouterPath("/a/register", "PUT", false, handlerRegister)
 	if err != nil {
 		return err
@@ -116,26 +176,146 @@ func addServerPaths(server *gss.Server) error {
 		return err
 	}
 
+	err = server.AddRouterPath("/a/deactivate", "PUT", false, handlerDeactivate)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/deactivate/challenge", "PUT", false, handlerDeactivateChallenge)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/admin/deactivate", "PUT", false, handlerAdminDeactivate)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/admin/users", "GET", false, handlerAdminGetUsers)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/admin/reactivate", "PUT", false, handlerAdminReactivate)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/admin/role/grant", "PUT", false, handlerAdminGrantAdmin)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/admin/role/revoke", "PUT", false, handlerAdminRevokeAdmin)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/admin/signature", "DELETE", false, handlerAdminDeleteSignature)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/admin/signature/revoke", "PUT", false, handlerAdminRevokeSignature)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/admin/session", "DELETE", false, handlerAdminKillSession)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/admin/sessions", "GET", false, handlerAdminGetSessions)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/admin/challenges", "GET", false, handlerAdminGetChallenges)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/admin/audit", "GET", false, handlerAdminGetAuditLog)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/admin/webhooks", "GET", false, handlerAdminGetWebhookDeliveries)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/rotate", "PUT", false, handlerRotateKey)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/rotate/challenge", "PUT", false, handlerRotateKeyChallenge)
+	if err != nil {
+		return err
+	}
+
 	err = server.AddRouterPath("/a/sign", "POST", false, handlerAddSignature)
 	if err != nil {
 		return err
 	}
 
-	//err = server.AddRouterPath("/a/revoke", "PUT", false, handlerRevokeSignature)
-	//if err != nil {
-	//	log.Fatal(err)
-	//}
+	err = server.AddRouterPath("/a/revoke", "PUT", false, handlerRevokeSignature)
+	if err != nil {
+		return err
+	}
 
 	err = server.AddRouterPath("/a/signatures", "GET", false, handlerGetSignatures)
 	if err != nil {
 		return err
 	}
 
+	err = server.AddRouterPath("/a/message-keys", "GET", false, handlerGetMessageKeys)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/log/head", "GET", false, handlerGetLogHead)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/log/entries", "GET", false, handlerGetLogEntries)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/log/proof/user", "GET", false, handlerGetLogUserProof)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/log/proof/signature", "GET", false, handlerGetLogSignatureProof)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/log/consistency", "GET", false, handlerGetLogConsistency)
+	if err != nil {
+		return err
+	}
+
+	err = server.AddRouterPath("/a/path", "GET", false, handlerGetTrustPath)
+	if err != nil {
+		return err
+	}
+
 	err = server.AddRouterPath("/a/sessions", "GET", false, handlerGetSessions)
 	if err != nil {
 		return err
 	}
 
+	err = server.AddRouterPath("/a/sessions/stream", "GET", false, handlerGetSessionStream)
+	if err != nil {
+		return err
+	}
+
 	err = server.AddRouterPath("/a/keys", "GET", false, handlerGetKeys)
 	if err != nil {
 		return err
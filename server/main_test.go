@@ -0,0 +1,73 @@
+package main
+
+import (
+	gss "github.com/fivebillionmph/gosimpleserver"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+type testRoute struct {
+	method  string
+	path    string
+	handler func(http.ResponseWriter, *http.Request, *gss.Server)
+}
+
+var test_routes = []testRoute{
+	{"POST", "/a/session", handlerStartSession},
+	{"DELETE", "/a/session", handlerStopSession},
+	{"PUT", "/a/session/challenge", handlerSessionChallenge},
+	{"POST", "/a/session/refresh", handlerSessionRefresh},
+	{"PUT", "/a/register", handlerRegister},
+	{"PUT", "/a/register/challenge", handlerRegisterChallenge},
+	{"PUT", "/a/rotate", handlerRotateKey},
+	{"PUT", "/a/rotate/challenge", handlerRotateKeyChallenge},
+	{"POST", "/a/sign", handlerAddSignature},
+	{"PUT", "/a/revoke", handlerRevokeSignature},
+	{"GET", "/a/signatures", handlerGetSignatures},
+	{"GET", "/a/sessions", handlerGetSessions},
+	{"GET", "/a/sessions/stream", handlerGetSessionStream},
+	{"GET", "/a/keys", handlerGetKeys},
+	{"GET", "/.well-known/keyserver-key", handlerGetServerKey},
+	{"PUT", "/a/admin/deactivate", handlerAdminDeactivate},
+	{"PUT", "/a/admin/reactivate", handlerAdminReactivate},
+	{"DELETE", "/a/admin/signature", handlerAdminDeleteSignature},
+	{"PUT", "/a/admin/signature/revoke", handlerAdminRevokeSignature},
+	{"GET", "/a/admin/webhooks", handlerAdminGetWebhookDeliveries},
+}
+
+/*
+ * a fresh server on the in-memory backend. the handlers only use the gss
+ * server for the mysql connection, so they're called with nil.
+ */
+func testServer(t *testing.T) *httptest.Server {
+	t.Setenv("HOST_NAME", "test")
+	t.Setenv("STORAGE", "memory")
+	t.Setenv("KEY_FILE", filepath.Join(t.TempDir(), "key"))
+
+	err := initGlobals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = initStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	for _, route := range test_routes {
+		handler := route.handler
+		mux.HandleFunc(route.method+" "+route.path, func(w http.ResponseWriter, r *http.Request) {
+			handler(w, r, nil)
+		})
+	}
+
+	test_server := httptest.NewServer(mux)
+	t.Cleanup(test_server.Close)
+	return test_server
+}
@@ -4,26 +4,48 @@ import (
 	"time"
 )
 
-/* runs every 5 seconds */
-func maintainer() {
-	const SESSION_TIME_LIMIT = 3600 // seconds
+/* starts a goroutine that expires entries every interval until stopMaintainer is called */
+func (self *Registry) startMaintainer(interval time.Duration) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 
-	for {
-		time.Sleep(5 * time.Second)
-		now := timestamp()
-
-		/* user challenges */
-		for key, user_challenge := range global_user_challenges {
-			if now > user_challenge.expire_timestamp {
-				delete(global_user_challenges, key)
-			}
-		}
+	if self.stop_channel != nil {
+		return
+	}
+	self.stop_channel = make(chan bool)
+	self.done_channel = make(chan bool)
+
+	go self.maintainer(interval, self.stop_channel, self.done_channel)
+}
+
+/* returns once the goroutine has exited, so no expire callback runs after it */
+func (self *Registry) stopMaintainer() {
+	self.mutex.Lock()
+	stop_channel := self.stop_channel
+	done_channel := self.done_channel
+	self.stop_channel = nil
+	self.done_channel = nil
+	self.mutex.Unlock()
 
-		/* sessions */
-		for key, user_session := range global_user_sessions {
-			if now > user_session.lastcheck_timestamp+SESSION_TIME_LIMIT {
-				delete(global_user_sessions, key)
-			}
+	if stop_channel != nil {
+		close(stop_channel)
+		/* the lock is released first, expire takes it */
+		<-done_channel
+	}
+}
+
+func (self *Registry) maintainer(interval time.Duration, stop_channel chan bool, done_channel chan bool) {
+	defer close(done_channel)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop_channel:
+			return
+		case <-ticker.C:
+			self.expire(timestamp())
 		}
 	}
 }
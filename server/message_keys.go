@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+const MODIFIER_TYPE_STRING = "string"
+const MODIFIER_TYPE_INT = "int"
+const MODIFIER_TYPE_BOOL = "bool"
+
+/*
+ * a known Message_key and the modifiers that may go with it. Modifiers is a json
+ * object whose fields are checked against the schema, an empty string is {}.
+ * prefix schemas match any key that starts with name, like role:reviewer.
+ */
+type MessageKeySchema struct {
+	Name      string                    `json:"name"`
+	Prefix    bool                      `json:"prefix"`
+	Modifiers map[string]ModifierSchema `json:"modifiers"`
+}
+
+type ModifierSchema struct {
+	Type     string   `json:"type"`
+	Required bool     `json:"required"`
+	Values   []string `json:"values,omitempty"`
+}
+
+var global_message_keys = []MessageKeySchema{
+	{
+		Name: "identity",
+		Modifiers: map[string]ModifierSchema{
+			"method": {Type: MODIFIER_TYPE_STRING, Values: []string{"in_person", "video", "document"}},
+		},
+	},
+	{
+		Name: "org-membership",
+		Modifiers: map[string]ModifierSchema{
+			"organization": {Type: MODIFIER_TYPE_STRING, Required: true},
+			"since":        {Type: MODIFIER_TYPE_INT},
+		},
+	},
+	{
+		Name:   "role:",
+		Prefix: true,
+		Modifiers: map[string]ModifierSchema{
+			"scope": {Type: MODIFIER_TYPE_STRING},
+			"level": {Type: MODIFIER_TYPE_INT},
+		},
+	},
+}
+
+func MessageKeySchema__find(message_key string) *MessageKeySchema {
+	for i := range global_message_keys {
+		schema := &global_message_keys[i]
+		if schema.Prefix {
+			if strings.HasPrefix(message_key, schema.Name) && len(message_key) > len(schema.Name) {
+				return schema
+			}
+		} else if message_key == schema.Name {
+			return schema
+		}
+	}
+	return nil
+}
+
+func validateMessageKey(message_key string, modifiers string) error {
+	schema := MessageKeySchema__find(message_key)
+	if schema == nil {
+		return errors.New("unknown message key: " + message_key)
+	}
+
+	return schema.validateModifiers(modifiers)
+}
+
+func (self *MessageKeySchema) validateModifiers(modifiers string) error {
+	values := make(map[string]interface{})
+	if modifiers != "" {
+		decoder := json.NewDecoder(bytes.NewReader([]byte(modifiers)))
+		decoder.UseNumber()
+		err := decoder.Decode(&values)
+		if err != nil {
+			return errors.New("modifiers must be a json object")
+		}
+		if decoder.More() {
+			return errors.New("modifiers must be a single json object")
+		}
+	}
+
+	for field := range values {
+		_, ok := self.Modifiers[field]
+		if !ok {
+			return errors.New("unknown modifier: " + field)
+		}
+	}
+
+	for field, modifier := range self.Modifiers {
+		value, ok := values[field]
+		if !ok {
+			if modifier.Required {
+				return errors.New("missing modifier: " + field)
+			}
+			continue
+		}
+		err := modifier.validate(value)
+		if err != nil {
+			return errors.New("modifier " + field + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (self ModifierSchema) validate(value interface{}) error {
+	switch self.Type {
+	case MODIFIER_TYPE_STRING:
+		str, ok := value.(string)
+		if !ok {
+			return errors.New("must be a string")
+		}
+		if len(self.Values) == 0 {
+			return nil
+		}
+		for _, allowed := range self.Values {
+			if str == allowed {
+				return nil
+			}
+		}
+		return errors.New("must be one of " + strings.Join(self.Values, ", "))
+	case MODIFIER_TYPE_INT:
+		number, ok := value.(json.Number)
+		if !ok {
+			return errors.New("must be an integer")
+		}
+		_, err := number.Int64()
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		return nil
+	case MODIFIER_TYPE_BOOL:
+		_, ok := value.(bool)
+		if !ok {
+			return errors.New("must be true or false")
+		}
+		return nil
+	default:
+		return errors.New("unknown modifier type")
+	}
+}
+
+/* scope is an exact message key, or a prefix ending in ":" like "role:" */
+func messageKeyInScope(message_key string, scope string) bool {
+	if strings.HasSuffix(scope, ":") {
+		return strings.HasPrefix(message_key, scope)
+	}
+	return message_key == scope
+}
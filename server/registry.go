@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+)
+
+type RegistryEntry interface {
+	expired(now int) bool
+}
+
+/* concurrent-safe map of entries that are dropped once they expire */
+type Registry struct {
+	mutex           sync.RWMutex
+	entries         map[interface{}]RegistryEntry
+	stop_channel    chan bool
+	done_channel    chan bool
+	expire_callback func(key interface{}, entry RegistryEntry)
+}
+
+func Registry__new() *Registry {
+	return &Registry{
+		entries: make(map[interface{}]RegistryEntry),
+	}
+}
+
+/* returns false without replacing anything if the key is already taken */
+func (self *Registry) add(key interface{}, entry RegistryEntry) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	_, ok := self.entries[key]
+	if ok {
+		return false
+	}
+	self.entries[key] = entry
+
+	return true
+}
+
+/* returns nil if the entry does not exist or has expired but not been cleaned up yet */
+func (self *Registry) get(key interface{}) RegistryEntry {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	entry, ok := self.entries[key]
+	if !ok || entry.expired(timestamp()) {
+		return nil
+	}
+
+	return entry
+}
+
+/* returns false if there was nothing to remove */
+func (self *Registry) remove(key interface{}) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	_, ok := self.entries[key]
+	if ok {
+		delete(self.entries, key)
+	}
+
+	return ok
+}
+
+/* snapshot of the unexpired entries, in no particular order */
+func (self *Registry) values() []RegistryEntry {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	now := timestamp()
+	values := make([]RegistryEntry, 0, len(self.entries))
+	for _, entry := range self.entries {
+		if !entry.expired(now) {
+			values = append(values, entry)
+		}
+	}
+
+	return values
+}
+
+func (self *Registry) len() int {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	return len(self.entries)
+}
+
+/* called by expire for every entry it removes, outside of the registry lock */
+func (self *Registry) setExpireCallback(callback func(key interface{}, entry RegistryEntry)) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.expire_callback = callback
+}
+
+/* removes and returns the entries that have expired at now */
+func (self *Registry) expire(now int) []RegistryEntry {
+	self.mutex.Lock()
+	expired_keys := make([]interface{}, 0)
+	expired := make([]RegistryEntry, 0)
+	for key, entry := range self.entries {
+		if entry.expired(now) {
+			delete(self.entries, key)
+			expired_keys = append(expired_keys, key)
+			expired = append(expired, entry)
+		}
+	}
+	callback := self.expire_callback
+	self.mutex.Unlock()
+
+	if callback != nil {
+		for i, entry := range expired {
+			callback(expired_keys[i], entry)
+		}
+	}
+
+	return expired
+}
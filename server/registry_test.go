@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type testEntry struct {
+	expire_timestamp int
+}
+
+func (self *testEntry) expired(now int) bool {
+	return now > self.expire_timestamp
+}
+
+func TestRegistryExpire(t *testing.T) {
+	registry := Registry__new()
+	now := timestamp()
+
+	registry.add("old", &testEntry{now - 1})
+	registry.add("new", &testEntry{now + 100})
+	if registry.add("new", &testEntry{now + 200}) {
+		t.Fatal("add replaced an existing key")
+	}
+	if registry.get("old") != nil {
+		t.Fatal("get returned an expired entry")
+	}
+	if len(registry.values()) != 1 {
+		t.Fatal("values included an expired entry")
+	}
+
+	expired_keys := make([]interface{}, 0)
+	registry.setExpireCallback(func(key interface{}, entry RegistryEntry) {
+		expired_keys = append(expired_keys, key)
+	})
+
+	expired := registry.expire(now)
+	if len(expired) != 1 || len(expired_keys) != 1 || expired_keys[0] != "old" {
+		t.Fatalf("expired %v, callback got %v", expired, expired_keys)
+	}
+	if registry.len() != 1 || registry.get("new") == nil {
+		t.Fatal("expire removed an unexpired entry")
+	}
+
+	if len(registry.expire(now+101)) != 1 || registry.len() != 0 {
+		t.Fatal("entry not expired once its time passed")
+	}
+}
+
+func TestRegistryMaintainer(t *testing.T) {
+	registry := Registry__new()
+	now := timestamp()
+
+	expired_keys := make(chan interface{}, 8)
+	registry.setExpireCallback(func(key interface{}, entry RegistryEntry) {
+		expired_keys <- key
+	})
+
+	registry.add("old", &testEntry{now - 1})
+	registry.add("new", &testEntry{now + 100})
+	registry.startMaintainer(10 * time.Millisecond)
+	/* a second start doesn't start another goroutine */
+	registry.startMaintainer(10 * time.Millisecond)
+
+	select {
+	case key := <-expired_keys:
+		if key != "old" {
+			t.Fatal("expired", key)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("maintainer didn't expire the entry")
+	}
+	if registry.len() != 1 || registry.get("new") == nil {
+		t.Fatal("maintainer removed an unexpired entry")
+	}
+
+	registry.mutex.RLock()
+	done_channel := registry.done_channel
+	registry.mutex.RUnlock()
+
+	registry.stopMaintainer()
+	select {
+	case <-done_channel:
+	default:
+		t.Fatal("maintainer goroutine still running after stop")
+	}
+
+	registry.add("stale", &testEntry{now - 1})
+	time.Sleep(50 * time.Millisecond)
+	if registry.len() != 2 {
+		t.Fatal("entries expired after the maintainer stopped")
+	}
+	select {
+	case key := <-expired_keys:
+		t.Fatal("callback ran after stop for", key)
+	default:
+	}
+
+	/* stopping twice is fine and it can be started again */
+	registry.stopMaintainer()
+	registry.startMaintainer(10 * time.Millisecond)
+	select {
+	case <-expired_keys:
+	case <-time.After(2 * time.Second):
+		t.Fatal("restarted maintainer didn't expire the entry")
+	}
+	registry.stopMaintainer()
+}
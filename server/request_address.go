@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+/*
+ * set from TRUSTED_PROXIES, a comma separated list of cidrs or addresses whose
+ * forwarding headers are believed. when it's unset only loopback proxies are
+ * trusted, set it empty to ignore the headers and use the connection's address.
+ */
+var global_trusted_proxies []*net.IPNet
+
+const TRUSTED_PROXIES_DEFAULT = "127.0.0.0/8,::1/128"
+
+/*
+ * where a request came from. observed is the address of the connection,
+ * claimed is the first address in the forwarding headers, which anyone can
+ * set, and ip is the client as far as the trusted proxies vouch for it.
+ */
+type RequestAddress struct {
+	ip       net.IP
+	observed net.IP
+	claimed  net.IP
+}
+
+func initTrustedProxies() error {
+	trusted_proxies, ok := os.LookupEnv("TRUSTED_PROXIES")
+	if !ok {
+		trusted_proxies = TRUSTED_PROXIES_DEFAULT
+	}
+
+	global_trusted_proxies = make([]*net.IPNet, 0, 4)
+	for _, cidr := range strings.Split(trusted_proxies, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+
+		/* a bare address is a network of one */
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return errors.New("invalid trusted proxy: " + cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.New("invalid trusted proxy: " + cidr)
+		}
+		global_trusted_proxies = append(global_trusted_proxies, network)
+	}
+
+	return nil
+}
+
+func trustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range global_trusted_proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * walks the forwarding chain back from the connection. each trusted proxy
+ * vouches for the address before it, the first address not from a trusted
+ * proxy is the client. an address a proxy couldn't give ("unknown" or an
+ * obfuscated name) leaves ip nil.
+ */
+func requestAddress(r *http.Request) RequestAddress {
+	address := RequestAddress{}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	address.observed = net.ParseIP(host)
+
+	forwarded := forwardedAddresses(r)
+	if len(forwarded) > 0 {
+		address.claimed = forwarded[0]
+	}
+
+	chain := append(forwarded, address.observed)
+	for i := len(chain) - 1; i >= 0; i-- {
+		if chain[i] == nil {
+			return address
+		}
+		if i == 0 || !trustedProxy(chain[i]) {
+			address.ip = chain[i]
+			return address
+		}
+	}
+
+	return address
+}
+
+/* "" for nil, where net.IP.String would give "<nil>" */
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+/* the client as far as the trusted proxies vouch for it, nil if it can't be told */
+func requestIP(r *http.Request) net.IP {
+	return requestAddress(r).ip
+}
+
+/*
+ * the addresses in the Forwarded header, or X-Forwarded-For if there isn't
+ * one, first hop first. entries that aren't addresses are nil. Forwarded
+ * elements without for=, like proto=https, say nothing about the chain and
+ * are skipped.
+ */
+func forwardedAddresses(r *http.Request) []net.IP {
+	addresses := make([]net.IP, 0, 4)
+
+	forwarded := r.Header.Values("Forwarded")
+	if len(forwarded) > 0 {
+		for _, element := range splitHeaderList(forwarded) {
+			ip, ok := parseForwardedElement(element)
+			if ok {
+				addresses = append(addresses, ip)
+			}
+		}
+		return addresses
+	}
+
+	for _, entry := range splitHeaderList(r.Header.Values("X-Forwarded-For")) {
+		addresses = append(addresses, parseForwardedNode(entry))
+	}
+	return addresses
+}
+
+/* header lines may repeat and each may hold a comma separated list */
+func splitHeaderList(lines []string) []string {
+	entries := make([]string, 0, 4)
+	for _, line := range lines {
+		for _, entry := range splitOutsideQuotes(line, ',') {
+			entry = strings.TrimSpace(entry)
+			if entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries
+}
+
+func splitOutsideQuotes(s string, separator byte) []string {
+	parts := make([]string, 0, 4)
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == separator && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+/*
+ * the for= parameter of one RFC 7239 element, like for="[2001:db8::1]:4711";proto=https.
+ * false if the element has no for=.
+ */
+func parseForwardedElement(element string) (net.IP, bool) {
+	for _, pair := range splitOutsideQuotes(element, ';') {
+		equals := strings.IndexByte(pair, '=')
+		if equals < 0 {
+			continue
+		}
+		if strings.ToLower(strings.TrimSpace(pair[:equals])) != "for" {
+			continue
+		}
+
+		value := strings.TrimSpace(pair[equals+1:])
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = strings.Replace(value[1:len(value)-1], "\\", "", -1)
+		}
+		return parseForwardedNode(value), true
+	}
+	return nil, false
+}
+
+/* an address, possibly with a port and ipv6 brackets */
+func parseForwardedNode(node string) net.IP {
+	ip := net.ParseIP(node)
+	if ip != nil {
+		return ip
+	}
+
+	host, _, err := net.SplitHostPort(node)
+	if err == nil {
+		return net.ParseIP(host)
+	}
+
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]"))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func testTrustedProxies(t *testing.T, trusted_proxies string) {
+	/* registered before Setenv so it runs after the variable is restored */
+	t.Cleanup(func() {
+		initTrustedProxies()
+	})
+	t.Setenv("TRUSTED_PROXIES", trusted_proxies)
+	err := initTrustedProxies()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testRequestAddress(remote_addr string, headers map[string][]string) RequestAddress {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = remote_addr
+	for name, values := range headers {
+		r.Header[name] = values
+	}
+	return requestAddress(r)
+}
+
+func TestRequestAddress(t *testing.T) {
+	testTrustedProxies(t, "10.0.0.0/8, 192.0.2.1, 2001:db8::/32")
+
+	tests := []struct {
+		name        string
+		remote_addr string
+		headers     map[string][]string
+		ip          string
+		observed    string
+		claimed     string
+	}{
+		{"direct", "203.0.113.5:1000", nil, "203.0.113.5", "203.0.113.5", ""},
+		{"direct from a trusted proxy", "10.1.1.1:1000", nil, "10.1.1.1", "10.1.1.1", ""},
+		{"untrusted hop", "203.0.113.5:1000", map[string][]string{"X-Forwarded-For": {"1.1.1.1"}}, "203.0.113.5", "203.0.113.5", "1.1.1.1"},
+		{"x-forwarded-for", "10.1.1.1:1000", map[string][]string{"X-Forwarded-For": {"6.6.6.6, 1.1.1.1, 10.2.2.2"}}, "1.1.1.1", "10.1.1.1", "6.6.6.6"},
+		{"x-forwarded-for repeated", "10.1.1.1:1000", map[string][]string{"X-Forwarded-For": {"6.6.6.6", "1.1.1.1"}}, "1.1.1.1", "10.1.1.1", "6.6.6.6"},
+		{"untrusted hop in the chain", "10.1.1.1:1000", map[string][]string{"X-Forwarded-For": {"1.1.1.1, 6.6.6.6, 10.2.2.2"}}, "6.6.6.6", "10.1.1.1", "1.1.1.1"},
+		{"all hops trusted", "10.1.1.1:1000", map[string][]string{"X-Forwarded-For": {"10.3.3.3, 192.0.2.1"}}, "10.3.3.3", "10.1.1.1", "10.3.3.3"},
+		{"x-forwarded-for bracketed ipv6 with port", "10.1.1.1:1000", map[string][]string{"X-Forwarded-For": {"[2001:db9::1]:4711"}}, "2001:db9::1", "10.1.1.1", "2001:db9::1"},
+		{"x-forwarded-for garbage", "10.1.1.1:1000", map[string][]string{"X-Forwarded-For": {"garbage"}}, "", "10.1.1.1", ""},
+		{"forwarded over x-forwarded-for", "10.1.1.1:1000", map[string][]string{"Forwarded": {"for=6.6.6.6;proto=http, for=10.2.2.2"}, "X-Forwarded-For": {"9.9.9.9"}}, "6.6.6.6", "10.1.1.1", "6.6.6.6"},
+		{"forwarded quoted with port", "10.1.1.1:1000", map[string][]string{"Forwarded": {`For="1.2.3.4:80"`}}, "1.2.3.4", "10.1.1.1", "1.2.3.4"},
+		{"forwarded bracketed ipv6 with port", "10.1.1.1:1000", map[string][]string{"Forwarded": {`for="[2001:db9:cafe::17]:4711";proto=https`}}, "2001:db9:cafe::17", "10.1.1.1", "2001:db9:cafe::17"},
+		{"forwarded through an ipv6 proxy", "[2001:db8::1]:1000", map[string][]string{"Forwarded": {`for="[2001:db9::2]"`}}, "2001:db9::2", "2001:db8::1", "2001:db9::2"},
+		{"forwarded untrusted hop", "10.1.1.1:1000", map[string][]string{"Forwarded": {"for=1.1.1.1, for=6.6.6.6"}}, "6.6.6.6", "10.1.1.1", "1.1.1.1"},
+		{"forwarded without for", "10.1.1.1:1000", map[string][]string{"Forwarded": {"proto=https"}}, "10.1.1.1", "10.1.1.1", ""},
+		{"forwarded without for after a hop", "10.1.1.1:1000", map[string][]string{"Forwarded": {"for=1.1.1.1", "proto=https;host=example.com"}}, "1.1.1.1", "10.1.1.1", "1.1.1.1"},
+		{"forwarded unknown", "10.1.1.1:1000", map[string][]string{"Forwarded": {"for=unknown"}}, "", "10.1.1.1", ""},
+		{"forwarded obfuscated", "10.1.1.1:1000", map[string][]string{"Forwarded": {"for=_hidden"}}, "", "10.1.1.1", ""},
+	}
+
+	for _, test := range tests {
+		address := testRequestAddress(test.remote_addr, test.headers)
+		if ipString(address.ip) != test.ip || ipString(address.observed) != test.observed || ipString(address.claimed) != test.claimed {
+			t.Errorf("%s: got ip %q observed %q claimed %q", test.name, ipString(address.ip), ipString(address.observed), ipString(address.claimed))
+		}
+	}
+}
+
+func TestRequestAddressNoTrustedProxies(t *testing.T) {
+	testTrustedProxies(t, "")
+
+	address := testRequestAddress("127.0.0.1:1000", map[string][]string{"X-Forwarded-For": {"1.1.1.1"}})
+	if ipString(address.ip) != "127.0.0.1" {
+		t.Fatal("headers believed with no trusted proxies, got", ipString(address.ip))
+	}
+}
+
+func TestInitTrustedProxiesInvalid(t *testing.T) {
+	testTrustedProxies(t, "")
+	for _, trusted_proxies := range []string{"nope", "10.0.0.0/33", "10.0.0.1, 300.0.0.1"} {
+		t.Setenv("TRUSTED_PROXIES", trusted_proxies)
+		if initTrustedProxies() == nil {
+			t.Errorf("accepted %q", trusted_proxies)
+		}
+	}
+}
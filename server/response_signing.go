@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/fivebillionmph/be227a/protocol"
+	gss "github.com/fivebillionmph/gosimpleserver"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+/* set with SIGN_RESPONSES=1 */
+var global_sign_responses bool
+
+func initResponseSigning() {
+	global_sign_responses = os.Getenv("SIGN_RESPONSES") == "1"
+}
+
+/* like sendJSONResponse, with a detached signature header when responses are signed */
+func sendSignedJSONResponse(w http.ResponseWriter, r *http.Request, s interface{}) {
+	json_response, err := json.Marshal(s)
+	if err != nil {
+		errorResponse(w, 500, "Could not send request")
+		return
+	}
+
+	if global_sign_responses {
+		now := timestamp()
+		signing_string := protocol.ResponseSigningString(global_host_name, r.URL.RequestURI(), now, json_response)
+		signature, err := serverSign([]byte(signing_string))
+		if err != nil {
+			errorResponse(w, 500, "Could not sign response")
+			return
+		}
+		w.Header().Set(protocol.RESPONSE_TIMESTAMP_HEADER, strconv.Itoa(now))
+		w.Header().Set(protocol.RESPONSE_SIGNATURE_HEADER, base64.StdEncoding.EncodeToString(signature))
+	}
+
+	w.Header().Set("Content-type", "application/json")
+	w.Write(json_response)
+}
+
+func handlerGetServerKey(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	public_key_string, err := publicKeyToString(&global_private_key.PublicKey)
+	if err != nil {
+		errorResponse(w, 500, "Could not encode server key")
+		return
+	}
+
+	json_response := protocol.ServerKey{
+		Host_name:  global_host_name,
+		Public_key: public_key_string,
+	}
+
+	sendJSONResponse(w, &json_response)
+}
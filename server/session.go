@@ -2,55 +2,208 @@ package main
 
 import (
 	"errors"
+	"github.com/fivebillionmph/be227a/protocol"
 	"net"
+	"os"
+	"strconv"
+	"sync"
 )
 
+const SESSION_TIME_LIMIT = 3600 // seconds
+const SESSION_ID_LENGTH = 32
+const SESSION_LABEL_MAX_LENGTH = 64
+const SESSION_METADATA_FIELD_MAX_LENGTH = 64
+const SESSION_CAPABILITIES_MAX = 16
+const SESSIONS_PER_USER_DEFAULT = 16
+
+/* set from MAX_SESSIONS_PER_USER, 0 is no limit */
+var global_sessions_per_user int
+
+/* held while a user's sessions are counted and one is added */
+var global_user_session_mutex sync.Mutex
+
 type UserSession struct {
+	mutex               sync.Mutex
 	db_user             *DBUser
 	id                  string
 	start_timestamp     int
 	lastcheck_timestamp int
-	ip                  net.IP
+	ip                  net.IP // what the session is bound to
+	observed_ip         net.IP // the connection's address, a proxy's if there was one
+	claimed_ip          net.IP // the first forwarded address, nil if there wasn't one
 	port                int
+	label               string // names the device, at most one session per label
+	metadata            protocol.SessionMetadata
+	session_attestation *protocol.SessionAttestation
+}
+
+func initSessionLimit() error {
+	global_sessions_per_user = SESSIONS_PER_USER_DEFAULT
+	limit_str := os.Getenv("MAX_SESSIONS_PER_USER")
+	if limit_str == "" {
+		return nil
+	}
+
+	limit, err := strconv.Atoi(limit_str)
+	if err != nil || limit < 0 {
+		return errors.New("invalid MAX_SESSIONS_PER_USER: " + limit_str)
+	}
+	global_sessions_per_user = limit
+	return nil
+}
+
+func checkSessionLabel(label string, metadata protocol.SessionMetadata) error {
+	if len(label) > SESSION_LABEL_MAX_LENGTH {
+		return errors.New("session label too long")
+	}
+	if len(metadata.Protocol) > SESSION_METADATA_FIELD_MAX_LENGTH {
+		return errors.New("session protocol too long")
+	}
+	if len(metadata.Capabilities) > SESSION_CAPABILITIES_MAX {
+		return errors.New("too many session capabilities")
+	}
+	for _, capability := range metadata.Capabilities {
+		if len(capability) > SESSION_METADATA_FIELD_MAX_LENGTH {
+			return errors.New("session capability too long")
+		}
+	}
+	return nil
 }
 
-func UserSession__new(user *DBUser, ip net.IP, port int) (*UserSession, error) {
+/* false if the user can't start another session, one that replaces a labeled session always can */
+func UserSession__canStart(user *DBUser, label string) bool {
+	if global_sessions_per_user == 0 {
+		return true
+	}
+
+	sessions := UserSession__getByUser(user.F_id)
+	if label != "" {
+		for _, session := range sessions {
+			if session.label == label {
+				return true
+			}
+		}
+	}
+	return len(sessions) < global_sessions_per_user
+}
+
+/* a session with the same label as one of the user's others replaces it */
+func UserSession__new(store Storage, user *DBUser, address RequestAddress, port int, label string, metadata protocol.SessionMetadata) (*UserSession, error) {
 	now := timestamp()
 	if port < 1 || port > 65535 {
 		return nil, errors.New("invalid port")
 	}
+	err := checkSessionLabel(label, metadata)
+	if err != nil {
+		return nil, err
+	}
 
-	var session_id string
-	for {
-		session_id = randomString(12)
-		existing_challenge := global_user_sessions[session_id]
-		if existing_challenge == nil {
-			break
+	global_user_session_mutex.Lock()
+	defer global_user_session_mutex.Unlock()
+
+	if !UserSession__canStart(user, label) {
+		return nil, errors.New("session limit reached")
+	}
+	if label != "" {
+		for _, session := range UserSession__getByUser(user.F_id) {
+			if session.label == label {
+				UserSession__delete(store, session.id)
+			}
 		}
 	}
 
 	session := UserSession{
 		db_user:             user,
-		id:                  session_id,
 		start_timestamp:     now,
 		lastcheck_timestamp: now,
-		ip:                  ip,
+		ip:                  address.ip,
+		observed_ip:         address.observed,
+		claimed_ip:          address.claimed,
 		port:                port,
+		label:               label,
+		metadata:            metadata,
 	}
 
-	global_user_sessions[session_id] = &session
+	for {
+		id, err := randomString(SESSION_ID_LENGTH)
+		if err != nil {
+			return nil, err
+		}
+		session.id = id
+		if global_user_sessions.add(session.id, &session) {
+			break
+		}
+	}
+
+	err = DBSession__save(store, &session)
+	if err != nil {
+		global_user_sessions.remove(session.id)
+		return nil, err
+	}
 
+	global_session_events.publish(SESSION_EVENT_START, &session)
+	webhookSession(store, SESSION_EVENT_START, &session)
 	return &session, nil
 }
 
 func UserSession__getRegistered(id string) *UserSession {
-	user_session := global_user_sessions[id]
+	user_session, _ := global_user_sessions.get(id).(*UserSession)
 	return user_session
 }
 
-func UserSession__delete(id string) {
-	_, ok := global_user_sessions[id]
-	if ok {
-		delete(global_user_sessions, id)
+func UserSession__getAllRegistered() []*UserSession {
+	entries := global_user_sessions.values()
+	user_sessions := make([]*UserSession, 0, len(entries))
+	for _, entry := range entries {
+		user_sessions = append(user_sessions, entry.(*UserSession))
 	}
+	return user_sessions
+}
+
+func UserSession__delete(store Storage, id string) {
+	session := UserSession__getRegistered(id)
+	if global_user_sessions.remove(id) && session != nil {
+		global_session_events.publish(SESSION_EVENT_STOP, session)
+		webhookSession(store, SESSION_EVENT_STOP, session)
+	}
+	DBSession__delete(store, id)
+}
+
+/* the expire callback of global_user_sessions, the registry has already dropped the session */
+func UserSession__expired(store Storage, session *UserSession) {
+	DBSession__delete(store, session.id)
+	global_session_events.publish(SESSION_EVENT_EXPIRE, session)
+	webhookSession(store, SESSION_EVENT_EXPIRE, session)
+}
+
+func UserSession__getByUser(user_id int) []*UserSession {
+	user_sessions := make([]*UserSession, 0, 4)
+	for _, session := range UserSession__getAllRegistered() {
+		if session.db_user.F_id == user_id {
+			user_sessions = append(user_sessions, session)
+		}
+	}
+	return user_sessions
+}
+
+/* ends every session of the user, for when their key or status changes */
+func UserSession__deleteByUser(store Storage, user_id int) {
+	for _, session := range UserSession__getByUser(user_id) {
+		UserSession__delete(store, session.id)
+	}
+}
+
+func (self *UserSession) refresh(store Storage) error {
+	self.mutex.Lock()
+	self.lastcheck_timestamp = timestamp()
+	self.mutex.Unlock()
+
+	return DBSession__save(store, self)
+}
+
+func (self *UserSession) expired(now int) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return now > self.lastcheck_timestamp+SESSION_TIME_LIMIT
 }
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/fivebillionmph/be227a/protocol"
+)
+
+/*
+ * the attestation lasts as long as the session would without a refresh. it's
+ * kept on the session and signed again once a refresh moves the expiry.
+ */
+func (self *UserSession) attestation() (*protocol.SessionAttestation, error) {
+	public_key_string, err := self.db_user.publicKeyString()
+	if err != nil {
+		return nil, err
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	expire_timestamp := self.lastcheck_timestamp + SESSION_TIME_LIMIT
+	if self.session_attestation != nil && self.session_attestation.Expire_timestamp == expire_timestamp {
+		return self.session_attestation, nil
+	}
+
+	attestation := protocol.SessionAttestation{
+		Version:          protocol.VERSION_CANONICAL,
+		Host_name:        global_host_name,
+		Public_key:       public_key_string,
+		IP:               self.ip.String(),
+		Port:             self.port,
+		Start_timestamp:  self.start_timestamp,
+		Expire_timestamp: expire_timestamp,
+	}
+	signing_string, err := attestation.SigningString()
+	if err != nil {
+		return nil, err
+	}
+	attestation.Signature, err = serverSign([]byte(signing_string))
+	if err != nil {
+		return nil, err
+	}
+
+	self.session_attestation = &attestation
+	return self.session_attestation, nil
+}
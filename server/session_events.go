@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fivebillionmph/be227a/protocol"
+	gss "github.com/fivebillionmph/gosimpleserver"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * sessions starting, stopping and expiring are pushed to subscribers of
+ * /a/sessions/stream as server-sent events. a subscriber that falls behind by
+ * more than SESSION_EVENT_BUFFER events is dropped and has to reconnect.
+ */
+const SESSION_EVENT_START = "session_start"
+const SESSION_EVENT_STOP = "session_stop"
+const SESSION_EVENT_EXPIRE = "session_expire"
+const SESSION_EVENT_BUFFER = 64
+const SESSION_EVENT_SUBSCRIBERS_MAX = 1000
+const SESSION_EVENT_KEEPALIVE = 30 * time.Second
+
+var global_session_events *SessionEventHub = SessionEventHub__new()
+
+/* the endpoint fields match a row of /a/sessions, the attestation is only sent on start */
+type SessionEvent struct {
+	Event_type      string                       `json:"event_type"`
+	Timestamp       int                          `json:"timestamp"`
+	Existing        bool                         `json:"existing"` // started before the subscriber connected
+	Name            string                       `json:"name"`
+	Organization    string                       `json:"organization"`
+	Public_key      string                       `json:"public_key"`
+	IP              string                       `json:"ip"`
+	Port            int                          `json:"port"`
+	Label           string                       `json:"label"`
+	Metadata        protocol.SessionMetadata     `json:"metadata"`
+	Start_timestamp int                          `json:"start_timestamp"`
+	Attestation     *protocol.SessionAttestation `json:"attestation,omitempty"`
+}
+
+type SessionEventHub struct {
+	mutex       sync.Mutex
+	subscribers map[*sessionEventSubscriber]bool
+}
+
+type sessionEventSubscriber struct {
+	query  string
+	events chan *SessionEvent
+}
+
+func SessionEventHub__new() *SessionEventHub {
+	return &SessionEventHub{
+		subscribers: make(map[*sessionEventSubscriber]bool),
+	}
+}
+
+/* nil if there are too many subscribers */
+func (self *SessionEventHub) subscribe(query string) *sessionEventSubscriber {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if len(self.subscribers) >= SESSION_EVENT_SUBSCRIBERS_MAX {
+		return nil
+	}
+
+	subscriber := &sessionEventSubscriber{
+		query:  query,
+		events: make(chan *SessionEvent, SESSION_EVENT_BUFFER),
+	}
+	self.subscribers[subscriber] = true
+	return subscriber
+}
+
+func (self *SessionEventHub) unsubscribe(subscriber *sessionEventSubscriber) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.subscribers[subscriber] {
+		delete(self.subscribers, subscriber)
+		close(subscriber.events)
+	}
+}
+
+/* never blocks, a subscriber whose buffer is full is dropped */
+func (self *SessionEventHub) publish(event_type string, session *UserSession) {
+	/* stops still go out, so peers hear about the sessions of a user being deactivated */
+	if event_type == SESSION_EVENT_START && !session.db_user.active() {
+		return
+	}
+
+	self.mutex.Lock()
+	subscribed := len(self.subscribers) > 0
+	self.mutex.Unlock()
+	if !subscribed {
+		return
+	}
+
+	/* built outside the lock, the attestation is signed with the server key */
+	event, err := SessionEvent__new(event_type, session)
+	if err != nil {
+		return
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for subscriber := range self.subscribers {
+		if !sessionMatchesQuery(session, subscriber.query) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+			delete(self.subscribers, subscriber)
+			close(subscriber.events)
+		}
+	}
+}
+
+func SessionEvent__new(event_type string, session *UserSession) (*SessionEvent, error) {
+	public_key_string, err := session.db_user.publicKeyString()
+	if err != nil {
+		return nil, err
+	}
+
+	event := SessionEvent{
+		Event_type:      event_type,
+		Timestamp:       timestamp(),
+		Name:            session.db_user.F_name,
+		Organization:    session.db_user.F_organization,
+		Public_key:      public_key_string,
+		IP:              session.ip.String(),
+		Port:            session.port,
+		Label:           session.label,
+		Metadata:        session.metadata,
+		Start_timestamp: session.start_timestamp,
+	}
+
+	if event_type == SESSION_EVENT_START {
+		event.Attestation, err = session.attestation()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &event, nil
+}
+
+/* query is lowercase, empty matches every session */
+func sessionMatchesQuery(session *UserSession, query string) bool {
+	if query == "" {
+		return true
+	}
+	return strings.Contains(strings.ToLower(session.db_user.F_name), query) || strings.Contains(strings.ToLower(session.db_user.F_organization), query)
+}
+
+func writeSessionEvent(w http.ResponseWriter, event *SessionEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Event_type, data)
+	return err
+}
+
+/*
+ * the current sessions are sent first as start events marked existing, then
+ * changes as they happen, until the client disconnects. q filters by name or
+ * organization like it does for /a/sessions.
+ */
+func handlerGetSessionStream(w http.ResponseWriter, r *http.Request, server *gss.Server) {
+	query := strings.ToLower(r.URL.Query().Get("q"))
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		errorResponse(w, 500, "Streaming not supported")
+		return
+	}
+
+	subscriber := global_session_events.subscribe(query)
+	if subscriber == nil {
+		errorResponse(w, 503, "Too many subscribers")
+		return
+	}
+	defer global_session_events.unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+
+	for _, session := range UserSession__getAllRegistered() {
+		if !session.db_user.active() || !sessionMatchesQuery(session, query) {
+			continue
+		}
+		event, err := SessionEvent__new(SESSION_EVENT_START, session)
+		if err != nil {
+			continue
+		}
+		event.Existing = true
+		if writeSessionEvent(w, event) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(SESSION_EVENT_KEEPALIVE)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			_, err := fmt.Fprint(w, ": keepalive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-subscriber.events:
+			if !ok {
+				return
+			}
+			if writeSessionEvent(w, event) != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"github.com/fivebillionmph/be227a/client"
+	"github.com/fivebillionmph/be227a/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+func testSubscriberCount(hub *SessionEventHub) int {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	return len(hub.subscribers)
+}
+
+/* follows the stream until the test ends, returns once the server has subscribed it */
+func testWatchSessions(t *testing.T, base_url string, query string) chan client.SessionEvent {
+	events := make(chan client.SessionEvent, SESSION_EVENT_BUFFER)
+	stop := make(chan bool)
+	done := make(chan bool)
+	subscribers := testSubscriberCount(global_session_events)
+
+	go func() {
+		defer close(done)
+		err := client.Client__new(base_url, nil).WatchSessions(query, stop, func(event client.SessionEvent) {
+			events <- event
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+	/* runs before the server is closed, which waits for the stream to end */
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+
+	for i := 0; testSubscriberCount(global_session_events) == subscribers; i++ {
+		if i == 500 {
+			t.Fatal("stream never subscribed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return events
+}
+
+func testNextSessionEvent(t *testing.T, events chan client.SessionEvent) client.SessionEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no session event")
+	}
+	return client.SessionEvent{}
+}
+
+func testNoSessionEvent(t *testing.T, events chan client.SessionEvent) {
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSessionStreamSnapshot(t *testing.T) {
+	test_server := testServer(t)
+	alpha, _ := testClient(t, test_server.URL, "ed25519", "alpha")
+	beta, _ := testClient(t, test_server.URL, "ecdsa", "beta")
+	if _, err := alpha.StartSession(4000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := beta.StartSession(4001); err != nil {
+		t.Fatal(err)
+	}
+
+	events := testWatchSessions(t, test_server.URL, "")
+	names := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		event := testNextSessionEvent(t, events)
+		if event.Event_type != SESSION_EVENT_START || !event.Existing || event.Attestation == nil {
+			t.Fatalf("snapshot event %+v", event)
+		}
+		names[event.Name] = true
+	}
+	if !names["alpha"] || !names["beta"] {
+		t.Fatalf("snapshot of %v", names)
+	}
+	testNoSessionEvent(t, events)
+
+	/* q matches the name or organization, case insensitively */
+	events = testWatchSessions(t, test_server.URL, "ALP")
+	event := testNextSessionEvent(t, events)
+	if event.Name != "alpha" || event.Port != 4000 || !event.Existing {
+		t.Fatalf("filtered snapshot event %+v", event)
+	}
+	testNoSessionEvent(t, events)
+}
+
+func TestSessionStreamEvents(t *testing.T) {
+	test_server := testServer(t)
+	global_user_sessions.setExpireCallback(func(key interface{}, entry RegistryEntry) {
+		UserSession__expired(requestStorage(nil), entry.(*UserSession))
+	})
+	peer, public_key_string := testClient(t, test_server.URL, "ed25519", "peer")
+	other, _ := testClient(t, test_server.URL, "ed25519", "other")
+
+	all_events := testWatchSessions(t, test_server.URL, "")
+	peer_events := testWatchSessions(t, test_server.URL, "peer")
+
+	session, err := peer.StartSession(4000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, events := range []chan client.SessionEvent{all_events, peer_events} {
+		event := testNextSessionEvent(t, events)
+		if event.Event_type != SESSION_EVENT_START || event.Existing || event.Name != "peer" || event.Port != 4000 || !samePublicKeyString(event.Public_key, public_key_string) {
+			t.Fatalf("start event %+v", event)
+		}
+		if event.Attestation == nil || event.Attestation.Port != 4000 {
+			t.Fatalf("start event attestation %+v", event.Attestation)
+		}
+	}
+
+	other_session, err := other.StartSession(4001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := testNextSessionEvent(t, all_events); event.Name != "other" {
+		t.Fatalf("start event %+v", event)
+	}
+
+	err = session.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, events := range []chan client.SessionEvent{all_events, peer_events} {
+		event := testNextSessionEvent(t, events)
+		if event.Event_type != SESSION_EVENT_STOP || event.Name != "peer" || event.Attestation != nil {
+			t.Fatalf("stop event %+v", event)
+		}
+	}
+
+	global_user_sessions.expire(timestamp() + 24*3600)
+	event := testNextSessionEvent(t, all_events)
+	if event.Event_type != SESSION_EVENT_EXPIRE || event.Name != "other" || event.Port != 4001 {
+		t.Fatalf("expire event %+v", event)
+	}
+	if other_session.Refresh() == nil {
+		t.Fatal("expired session refreshed")
+	}
+
+	/* the filtered stream saw nothing of other's session */
+	testNoSessionEvent(t, peer_events)
+	testNoSessionEvent(t, all_events)
+}
+
+/* publish never waits on a subscriber, one that stops reading is dropped */
+func TestSessionEventSlowSubscriber(t *testing.T) {
+	test_server := testServer(t)
+	testClient(t, test_server.URL, "ed25519", "peer")
+	user, err := DBUser__getByQuery(requestStorage(nil), "peer")
+	if err != nil || len(user) != 1 {
+		t.Fatal(err, user)
+	}
+	session, err := UserSession__new(requestStorage(nil), user[0], RequestAddress{ip: net.ParseIP("127.0.0.1")}, 4000, "", protocol.SessionMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := SessionEventHub__new()
+	slow := hub.subscribe("")
+	fast := hub.subscribe("")
+
+	for i := 0; i < SESSION_EVENT_BUFFER; i++ {
+		hub.publish(SESSION_EVENT_STOP, session)
+		<-fast.events
+	}
+	if testSubscriberCount(hub) != 2 {
+		t.Fatal("dropped a subscriber with room in its buffer")
+	}
+
+	hub.publish(SESSION_EVENT_STOP, session)
+	if testSubscriberCount(hub) != 1 {
+		t.Fatal("kept a subscriber with a full buffer")
+	}
+	received := 0
+	for range slow.events {
+		received++
+	}
+	if received != SESSION_EVENT_BUFFER {
+		t.Fatalf("dropped subscriber got %d events", received)
+	}
+	if _, ok := <-fast.events; !ok {
+		t.Fatal("fast subscriber missed the last event")
+	}
+
+	/* unsubscribing a dropped subscriber is harmless */
+	hub.unsubscribe(slow)
+	hub.unsubscribe(fast)
+	if testSubscriberCount(hub) != 0 {
+		t.Fatal("subscribers left")
+	}
+}
+
+func TestSessionEventSubscriberLimit(t *testing.T) {
+	hub := SessionEventHub__new()
+	for i := 0; i < SESSION_EVENT_SUBSCRIBERS_MAX; i++ {
+		if hub.subscribe("") == nil {
+			t.Fatalf("refused subscriber %d", i)
+		}
+	}
+	if hub.subscribe("") != nil {
+		t.Fatal("subscribed past the limit")
+	}
+}
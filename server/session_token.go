@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+)
+
+/*
+ * a session token is "<payload>.<signature>", both base64url. the payload
+ * binds the session to the user, the client's ip and port and an expiry, and
+ * is signed with global_private_key. clients treat it as opaque.
+ */
+const SESSION_TOKEN_PREFIX = "session_token."
+
+type SessionToken struct {
+	Session_id       string `json:"session_id"`
+	User_id          int    `json:"user_id"`
+	IP               string `json:"ip"`
+	Port             int    `json:"port"`
+	Expire_timestamp int    `json:"expire_timestamp"`
+}
+
+/* a new token each time, expiring when the session would without a refresh */
+func (self *UserSession) token() (string, error) {
+	self.mutex.Lock()
+	session_token := SessionToken{
+		Session_id:       self.id,
+		User_id:          self.db_user.F_id,
+		IP:               self.ip.String(),
+		Port:             self.port,
+		Expire_timestamp: self.lastcheck_timestamp + SESSION_TIME_LIMIT,
+	}
+	self.mutex.Unlock()
+
+	payload_bytes, err := json.Marshal(&session_token)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(payload_bytes)
+
+	signature, err := serverSign([]byte(SESSION_TOKEN_PREFIX + payload))
+	if err != nil {
+		return "", err
+	}
+
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+/* checks the signature and expiry, not the binding */
+func SessionToken__parse(token string) (*SessionToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed session token")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed session token")
+	}
+	if !serverVerify([]byte(SESSION_TOKEN_PREFIX+parts[0]), signature) {
+		return nil, errors.New("invalid session token signature")
+	}
+
+	payload_bytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed session token")
+	}
+	session_token := SessionToken{}
+	err = json.Unmarshal(payload_bytes, &session_token)
+	if err != nil {
+		return nil, errors.New("malformed session token")
+	}
+
+	if timestamp() > session_token.Expire_timestamp {
+		return nil, errors.New("session token expired")
+	}
+
+	return &session_token, nil
+}
+
+/*
+ * the live session a token was issued for, if it's presented from the ip it
+ * was bound to and the session still belongs to the same user, ip and port.
+ */
+func UserSession__getByToken(token string, ip net.IP) (*UserSession, error) {
+	session_token, err := SessionToken__parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip == nil || !ip.Equal(net.ParseIP(session_token.IP)) {
+		return nil, errors.New("session token presented from a different ip")
+	}
+
+	session := UserSession__getRegistered(session_token.Session_id)
+	if session == nil {
+		return nil, errors.New("session does not exist")
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.db_user.F_id != session_token.User_id || !session.ip.Equal(ip) || session.port != session_token.Port {
+		return nil, errors.New("session token does not match session")
+	}
+
+	return session, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"strings"
+)
+
+/*
+ * openssh keys and SSHSIG signatures, see PROTOCOL.sshsig in the openssh source.
+ * clients sign with `ssh-keygen -Y sign -n <SSHSIG_NAMESPACE> -f <key>`.
+ */
+const SSHSIG_NAMESPACE = "keyserver"
+const SSHSIG_MAGIC = "SSHSIG"
+const SSHSIG_VERSION = 1
+
+type sshsigBlob struct {
+	Version        uint32
+	Public_key     []byte
+	Namespace      string
+	Reserved       string
+	Hash_algorithm string
+	Signature      []byte
+}
+
+type sshsigSignedData struct {
+	Namespace      string
+	Reserved       string
+	Hash_algorithm string
+	Hash           []byte
+}
+
+/* true for authorized_keys lines such as "ssh-ed25519 AAAA... comment" */
+func isSSHPublicKeyString(key_str string) bool {
+	return strings.HasPrefix(strings.TrimSpace(key_str), "ssh-") || strings.HasPrefix(strings.TrimSpace(key_str), "ecdsa-sha2-")
+}
+
+func sshStringToPublicKey(key_str string) (crypto.PublicKey, error) {
+	ssh_public_key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key_str))
+	if err != nil {
+		return nil, err
+	}
+
+	crypto_public_key, ok := ssh_public_key.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, errors.New("Unsupported public key algorithm")
+	}
+
+	return checkPublicKeyType(crypto_public_key.CryptoPublicKey())
+}
+
+/* accepts the armored output of ssh-keygen or the raw blob */
+func isSSHSignature(signature string) bool {
+	return strings.HasPrefix(signature, "-----BEGIN SSH SIGNATURE-----") || strings.HasPrefix(signature, SSHSIG_MAGIC)
+}
+
+func verifySSHSignature(public_key crypto.PublicKey, message string, signature string) bool {
+	blob_bytes := []byte(signature)
+	block, _ := pem.Decode(blob_bytes)
+	if block != nil {
+		if block.Type != "SSH SIGNATURE" {
+			return false
+		}
+		blob_bytes = block.Bytes
+	}
+
+	if !bytes.HasPrefix(blob_bytes, []byte(SSHSIG_MAGIC)) {
+		return false
+	}
+	blob := sshsigBlob{}
+	err := ssh.Unmarshal(blob_bytes[len(SSHSIG_MAGIC):], &blob)
+	if err != nil {
+		return false
+	}
+	if blob.Version != SSHSIG_VERSION || blob.Namespace != SSHSIG_NAMESPACE {
+		return false
+	}
+
+	/* the key embedded in the signature has to be the one we expect */
+	ssh_public_key, err := ssh.ParsePublicKey(blob.Public_key)
+	if err != nil {
+		return false
+	}
+	crypto_public_key, ok := ssh_public_key.(ssh.CryptoPublicKey)
+	if !ok {
+		return false
+	}
+	if publicKeyToDerString(crypto_public_key.CryptoPublicKey()) != publicKeyToDerString(public_key) {
+		return false
+	}
+
+	var hash []byte
+	switch blob.Hash_algorithm {
+	case "sha256":
+		sum := sha256.Sum256([]byte(message))
+		hash = sum[:]
+	case "sha512":
+		sum := sha512.Sum512([]byte(message))
+		hash = sum[:]
+	default:
+		return false
+	}
+
+	ssh_signature := ssh.Signature{}
+	err = ssh.Unmarshal(blob.Signature, &ssh_signature)
+	if err != nil {
+		return false
+	}
+	/* sha1 rsa signatures aren't allowed by the sshsig format */
+	if ssh_signature.Format == ssh.KeyAlgoRSA {
+		return false
+	}
+
+	signed_data := append([]byte(SSHSIG_MAGIC), ssh.Marshal(sshsigSignedData{
+		Namespace:      blob.Namespace,
+		Reserved:       blob.Reserved,
+		Hash_algorithm: blob.Hash_algorithm,
+		Hash:           hash,
+	})...)
+
+	return ssh_public_key.Verify(signed_data, &ssh_signature) == nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	gss "github.com/fivebillionmph/gosimpleserver"
+	"os"
+)
+
+/*
+ * Storage is the persistence backend for users, their key history and roles,
+ * signatures, revocations, sessions, the admin audit log and the transparency
+ * log. The DB*__* functions hold the validation logic and call into a Storage
+ * for reads and writes.
+ * Lookups that find nothing return sql.ErrNoRows.
+ * The deletes of users, user keys and revocations only undo a create whose
+ * transparency log entry couldn't be written.
+ */
+type Storage interface {
+	userCreate(user *DBUser) (int, error)
+	userGetByID(id int) (*DBUser, error)
+	userGetByPublicKey(public_key_der string) (*DBUser, error)
+	userGetAll() ([]*DBUser, error)
+	userGetByQuery(query string) ([]*DBUser, error)
+	userUpdatePublicKey(id int, public_key_der string) error
+	userSetActive(id int, active int) error
+	userDelete(id int) error
+
+	userKeyCreate(user_key *DBUserKey) (int, error)
+	userKeyGetByUser(user_id int) ([]*DBUserKey, error)
+	userKeyGetByPublicKey(public_key_der string) (*DBUserKey, error)
+	userKeyDelete(id int) error
+
+	signatureCreate(signature *DBSignature) (int, error)
+	signatureGetByID(id int) (*DBSignature, error)
+	signatureGetBySignee(signee_id int) ([]*DBSignature, error)
+	signatureGetBySigner(signer_id int) ([]*DBSignature, error)
+	signatureDelete(id int) error
+
+	revocationCreate(revocation *DBRevocation) (int, error)
+	revocationGetByID(id int) (*DBRevocation, error)
+	revocationGetBySignatureID(signature_id int) (*DBRevocation, error)
+	revocationDelete(id int) error
+
+	sessionSave(session *DBSession) error
+	sessionDelete(id string) error
+	sessionGetAll() ([]*DBSession, error)
+
+	roleCreate(role *DBRole) (int, error)
+	roleDelete(user_id int, role string) error
+	roleGetByUser(user_id int) ([]*DBRole, error)
+
+	auditLogCreate(audit_log *DBAuditLog) (int, error)
+	auditLogGetRecent(limit int) ([]*DBAuditLog, error)
+
+	logEntryCreate(log_entry *DBLogEntry) (int, error)
+	logEntryGetAll() ([]*DBLogEntry, error)
+	logEntryGetByItem(entry_type string, item_id int) (*DBLogEntry, error)
+
+	webhookDeliveryCreate(delivery *DBWebhookDelivery) (int, error)
+	webhookDeliveryUpdate(delivery *DBWebhookDelivery) error
+	webhookDeliveryGetDue(now int, limit int) ([]*DBWebhookDelivery, error)
+	webhookDeliveryGetRecent(limit int) ([]*DBWebhookDelivery, error)
+}
+
+/* nil when the MySQL backend is used, since it needs a connection per request */
+var global_storage Storage
+
+func initStorage() error {
+	switch os.Getenv("STORAGE") {
+	case "", "mysql":
+		global_storage = nil
+	case "memory":
+		global_storage = StorageMemory__new()
+	default:
+		return errors.New("unknown storage backend")
+	}
+
+	return nil
+}
+
+func requestStorage(server *gss.Server) Storage {
+	if global_storage != nil {
+		return global_storage
+	}
+
+	return StorageMySQL__new(server.RequestDBConnection())
+}
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+)
+
+/*
+ * in-memory storage for tests and small deployments, nothing survives a restart.
+ * rows are copied in and out so callers can't modify the stored values. the
+ * unique and foreign keys of mysql-scripts/main.mysql are checked the same way.
+ */
+type StorageMemory struct {
+	mutex       sync.RWMutex
+	last_id     int
+	users       []DBUser
+	user_keys   []DBUserKey
+	signatures  []DBSignature
+	revocations []DBRevocation
+	sessions    map[string]DBSession
+	roles       []DBRole
+	audit_logs  []DBAuditLog
+	log_entries []DBLogEntry
+	deliveries  []DBWebhookDelivery
+}
+
+func StorageMemory__new() *StorageMemory {
+	return &StorageMemory{
+		users:       make([]DBUser, 0, 8),
+		user_keys:   make([]DBUserKey, 0, 8),
+		signatures:  make([]DBSignature, 0, 8),
+		revocations: make([]DBRevocation, 0, 8),
+		sessions:    make(map[string]DBSession),
+		roles:       make([]DBRole, 0, 2),
+		audit_logs:  make([]DBAuditLog, 0, 8),
+		log_entries: make([]DBLogEntry, 0, 64),
+		deliveries:  make([]DBWebhookDelivery, 0, 8),
+	}
+}
+
+/* ids are unique across tables, which is fine since callers only compare them within a table */
+func (self *StorageMemory) nextID() int {
+	self.last_id++
+	return self.last_id
+}
+
+func (self *StorageMemory) userIndex(id int) int {
+	for i := range self.users {
+		if self.users[i].F_id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (self *StorageMemory) signatureIndex(id int) int {
+	for i := range self.signatures {
+		if self.signatures[i].F_id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (self *StorageMemory) userCreate(user *DBUser) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i := range self.users {
+		if self.users[i].F_name == user.F_name {
+			return 0, errors.New("duplicate user name")
+		}
+	}
+
+	row := *user
+	row.F_id = self.nextID()
+	row.public_key = nil
+	self.users = append(self.users, row)
+
+	return row.F_id, nil
+}
+
+func (self *StorageMemory) userGetByID(id int) (*DBUser, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	i := self.userIndex(id)
+	if i < 0 {
+		return &DBUser{}, sql.ErrNoRows
+	}
+	user := self.users[i]
+
+	return &user, nil
+}
+
+func (self *StorageMemory) userGetByPublicKey(public_key_der string) (*DBUser, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	for i := range self.users {
+		if self.users[i].F_public_key == public_key_der {
+			user := self.users[i]
+			return &user, nil
+		}
+	}
+
+	return &DBUser{}, sql.ErrNoRows
+}
+
+func (self *StorageMemory) userGetAll() ([]*DBUser, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	users := make([]*DBUser, 0, len(self.users))
+	for i := range self.users {
+		user := self.users[i]
+		users = append(users, &user)
+	}
+
+	return users, nil
+}
+
+/* case insensitive like mysql's default collation */
+func (self *StorageMemory) userGetByQuery(query string) ([]*DBUser, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	query = strings.ToLower(query)
+	users := make([]*DBUser, 0, 8)
+	for i := range self.users {
+		if strings.Contains(strings.ToLower(self.users[i].F_name), query) || strings.Contains(strings.ToLower(self.users[i].F_organization), query) {
+			user := self.users[i]
+			users = append(users, &user)
+		}
+	}
+
+	return users, nil
+}
+
+func (self *StorageMemory) userUpdatePublicKey(id int, public_key_der string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	i := self.userIndex(id)
+	if i < 0 {
+		return sql.ErrNoRows
+	}
+	self.users[i].F_public_key = public_key_der
+
+	return nil
+}
+
+func (self *StorageMemory) userSetActive(id int, active int) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	i := self.userIndex(id)
+	if i < 0 {
+		return sql.ErrNoRows
+	}
+	self.users[i].F_active = active
+
+	return nil
+}
+
+func (self *StorageMemory) userDelete(id int) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	/* the foreign keys of the mysql schema */
+	for i := range self.user_keys {
+		if self.user_keys[i].F_user_id == id {
+			return errors.New("user has keys")
+		}
+	}
+	for i := range self.signatures {
+		if self.signatures[i].F_signer_id == id {
+			return errors.New("user has signatures")
+		}
+	}
+	for _, session := range self.sessions {
+		if session.F_user_id == id {
+			return errors.New("user has sessions")
+		}
+	}
+	for i := range self.roles {
+		if self.roles[i].F_user_id == id {
+			return errors.New("user has roles")
+		}
+	}
+
+	i := self.userIndex(id)
+	if i >= 0 {
+		self.users = append(self.users[:i], self.users[i+1:]...)
+	}
+
+	return nil
+}
+
+func (self *StorageMemory) userKeyCreate(user_key *DBUserKey) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.userIndex(user_key.F_user_id) < 0 {
+		return 0, errors.New("user does not exist")
+	}
+
+	row := *user_key
+	row.F_id = self.nextID()
+	self.user_keys = append(self.user_keys, row)
+
+	return row.F_id, nil
+}
+
+/* oldest first */
+func (self *StorageMemory) userKeyGetByUser(user_id int) ([]*DBUserKey, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	user_keys := make([]*DBUserKey, 0, 2)
+	for i := range self.user_keys {
+		if self.user_keys[i].F_user_id == user_id {
+			user_key := self.user_keys[i]
+			user_keys = append(user_keys, &user_key)
+		}
+	}
+
+	return user_keys, nil
+}
+
+func (self *StorageMemory) userKeyGetByPublicKey(public_key_der string) (*DBUserKey, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	for i := range self.user_keys {
+		if self.user_keys[i].F_public_key == public_key_der {
+			user_key := self.user_keys[i]
+			return &user_key, nil
+		}
+	}
+
+	return &DBUserKey{}, sql.ErrNoRows
+}
+
+func (self *StorageMemory) userKeyDelete(id int) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i := range self.user_keys {
+		if self.user_keys[i].F_id == id {
+			self.user_keys = append(self.user_keys[:i], self.user_keys[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (self *StorageMemory) signatureCreate(signature *DBSignature) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.userIndex(signature.F_signer_id) < 0 {
+		return 0, errors.New("signer does not exist")
+	}
+
+	row := *signature
+	row.F_id = self.nextID()
+	self.signatures = append(self.signatures, row)
+
+	return row.F_id, nil
+}
+
+func (self *StorageMemory) signatureGetByID(id int) (*DBSignature, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	i := self.signatureIndex(id)
+	if i < 0 {
+		return &DBSignature{}, sql.ErrNoRows
+	}
+	signature := self.signatures[i]
+
+	return &signature, nil
+}
+
+func (self *StorageMemory) signatureGetBySignee(signee_id int) ([]*DBSignature, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	signatures := make([]*DBSignature, 0, 8)
+	for i := range self.signatures {
+		if self.signatures[i].F_signee_id == signee_id {
+			sig := self.signatures[i]
+			signatures = append(signatures, &sig)
+		}
+	}
+
+	return signatures, nil
+}
+
+func (self *StorageMemory) signatureGetBySigner(signer_id int) ([]*DBSignature, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	signatures := make([]*DBSignature, 0, 8)
+	for i := range self.signatures {
+		if self.signatures[i].F_signer_id == signer_id {
+			sig := self.signatures[i]
+			signatures = append(signatures, &sig)
+		}
+	}
+
+	return signatures, nil
+}
+
+func (self *StorageMemory) signatureDelete(id int) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	revocations := self.revocations[:0]
+	for _, revocation := range self.revocations {
+		if revocation.F_signature_id != id {
+			revocations = append(revocations, revocation)
+		}
+	}
+	self.revocations = revocations
+
+	i := self.signatureIndex(id)
+	if i >= 0 {
+		self.signatures = append(self.signatures[:i], self.signatures[i+1:]...)
+	}
+
+	return nil
+}
+
+func (self *StorageMemory) revocationCreate(revocation *DBRevocation) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.signatureIndex(revocation.F_signature_id) < 0 {
+		return 0, errors.New("signature does not exist")
+	}
+	for i := range self.revocations {
+		if self.revocations[i].F_signature_id == revocation.F_signature_id {
+			return 0, errors.New("duplicate revocation")
+		}
+	}
+
+	row := *revocation
+	row.F_id = self.nextID()
+	self.revocations = append(self.revocations, row)
+
+	return row.F_id, nil
+}
+
+func (self *StorageMemory) revocationDelete(id int) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i := range self.revocations {
+		if self.revocations[i].F_id == id {
+			self.revocations = append(self.revocations[:i], self.revocations[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (self *StorageMemory) revocationGetByID(id int) (*DBRevocation, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	for i := range self.revocations {
+		if self.revocations[i].F_id == id {
+			revocation := self.revocations[i]
+			return &revocation, nil
+		}
+	}
+
+	return &DBRevocation{}, sql.ErrNoRows
+}
+
+func (self *StorageMemory) revocationGetBySignatureID(signature_id int) (*DBRevocation, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	for i := range self.revocations {
+		if self.revocations[i].F_signature_id == signature_id {
+			revocation := self.revocations[i]
+			return &revocation, nil
+		}
+	}
+
+	return &DBRevocation{}, sql.ErrNoRows
+}
+
+func (self *StorageMemory) sessionSave(session *DBSession) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.userIndex(session.F_user_id) < 0 {
+		return errors.New("user does not exist")
+	}
+	self.sessions[session.F_id] = *session
+
+	return nil
+}
+
+func (self *StorageMemory) sessionDelete(id string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	delete(self.sessions, id)
+
+	return nil
+}
+
+func (self *StorageMemory) sessionGetAll() ([]*DBSession, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	sessions := make([]*DBSession, 0, len(self.sessions))
+	for _, row := range self.sessions {
+		session := row
+		sessions = append(sessions, &session)
+	}
+
+	return sessions, nil
+}
+
+func (self *StorageMemory) roleCreate(role *DBRole) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.userIndex(role.F_user_id) < 0 {
+		return 0, errors.New("user does not exist")
+	}
+	for i := range self.roles {
+		if self.roles[i].F_user_id == role.F_user_id && self.roles[i].F_role == role.F_role {
+			return 0, errors.New("duplicate role")
+		}
+	}
+
+	row := *role
+	row.F_id = self.nextID()
+	self.roles = append(self.roles, row)
+
+	return row.F_id, nil
+}
+
+func (self *StorageMemory) roleDelete(user_id int, role string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	roles := self.roles[:0]
+	for _, row := range self.roles {
+		if row.F_user_id != user_id || row.F_role != role {
+			roles = append(roles, row)
+		}
+	}
+	self.roles = roles
+
+	return nil
+}
+
+func (self *StorageMemory) roleGetByUser(user_id int) ([]*DBRole, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	roles := make([]*DBRole, 0, 2)
+	for i := range self.roles {
+		if self.roles[i].F_user_id == user_id {
+			role := self.roles[i]
+			roles = append(roles, &role)
+		}
+	}
+
+	return roles, nil
+}
+
+func (self *StorageMemory) auditLogCreate(audit_log *DBAuditLog) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	row := *audit_log
+	row.F_id = self.nextID()
+	self.audit_logs = append(self.audit_logs, row)
+
+	return row.F_id, nil
+}
+
+func (self *StorageMemory) auditLogGetRecent(limit int) ([]*DBAuditLog, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	audit_logs := make([]*DBAuditLog, 0, limit)
+	for i := len(self.audit_logs) - 1; i >= 0 && len(audit_logs) < limit; i-- {
+		audit_log := self.audit_logs[i]
+		audit_logs = append(audit_logs, &audit_log)
+	}
+
+	return audit_logs, nil
+}
+
+func (self *StorageMemory) logEntryCreate(log_entry *DBLogEntry) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if log_entry.F_leaf_index != len(self.log_entries) {
+		return 0, errors.New("leaf index out of order")
+	}
+
+	row := *log_entry
+	row.F_id = self.nextID()
+	self.log_entries = append(self.log_entries, row)
+
+	return row.F_id, nil
+}
+
+func (self *StorageMemory) logEntryGetAll() ([]*DBLogEntry, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	log_entries := make([]*DBLogEntry, 0, len(self.log_entries))
+	for i := range self.log_entries {
+		log_entry := self.log_entries[i]
+		log_entries = append(log_entries, &log_entry)
+	}
+
+	return log_entries, nil
+}
+
+func (self *StorageMemory) logEntryGetByItem(entry_type string, item_id int) (*DBLogEntry, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	for i := range self.log_entries {
+		if self.log_entries[i].F_entry_type == entry_type && self.log_entries[i].F_item_id == item_id {
+			log_entry := self.log_entries[i]
+			return &log_entry, nil
+		}
+	}
+
+	return &DBLogEntry{}, sql.ErrNoRows
+}
+
+func (self *StorageMemory) webhookDeliveryCreate(delivery *DBWebhookDelivery) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	row := *delivery
+	row.F_id = self.nextID()
+	self.deliveries = append(self.deliveries, row)
+
+	return row.F_id, nil
+}
+
+func (self *StorageMemory) webhookDeliveryUpdate(delivery *DBWebhookDelivery) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i := range self.deliveries {
+		if self.deliveries[i].F_id == delivery.F_id {
+			self.deliveries[i] = *delivery
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (self *StorageMemory) webhookDeliveryGetDue(now int, limit int) ([]*DBWebhookDelivery, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	deliveries := make([]*DBWebhookDelivery, 0, 8)
+	for _, row := range self.deliveries {
+		if len(deliveries) >= limit {
+			break
+		}
+		if row.F_status == WEBHOOK_STATUS_PENDING && row.F_next_attempt_timestamp <= now {
+			delivery := row
+			deliveries = append(deliveries, &delivery)
+		}
+	}
+
+	return deliveries, nil
+}
+
+func (self *StorageMemory) webhookDeliveryGetRecent(limit int) ([]*DBWebhookDelivery, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	deliveries := make([]*DBWebhookDelivery, 0, limit)
+	for i := len(self.deliveries) - 1; i >= 0 && len(deliveries) < limit; i-- {
+		delivery := self.deliveries[i]
+		deliveries = append(deliveries, &delivery)
+	}
+
+	return deliveries, nil
+}
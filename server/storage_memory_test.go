@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/fivebillionmph/be227a/protocol"
+	"testing"
+)
+
+/* the memory backend refuses what the mysql schema's keys would */
+func TestStorageMemoryConstraints(t *testing.T) {
+	store := StorageMemory__new()
+
+	user_id, err := store.userCreate(&DBUser{F_name: "peer", F_active: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.userCreate(&DBUser{F_name: "peer"}); err == nil {
+		t.Fatal("duplicate user name accepted")
+	}
+
+	if _, err := store.roleCreate(&DBRole{F_user_id: user_id, F_role: ROLE_ADMIN}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.roleCreate(&DBRole{F_user_id: user_id, F_role: ROLE_ADMIN}); err == nil {
+		t.Fatal("duplicate role accepted")
+	}
+	if _, err := store.roleCreate(&DBRole{F_user_id: user_id + 100, F_role: ROLE_ADMIN}); err == nil {
+		t.Fatal("role for a missing user accepted")
+	}
+	if store.userDelete(user_id) == nil {
+		t.Fatal("deleted a user with a role")
+	}
+	store.roleDelete(user_id, ROLE_ADMIN)
+
+	signature_id, err := store.signatureCreate(&DBSignature{F_signer_id: user_id, F_signee_id: user_id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.userDelete(user_id) == nil {
+		t.Fatal("deleted a user with signatures")
+	}
+	if _, err := store.revocationCreate(&DBRevocation{F_signature_id: signature_id}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.revocationCreate(&DBRevocation{F_signature_id: signature_id}); err == nil {
+		t.Fatal("duplicate revocation accepted")
+	}
+	store.signatureDelete(signature_id)
+
+	err = store.userDelete(user_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.logEntryCreate(&DBLogEntry{F_leaf_index: 0, F_entry_type: protocol.LOG_ENTRY_DEACTIVATION, F_item_id: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.logEntryCreate(&DBLogEntry{F_leaf_index: 1, F_entry_type: protocol.LOG_ENTRY_DEACTIVATION, F_item_id: 1}); err != nil {
+		t.Fatal("repeated item refused", err)
+	}
+	if _, err := store.logEntryCreate(&DBLogEntry{F_leaf_index: 1, F_entry_type: protocol.LOG_ENTRY_USER, F_item_id: 2}); err == nil {
+		t.Fatal("duplicate leaf index accepted")
+	}
+}
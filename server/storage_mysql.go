@@ -0,0 +1,362 @@
+package main
+
+import (
+	gss "github.com/fivebillionmph/gosimpleserver"
+)
+
+/* matches the schema in mysql-scripts/main.mysql */
+type StorageMySQL struct {
+	cxn *gss.DBConnection
+}
+
+func StorageMySQL__new(cxn *gss.DBConnection) *StorageMySQL {
+	return &StorageMySQL{cxn}
+}
+
+func (self *StorageMySQL) insert(query string, args ...interface{}) (int, error) {
+	stmt, err := self.cxn.DB.Prepare(query)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(args...)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+func (self *StorageMySQL) queryUsers(query string, args ...interface{}) ([]*DBUser, error) {
+	rows, err := self.cxn.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]*DBUser, 0, 8)
+	for rows.Next() {
+		user := DBUser{}
+		err := user.readRow(rows)
+		if err == nil {
+			users = append(users, &user)
+		}
+	}
+
+	return users, nil
+}
+
+func (self *StorageMySQL) userCreate(user *DBUser) (int, error) {
+	return self.insert("insert into "+DBUser__table+" values(NULL, ?, ?, ?, ?, ?)", user.F_timestamp, user.F_name, user.F_organization, user.F_public_key, user.F_active)
+}
+
+func (self *StorageMySQL) userGetByID(id int) (*DBUser, error) {
+	row := self.cxn.DB.QueryRow("select * from "+DBUser__table+" where id = ?", id)
+
+	user := DBUser{}
+	err := user.readRow(row)
+
+	return &user, err
+}
+
+func (self *StorageMySQL) userGetByPublicKey(public_key_der string) (*DBUser, error) {
+	row := self.cxn.DB.QueryRow("select * from "+DBUser__table+" where public_key = ?", public_key_der)
+
+	user := DBUser{}
+	err := user.readRow(row)
+
+	return &user, err
+}
+
+func (self *StorageMySQL) userGetAll() ([]*DBUser, error) {
+	return self.queryUsers("select * from " + DBUser__table)
+}
+
+func (self *StorageMySQL) userGetByQuery(query string) ([]*DBUser, error) {
+	sql_query := "%" + query + "%"
+	return self.queryUsers("select * from "+DBUser__table+" where name like ? or organization like ?", sql_query, sql_query)
+}
+
+func (self *StorageMySQL) userUpdatePublicKey(id int, public_key_der string) error {
+	_, err := self.cxn.DB.Exec("update "+DBUser__table+" set public_key = ? where id = ?", public_key_der, id)
+	return err
+}
+
+func (self *StorageMySQL) userSetActive(id int, active int) error {
+	_, err := self.cxn.DB.Exec("update "+DBUser__table+" set active = ? where id = ?", active, id)
+	return err
+}
+
+func (self *StorageMySQL) userDelete(id int) error {
+	_, err := self.cxn.DB.Exec("delete from "+DBUser__table+" where id = ?", id)
+	return err
+}
+
+func (self *StorageMySQL) userKeyCreate(user_key *DBUserKey) (int, error) {
+	return self.insert("insert into "+DBUserKey__table+" values(NULL, ?, ?, ?, ?, ?, ?)", user_key.F_timestamp, user_key.F_user_id, user_key.F_public_key, user_key.F_new_public_key, user_key.F_message, user_key.F_signature)
+}
+
+/* oldest first */
+func (self *StorageMySQL) userKeyGetByUser(user_id int) ([]*DBUserKey, error) {
+	rows, err := self.cxn.DB.Query("select * from "+DBUserKey__table+" where user_id = ? order by id", user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	user_keys := make([]*DBUserKey, 0, 2)
+	for rows.Next() {
+		user_key := DBUserKey{}
+		err := user_key.readRow(rows)
+		if err == nil {
+			user_keys = append(user_keys, &user_key)
+		}
+	}
+
+	return user_keys, nil
+}
+
+func (self *StorageMySQL) userKeyGetByPublicKey(public_key_der string) (*DBUserKey, error) {
+	row := self.cxn.DB.QueryRow("select * from "+DBUserKey__table+" where public_key = ?", public_key_der)
+
+	user_key := DBUserKey{}
+	err := user_key.readRow(row)
+
+	return &user_key, err
+}
+
+func (self *StorageMySQL) userKeyDelete(id int) error {
+	_, err := self.cxn.DB.Exec("delete from "+DBUserKey__table+" where id = ?", id)
+	return err
+}
+
+func (self *StorageMySQL) signatureCreate(signature *DBSignature) (int, error) {
+	return self.insert("insert into "+DBSignature__table+" values(NULL, ?, ?, ?, ?, ?)", signature.F_timestamp, signature.F_signer_id, signature.F_signee_id, signature.F_message, signature.F_signature)
+}
+
+func (self *StorageMySQL) signatureGetByID(id int) (*DBSignature, error) {
+	row := self.cxn.DB.QueryRow("select * from "+DBSignature__table+" where id = ?", id)
+
+	signature := DBSignature{}
+	err := signature.readRow(row)
+
+	return &signature, err
+}
+
+func (self *StorageMySQL) querySignatures(query string, args ...interface{}) ([]*DBSignature, error) {
+	rows, err := self.cxn.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	signatures := make([]*DBSignature, 0, 8)
+	for rows.Next() {
+		sig := DBSignature{}
+		err := sig.readRow(rows)
+		if err == nil {
+			signatures = append(signatures, &sig)
+		}
+	}
+
+	return signatures, nil
+}
+
+func (self *StorageMySQL) signatureGetBySignee(signee_id int) ([]*DBSignature, error) {
+	return self.querySignatures("select * from "+DBSignature__table+" where signee_id = ?", signee_id)
+}
+
+func (self *StorageMySQL) signatureGetBySigner(signer_id int) ([]*DBSignature, error) {
+	return self.querySignatures("select * from "+DBSignature__table+" where signer_id = ?", signer_id)
+}
+
+func (self *StorageMySQL) signatureDelete(id int) error {
+	_, err := self.cxn.DB.Exec("delete from "+DBRevocation__table+" where signature_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = self.cxn.DB.Exec("delete from "+DBSignature__table+" where id = ?", id)
+	return err
+}
+
+func (self *StorageMySQL) revocationCreate(revocation *DBRevocation) (int, error) {
+	return self.insert("insert into "+DBRevocation__table+" values(NULL, ?, ?, ?, ?, ?)", revocation.F_timestamp, revocation.F_signature_id, revocation.F_message, revocation.F_signature, revocation.F_admin)
+}
+
+func (self *StorageMySQL) revocationDelete(id int) error {
+	_, err := self.cxn.DB.Exec("delete from "+DBRevocation__table+" where id = ?", id)
+	return err
+}
+
+func (self *StorageMySQL) revocationGetByID(id int) (*DBRevocation, error) {
+	row := self.cxn.DB.QueryRow("select * from "+DBRevocation__table+" where id = ?", id)
+
+	revocation := DBRevocation{}
+	err := revocation.readRow(row)
+
+	return &revocation, err
+}
+
+func (self *StorageMySQL) revocationGetBySignatureID(signature_id int) (*DBRevocation, error) {
+	row := self.cxn.DB.QueryRow("select * from "+DBRevocation__table+" where signature_id = ?", signature_id)
+
+	revocation := DBRevocation{}
+	err := revocation.readRow(row)
+
+	return &revocation, err
+}
+
+func (self *StorageMySQL) sessionSave(session *DBSession) error {
+	_, err := self.cxn.DB.Exec("replace into "+DBSession__table+" values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", session.F_id, session.F_user_id, session.F_start_timestamp, session.F_lastcheck_timestamp, session.F_ip, session.F_port, session.F_observed_ip, session.F_claimed_ip, session.F_label, session.F_metadata)
+	return err
+}
+
+func (self *StorageMySQL) sessionDelete(id string) error {
+	_, err := self.cxn.DB.Exec("delete from "+DBSession__table+" where id = ?", id)
+	return err
+}
+
+func (self *StorageMySQL) sessionGetAll() ([]*DBSession, error) {
+	rows, err := self.cxn.DB.Query("select * from " + DBSession__table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]*DBSession, 0, 8)
+	for rows.Next() {
+		session := DBSession{}
+		err := session.readRow(rows)
+		if err == nil {
+			sessions = append(sessions, &session)
+		}
+	}
+
+	return sessions, nil
+}
+
+func (self *StorageMySQL) roleCreate(role *DBRole) (int, error) {
+	return self.insert("insert into "+DBRole__table+" values(NULL, ?, ?, ?)", role.F_timestamp, role.F_user_id, role.F_role)
+}
+
+func (self *StorageMySQL) roleDelete(user_id int, role string) error {
+	_, err := self.cxn.DB.Exec("delete from "+DBRole__table+" where user_id = ? and role = ?", user_id, role)
+	return err
+}
+
+func (self *StorageMySQL) roleGetByUser(user_id int) ([]*DBRole, error) {
+	rows, err := self.cxn.DB.Query("select * from "+DBRole__table+" where user_id = ?", user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := make([]*DBRole, 0, 2)
+	for rows.Next() {
+		role := DBRole{}
+		err := role.readRow(rows)
+		if err == nil {
+			roles = append(roles, &role)
+		}
+	}
+
+	return roles, nil
+}
+
+func (self *StorageMySQL) auditLogCreate(audit_log *DBAuditLog) (int, error) {
+	return self.insert("insert into "+DBAuditLog__table+" values(NULL, ?, ?, ?, ?, ?, ?, ?)", audit_log.F_timestamp, audit_log.F_admin_public_key, audit_log.F_action, audit_log.F_target, audit_log.F_details, audit_log.F_message, audit_log.F_signature)
+}
+
+func (self *StorageMySQL) auditLogGetRecent(limit int) ([]*DBAuditLog, error) {
+	rows, err := self.cxn.DB.Query("select * from "+DBAuditLog__table+" order by id desc limit ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	audit_logs := make([]*DBAuditLog, 0, 8)
+	for rows.Next() {
+		audit_log := DBAuditLog{}
+		err := audit_log.readRow(rows)
+		if err == nil {
+			audit_logs = append(audit_logs, &audit_log)
+		}
+	}
+
+	return audit_logs, nil
+}
+
+func (self *StorageMySQL) logEntryCreate(log_entry *DBLogEntry) (int, error) {
+	return self.insert("insert into "+DBLogEntry__table+" values(NULL, ?, ?, ?, ?, ?)", log_entry.F_leaf_index, log_entry.F_timestamp, log_entry.F_entry_type, log_entry.F_item_id, log_entry.F_fields)
+}
+
+func (self *StorageMySQL) logEntryGetAll() ([]*DBLogEntry, error) {
+	rows, err := self.cxn.DB.Query("select * from " + DBLogEntry__table + " order by leaf_index")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	log_entries := make([]*DBLogEntry, 0, 64)
+	for rows.Next() {
+		log_entry := DBLogEntry{}
+		err := log_entry.readRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		log_entries = append(log_entries, &log_entry)
+	}
+
+	return log_entries, nil
+}
+
+func (self *StorageMySQL) logEntryGetByItem(entry_type string, item_id int) (*DBLogEntry, error) {
+	row := self.cxn.DB.QueryRow("select * from "+DBLogEntry__table+" where entry_type = ? and item_id = ? order by leaf_index limit 1", entry_type, item_id)
+
+	log_entry := DBLogEntry{}
+	err := log_entry.readRow(row)
+
+	return &log_entry, err
+}
+
+func (self *StorageMySQL) webhookDeliveryCreate(delivery *DBWebhookDelivery) (int, error) {
+	return self.insert("insert into "+DBWebhookDelivery__table+" values(NULL, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", delivery.F_timestamp, delivery.F_url, delivery.F_event_type, delivery.F_payload, delivery.F_status, delivery.F_attempts, delivery.F_next_attempt_timestamp, delivery.F_last_attempt_timestamp, delivery.F_last_status_code, delivery.F_last_error)
+}
+
+func (self *StorageMySQL) webhookDeliveryUpdate(delivery *DBWebhookDelivery) error {
+	_, err := self.cxn.DB.Exec("update "+DBWebhookDelivery__table+" set status = ?, attempts = ?, next_attempt_timestamp = ?, last_attempt_timestamp = ?, last_status_code = ?, last_error = ? where id = ?", delivery.F_status, delivery.F_attempts, delivery.F_next_attempt_timestamp, delivery.F_last_attempt_timestamp, delivery.F_last_status_code, delivery.F_last_error, delivery.F_id)
+	return err
+}
+
+func (self *StorageMySQL) webhookDeliveryGetDue(now int, limit int) ([]*DBWebhookDelivery, error) {
+	return self.webhookDeliveryQuery("select * from "+DBWebhookDelivery__table+" where status = ? and next_attempt_timestamp <= ? order by id limit ?", WEBHOOK_STATUS_PENDING, now, limit)
+}
+
+func (self *StorageMySQL) webhookDeliveryGetRecent(limit int) ([]*DBWebhookDelivery, error) {
+	return self.webhookDeliveryQuery("select * from "+DBWebhookDelivery__table+" order by id desc limit ?", limit)
+}
+
+func (self *StorageMySQL) webhookDeliveryQuery(query string, args ...interface{}) ([]*DBWebhookDelivery, error) {
+	rows, err := self.cxn.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]*DBWebhookDelivery, 0, 8)
+	for rows.Next() {
+		delivery := DBWebhookDelivery{}
+		err := delivery.readRow(rows)
+		if err == nil {
+			deliveries = append(deliveries, &delivery)
+		}
+	}
+
+	return deliveries, nil
+}
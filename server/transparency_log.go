@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/fivebillionmph/be227a/protocol"
+	"strconv"
+	"sync"
+)
+
+/*
+ * append-only merkle tree of every registration, signature, revocation, key
+ * rotation, deactivation and signature deletion, so clients can check the
+ * server isn't hiding or dropping any of them. entries are kept in storage,
+ * the leaf hashes are kept in memory to build proofs. a change whose entry
+ * can't be appended is undone by its caller.
+ */
+type TransparencyLog struct {
+	mutex  sync.RWMutex
+	leaves [][]byte
+}
+
+var global_transparency_log *TransparencyLog
+
+func TransparencyLog__new() *TransparencyLog {
+	return &TransparencyLog{
+		leaves: make([][]byte, 0, 64),
+	}
+}
+
+/* rebuilds the leaf hashes from storage on startup */
+func (self *TransparencyLog) load(store Storage) error {
+	log_entries, err := DBLogEntry__getAll(store)
+	if err != nil {
+		return err
+	}
+
+	leaves := make([][]byte, 0, len(log_entries))
+	for i, db_log_entry := range log_entries {
+		if db_log_entry.F_leaf_index != i {
+			return errors.New("transparency log is missing leaf " + strconv.Itoa(i))
+		}
+		log_entry, err := db_log_entry.logEntry()
+		if err != nil {
+			return err
+		}
+		leaves = append(leaves, log_entry.LeafHash())
+	}
+
+	self.mutex.Lock()
+	self.leaves = leaves
+	self.mutex.Unlock()
+
+	return nil
+}
+
+func (self *TransparencyLog) append(store Storage, log_entry protocol.LogEntry) error {
+	fields_bytes, err := json.Marshal(log_entry.Fields)
+	if err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	db_log_entry := DBLogEntry{
+		F_leaf_index: len(self.leaves),
+		F_timestamp:  log_entry.Timestamp,
+		F_entry_type: log_entry.Entry_type,
+		F_item_id:    log_entry.Item_id,
+		F_fields:     string(fields_bytes),
+	}
+	_, err = store.logEntryCreate(&db_log_entry)
+	if err != nil {
+		return err
+	}
+
+	self.leaves = append(self.leaves, log_entry.LeafHash())
+
+	return nil
+}
+
+func (self *TransparencyLog) size() int {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	return len(self.leaves)
+}
+
+func (self *TransparencyLog) rootHash(size int) ([]byte, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	if size < 0 || size > len(self.leaves) {
+		return nil, errors.New("tree size out of range")
+	}
+
+	return merkleTreeHash(self.leaves[:size]), nil
+}
+
+func (self *TransparencyLog) inclusionProof(index int, size int) ([][]byte, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	if size < 1 || size > len(self.leaves) || index < 0 || index >= size {
+		return nil, errors.New("leaf index or tree size out of range")
+	}
+
+	return merkleInclusionProof(index, self.leaves[:size]), nil
+}
+
+func (self *TransparencyLog) consistencyProof(size1 int, size2 int) ([][]byte, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	if size1 < 0 || size2 < size1 || size2 > len(self.leaves) {
+		return nil, errors.New("tree size out of range")
+	}
+	if size1 == 0 || size1 == size2 {
+		return [][]byte{}, nil
+	}
+
+	return merkleSubproof(size1, self.leaves[:size2], true), nil
+}
+
+/* the head for size, signed with the server's key */
+func (self *TransparencyLog) treeHead(size int) (*protocol.SignedTreeHead, error) {
+	root_hash, err := self.rootHash(size)
+	if err != nil {
+		return nil, err
+	}
+
+	tree_head := protocol.SignedTreeHead{}
+	tree_head.Version = protocol.VERSION_CANONICAL
+	tree_head.Tree_size = size
+	tree_head.Timestamp = timestamp()
+	tree_head.Root_hash = root_hash
+
+	signing_string, err := tree_head.SigningString()
+	if err != nil {
+		return nil, err
+	}
+	tree_head.Signature, err = serverSign([]byte(signing_string))
+	if err != nil {
+		return nil, err
+	}
+
+	return &tree_head, nil
+}
+
+/* the entry for an item with its inclusion proof in the tree of size */
+func (self *TransparencyLog) itemProof(store Storage, entry_type string, item_id int, size int) (*protocol.LogProof, error) {
+	db_log_entry, err := DBLogEntry__getByItem(store, entry_type, item_id)
+	if err != nil {
+		return nil, err
+	}
+	log_entry, err := db_log_entry.logEntry()
+	if err != nil {
+		return nil, err
+	}
+	proof, err := self.inclusionProof(db_log_entry.F_leaf_index, size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protocol.LogProof{
+		Entry:      log_entry,
+		Leaf_index: db_log_entry.F_leaf_index,
+		Proof:      proof,
+	}, nil
+}
+
+/* the largest power of two smaller than n, for n > 1 */
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+/* RFC 6962 2.1 */
+func merkleTreeHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		return protocol.EmptyRootHash()
+	case 1:
+		return leaves[0]
+	}
+
+	k := merkleSplit(len(leaves))
+	return protocol.NodeHash(merkleTreeHash(leaves[:k]), merkleTreeHash(leaves[k:]))
+}
+
+/* RFC 6962 2.1.1 */
+func merkleInclusionProof(index int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return [][]byte{}
+	}
+
+	k := merkleSplit(len(leaves))
+	if index < k {
+		return append(merkleInclusionProof(index, leaves[:k]), merkleTreeHash(leaves[k:]))
+	}
+	return append(merkleInclusionProof(index-k, leaves[k:]), merkleTreeHash(leaves[:k]))
+}
+
+/* RFC 6962 2.1.2 */
+func merkleSubproof(m int, leaves [][]byte, complete bool) [][]byte {
+	n := len(leaves)
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{merkleTreeHash(leaves)}
+	}
+
+	k := merkleSplit(n)
+	if m <= k {
+		return append(merkleSubproof(m, leaves[:k], complete), merkleTreeHash(leaves[k:]))
+	}
+	return append(merkleSubproof(m-k, leaves[k:], false), merkleTreeHash(leaves[:k]))
+}
+
+func logUser(store Storage, user *DBUser) error {
+	public_key_string, err := user.publicKeyString()
+	if err != nil {
+		return err
+	}
+
+	return global_transparency_log.append(store, protocol.LogEntry{
+		Entry_type: protocol.LOG_ENTRY_USER,
+		Item_id:    user.F_id,
+		Timestamp:  user.F_timestamp,
+		Fields:     []string{public_key_string, user.F_name, user.F_organization},
+	})
+}
+
+func logSignature(store Storage, db_signature *DBSignature, signer *DBUser, signee *DBUser) error {
+	signer_public_key_string, err := signer.publicKeyString()
+	if err != nil {
+		return err
+	}
+	signee_public_key_string, err := signee.publicKeyString()
+	if err != nil {
+		return err
+	}
+
+	return global_transparency_log.append(store, protocol.LogEntry{
+		Entry_type: protocol.LOG_ENTRY_SIGNATURE,
+		Item_id:    db_signature.F_id,
+		Timestamp:  db_signature.F_timestamp,
+		Fields:     []string{signer_public_key_string, signee_public_key_string, db_signature.F_message, db_signature.base64Signature()},
+	})
+}
+
+func logRevocation(store Storage, revocation *DBRevocation) error {
+	return global_transparency_log.append(store, protocol.LogEntry{
+		Entry_type: protocol.LOG_ENTRY_REVOCATION,
+		Item_id:    revocation.F_id,
+		Timestamp:  revocation.F_timestamp,
+		Fields:     []string{strconv.Itoa(revocation.F_signature_id), revocation.F_message, base64.StdEncoding.EncodeToString([]byte(revocation.F_signature)), strconv.Itoa(revocation.F_admin)},
+	})
+}
+
+func logRotation(store Storage, user_key *DBUserKey) error {
+	old_public_key, err := derStringToPublicKey(user_key.F_public_key)
+	if err != nil {
+		return err
+	}
+	old_public_key_string, err := publicKeyToString(old_public_key)
+	if err != nil {
+		return err
+	}
+	new_public_key, err := derStringToPublicKey(user_key.F_new_public_key)
+	if err != nil {
+		return err
+	}
+	new_public_key_string, err := publicKeyToString(new_public_key)
+	if err != nil {
+		return err
+	}
+
+	return global_transparency_log.append(store, protocol.LogEntry{
+		Entry_type: protocol.LOG_ENTRY_ROTATION,
+		Item_id:    user_key.F_id,
+		Timestamp:  user_key.F_timestamp,
+		Fields:     []string{strconv.Itoa(user_key.F_user_id), old_public_key_string, new_public_key_string, user_key.F_message, base64.StdEncoding.EncodeToString([]byte(user_key.F_signature))},
+	})
+}
+
+/* entry_type is LOG_ENTRY_DEACTIVATION or LOG_ENTRY_REACTIVATION */
+func logUserActive(store Storage, user *DBUser, entry_type string) error {
+	public_key_string, err := user.publicKeyString()
+	if err != nil {
+		return err
+	}
+
+	return global_transparency_log.append(store, protocol.LogEntry{
+		Entry_type: entry_type,
+		Item_id:    user.F_id,
+		Timestamp:  timestamp(),
+		Fields:     []string{public_key_string},
+	})
+}
+
+func logSignatureDeletion(store Storage, db_signature *DBSignature, admin_request *AdminRequest) error {
+	message_bytes, err := json.Marshal(&admin_request.message)
+	if err != nil {
+		return err
+	}
+
+	return global_transparency_log.append(store, protocol.LogEntry{
+		Entry_type: protocol.LOG_ENTRY_SIGNATURE_DELETION,
+		Item_id:    db_signature.F_id,
+		Timestamp:  timestamp(),
+		Fields:     []string{string(message_bytes), base64.StdEncoding.EncodeToString([]byte(admin_request.signature))},
+	})
+}
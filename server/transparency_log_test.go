@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/fivebillionmph/be227a/client"
+	"github.com/fivebillionmph/be227a/protocol"
+	"testing"
+)
+
+/* the RFC 6962 test vectors, see protocol/merkle_test.go */
+var test_merkle_leaves = []string{
+	"",
+	"00",
+	"10",
+	"2021",
+	"3031",
+	"40414243",
+	"5051525354555657",
+	"606162636465666768696a6b6c6d6e6f",
+}
+
+var test_merkle_roots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+func testMerkleLeaves(t *testing.T) [][]byte {
+	leaves := make([][]byte, 0, len(test_merkle_leaves))
+	for _, s := range test_merkle_leaves {
+		data, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves = append(leaves, protocol.LeafHash(data))
+	}
+	return leaves
+}
+
+func testHexProof(proof [][]byte) []string {
+	hashes := make([]string, 0, len(proof))
+	for _, hash := range proof {
+		hashes = append(hashes, hex.EncodeToString(hash))
+	}
+	return hashes
+}
+
+func testSameProof(proof [][]byte, want []string) bool {
+	got := testHexProof(proof)
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMerkleTreeHash(t *testing.T) {
+	leaves := testMerkleLeaves(t)
+
+	if hex.EncodeToString(merkleTreeHash(leaves[:0])) != hex.EncodeToString(protocol.EmptyRootHash()) {
+		t.Fatal("wrong empty tree hash")
+	}
+	for size := 1; size <= len(leaves); size++ {
+		if hex.EncodeToString(merkleTreeHash(leaves[:size])) != test_merkle_roots[size-1] {
+			t.Fatalf("wrong root for tree %d", size)
+		}
+	}
+}
+
+func TestMerkleProofVectors(t *testing.T) {
+	leaves := testMerkleLeaves(t)
+
+	if !testSameProof(merkleInclusionProof(0, leaves[:8]), []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}) {
+		t.Fatal("wrong inclusion proof for leaf 0 in tree 8")
+	}
+	if !testSameProof(merkleInclusionProof(5, leaves[:8]), []string{
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}) {
+		t.Fatal("wrong inclusion proof for leaf 5 in tree 8")
+	}
+	if !testSameProof(merkleInclusionProof(2, leaves[:3]), []string{
+		"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	}) {
+		t.Fatal("wrong inclusion proof for leaf 2 in tree 3")
+	}
+
+	if !testSameProof(merkleSubproof(1, leaves[:8], true), []string{
+		"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+	}) {
+		t.Fatal("wrong consistency proof from 1 to 8")
+	}
+	if !testSameProof(merkleSubproof(6, leaves[:8], true), []string{
+		"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+		"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	}) {
+		t.Fatal("wrong consistency proof from 6 to 8")
+	}
+	if !testSameProof(merkleSubproof(2, leaves[:5], true), []string{
+		"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+		"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+	}) {
+		t.Fatal("wrong consistency proof from 2 to 5")
+	}
+}
+
+/* every proof the server builds for trees up to 8 has to verify on the client side */
+func TestMerkleProofsVerify(t *testing.T) {
+	leaves := testMerkleLeaves(t)
+
+	for size := 1; size <= len(leaves); size++ {
+		root_hash := merkleTreeHash(leaves[:size])
+		for index := 0; index < size; index++ {
+			if !protocol.VerifyInclusion(leaves[index], index, size, merkleInclusionProof(index, leaves[:size]), root_hash) {
+				t.Fatalf("inclusion of %d in tree %d doesn't verify", index, size)
+			}
+		}
+		for size1 := 1; size1 < size; size1++ {
+			if !protocol.VerifyConsistency(size1, size, merkleSubproof(size1, leaves[:size], true), merkleTreeHash(leaves[:size1]), root_hash) {
+				t.Fatalf("consistency from %d to %d doesn't verify", size1, size)
+			}
+		}
+	}
+}
+
+/* in-memory storage whose log appends fail while fail is set */
+type testFailingStorage struct {
+	*StorageMemory
+	fail bool
+}
+
+func (self *testFailingStorage) logEntryCreate(log_entry *DBLogEntry) (int, error) {
+	if self.fail {
+		return 0, errors.New("log entry not written")
+	}
+	return self.StorageMemory.logEntryCreate(log_entry)
+}
+
+/* a change whose log entry can't be written is undone, so the log and storage agree */
+func TestLogAppendFailure(t *testing.T) {
+	test_server := testServer(t)
+	store := &testFailingStorage{StorageMemory: global_storage.(*StorageMemory)}
+	global_storage = store
+
+	admin, admin_public_key := testClient(t, test_server.URL, "ed25519", "")
+	global_admin_public_key, _ = stringToPublicKey(admin_public_key)
+	defer initAdmin()
+
+	signer, signer_public_key_string := testClient(t, test_server.URL, "ed25519", "signer")
+	_, signee_public_key := testClient(t, test_server.URL, "rsa", "signee")
+	testSign(t, signer, signee_public_key)
+	signatures, err := signer.Signatures(signee_public_key, false, false, "")
+	if err != nil || len(signatures) != 1 {
+		t.Fatal(err, signatures)
+	}
+	signature_id := signatures[0].Id
+
+	log_size := global_transparency_log.size()
+	store.fail = true
+
+	unlogged, unlogged_public_key_string := testClient(t, test_server.URL, "ed25519", "")
+	if unlogged.Register("unlogged", "org") == nil {
+		t.Fatal("registered without a log entry")
+	}
+	unlogged_public_key, _ := stringToPublicKey(unlogged_public_key_string)
+	if _, err := DBUser__getByPublicKey(store, unlogged_public_key); err == nil {
+		t.Fatal("unlogged user was kept")
+	}
+
+	if signer.Sign(signee_public_key, protocol.VerifyMessage{Start_time: timestamp() - 10, Message_key: "email"}) == nil {
+		t.Fatal("signed without a log entry")
+	}
+	signatures, _ = signer.Signatures(signee_public_key, false, false, "")
+	if len(signatures) != 1 {
+		t.Fatal("unlogged signature was kept")
+	}
+
+	if signer.Revoke(signature_id, "unlogged") == nil {
+		t.Fatal("revoked without a log entry")
+	}
+	if admin.AdminRevokeSignature(signature_id) == nil {
+		t.Fatal("admin revoked without a log entry")
+	}
+	signatures, _ = signer.Signatures(signee_public_key, false, false, "")
+	if signatures[0].Revoked {
+		t.Fatal("unlogged revocation was kept")
+	}
+
+	new_private_key, _ := client.GenerateKey("ed25519")
+	if signer.RotateKey(new_private_key) == nil {
+		t.Fatal("rotated without a log entry")
+	}
+	signer_public_key, _ := stringToPublicKey(signer_public_key_string)
+	signer_user, err := DBUser__getByPublicKey(store, signer_public_key)
+	if err != nil {
+		t.Fatal("unlogged rotation was kept")
+	}
+	user_keys, _ := store.userKeyGetByUser(signer_user.F_id)
+	if len(user_keys) != 0 {
+		t.Fatal("unlogged succession record was kept")
+	}
+
+	if admin.AdminDeactivate(signer_public_key_string) == nil {
+		t.Fatal("deactivated without a log entry")
+	}
+	signer_user, _ = DBUser__getByPublicKey(store, signer_public_key)
+	if !signer_user.active() {
+		t.Fatal("unlogged deactivation was kept")
+	}
+
+	if admin.AdminDeleteSignature(signature_id) == nil {
+		t.Fatal("deleted a signature without a log entry")
+	}
+	if _, err := DBSignature__getByID(store, signature_id); err != nil {
+		t.Fatal("unlogged signature deletion was kept")
+	}
+
+	if global_transparency_log.size() != log_size {
+		t.Fatal("failed appends changed the log")
+	}
+}
+
+/* rotations, deactivations and signature deletions all get entries */
+func TestLogEntryTypes(t *testing.T) {
+	test_server := testServer(t)
+	store := requestStorage(nil)
+
+	admin, admin_public_key := testClient(t, test_server.URL, "ed25519", "")
+	global_admin_public_key, _ = stringToPublicKey(admin_public_key)
+	defer initAdmin()
+
+	signer, signer_public_key_string := testClient(t, test_server.URL, "ed25519", "signer")
+	_, signee_public_key := testClient(t, test_server.URL, "rsa", "signee")
+	testSign(t, signer, signee_public_key)
+	signatures, err := signer.Signatures(signee_public_key, false, false, "")
+	if err != nil || len(signatures) != 1 {
+		t.Fatal(err, signatures)
+	}
+
+	new_private_key, _ := client.GenerateKey("ecdsa")
+	err = signer.RotateKey(new_private_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	new_public_key_string, _ := signer.PublicKeyString()
+	new_public_key, _ := stringToPublicKey(new_public_key_string)
+	signer_user, _ := DBUser__getByPublicKey(store, new_public_key)
+	user_keys, _ := store.userKeyGetByUser(signer_user.F_id)
+	if len(user_keys) != 1 {
+		t.Fatal("no succession record")
+	}
+	db_log_entry, err := DBLogEntry__getByItem(store, protocol.LOG_ENTRY_ROTATION, user_keys[0].F_id)
+	if err != nil {
+		t.Fatal("rotation not logged")
+	}
+	log_entry, _ := db_log_entry.logEntry()
+	if len(log_entry.Fields) != 5 || !samePublicKeyString(log_entry.Fields[1], signer_public_key_string) || !samePublicKeyString(log_entry.Fields[2], new_public_key_string) {
+		t.Fatalf("rotation logged as %+v", log_entry)
+	}
+
+	err = admin.AdminDeactivate(new_public_key_string)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DBLogEntry__getByItem(store, protocol.LOG_ENTRY_DEACTIVATION, signer_user.F_id); err != nil {
+		t.Fatal("deactivation not logged")
+	}
+	err = admin.AdminReactivate(new_public_key_string)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DBLogEntry__getByItem(store, protocol.LOG_ENTRY_REACTIVATION, signer_user.F_id); err != nil {
+		t.Fatal("reactivation not logged")
+	}
+
+	err = admin.AdminDeleteSignature(signatures[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DBLogEntry__getByItem(store, protocol.LOG_ENTRY_SIGNATURE_DELETION, signatures[0].Id); err != nil {
+		t.Fatal("signature deletion not logged")
+	}
+
+	/* the rebuilt tree matches the one kept in memory */
+	size := global_transparency_log.size()
+	root_hash, _ := global_transparency_log.rootHash(size)
+	rebuilt := TransparencyLog__new()
+	err = rebuilt.load(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilt_root_hash, _ := rebuilt.rootHash(size)
+	if rebuilt.size() != size || hex.EncodeToString(rebuilt_root_hash) != hex.EncodeToString(root_hash) {
+		t.Fatal("log reloaded from storage differs")
+	}
+}
+
+/* a user can be deactivated again after being reactivated, each change gets its own entry */
+func TestLogDeactivateTwice(t *testing.T) {
+	test_server := testServer(t)
+	store := requestStorage(nil)
+
+	admin, admin_public_key := testClient(t, test_server.URL, "ed25519", "")
+	global_admin_public_key, _ = stringToPublicKey(admin_public_key)
+	defer initAdmin()
+
+	_, public_key_string := testClient(t, test_server.URL, "ed25519", "peer")
+	for _, change := range []func(string) error{admin.AdminDeactivate, admin.AdminReactivate, admin.AdminDeactivate} {
+		err := change(public_key_string)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	public_key, _ := stringToPublicKey(public_key_string)
+	user, _ := DBUser__getByPublicKey(store, public_key)
+	if user.active() {
+		t.Fatal("user is active")
+	}
+
+	log_entries, _ := DBLogEntry__getAll(store)
+	counts := map[string]int{}
+	for _, log_entry := range log_entries {
+		if log_entry.F_item_id == user.F_id {
+			counts[log_entry.F_entry_type]++
+		}
+	}
+	if counts[protocol.LOG_ENTRY_DEACTIVATION] != 2 || counts[protocol.LOG_ENTRY_REACTIVATION] != 1 {
+		t.Fatalf("logged %v", counts)
+	}
+}
+
+/* deactivating an inactive user or reactivating an active one changes nothing and isn't logged */
+func TestLogNoOpActiveChange(t *testing.T) {
+	test_server := testServer(t)
+	store := requestStorage(nil)
+
+	admin, admin_public_key := testClient(t, test_server.URL, "ed25519", "")
+	global_admin_public_key, _ = stringToPublicKey(admin_public_key)
+	defer initAdmin()
+
+	_, public_key_string := testClient(t, test_server.URL, "ed25519", "peer")
+	public_key, _ := stringToPublicKey(public_key_string)
+	user, _ := DBUser__getByPublicKey(store, public_key)
+
+	log_size := global_transparency_log.size()
+	if admin.AdminReactivate(public_key_string) == nil || DBUser__reactivate(store, user) == nil {
+		t.Fatal("reactivated an active user")
+	}
+	if global_transparency_log.size() != log_size {
+		t.Fatal("logged a reactivation of an active user")
+	}
+
+	err := admin.AdminDeactivate(public_key_string)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ = DBUser__getByPublicKey(store, public_key)
+	log_size = global_transparency_log.size()
+	if admin.AdminDeactivate(public_key_string) == nil || DBUser__deactivate(store, user) == nil {
+		t.Fatal("deactivated an inactive user")
+	}
+	if global_transparency_log.size() != log_size {
+		t.Fatal("logged a deactivation of an inactive user")
+	}
+}
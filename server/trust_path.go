@@ -0,0 +1,117 @@
+package main
+
+const TRUST_PATH_DEFAULT_DEPTH = 4
+const TRUST_PATH_MAX_DEPTH = 8
+const TRUST_PATH_MAX_PATHS = 16
+
+/*
+ * breadth first search over signer -> signee edges starting at root.
+ * returns every shortest chain of signatures that ends at target, or nil if
+ * target can't be reached within max_depth hops. only signatures that verify,
+ * are inside their time window, haven't been revoked and are between active
+ * users are followed.
+ */
+func trustPaths(store Storage, root *DBUser, target *DBUser, max_depth int) ([][]*DBSignature, error) {
+	if root.F_id == target.F_id {
+		return [][]*DBSignature{}, nil
+	}
+
+	users := map[int]*DBUser{root.F_id: root}
+	/* signatures reaching each user on the shortest paths found so far */
+	parents := make(map[int][]*DBSignature)
+	depth := map[int]int{root.F_id: 0}
+	frontier := []int{root.F_id}
+	now := timestamp()
+
+	for level := 1; level <= max_depth && len(frontier) > 0; level++ {
+		next_frontier := make([]int, 0)
+
+		for _, user_id := range frontier {
+			signatures, err := store.signatureGetBySigner(user_id)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, signature := range signatures {
+				user_depth, seen := depth[signature.F_signee_id]
+				if seen && user_depth < level {
+					continue
+				}
+
+				signee, ok := users[signature.F_signee_id]
+				if !ok {
+					signee, err = signature.signee(store)
+					if err != nil {
+						continue
+					}
+					users[signee.F_id] = signee
+				}
+
+				if !trustPathUsable(store, users[user_id], signee, signature, now) {
+					continue
+				}
+
+				if !seen {
+					depth[signee.F_id] = level
+					next_frontier = append(next_frontier, signee.F_id)
+				}
+				parents[signee.F_id] = append(parents[signee.F_id], signature)
+			}
+		}
+
+		_, found := depth[target.F_id]
+		if found {
+			return trustPathCollect(parents, root.F_id, target.F_id), nil
+		}
+
+		frontier = next_frontier
+	}
+
+	return nil, nil
+}
+
+func trustPathUsable(store Storage, signer *DBUser, signee *DBUser, signature *DBSignature, now int) bool {
+	if !signer.active() || !signee.active() {
+		return false
+	}
+
+	if signature.revocation(store) != nil {
+		return false
+	}
+
+	message, err := signature.message()
+	if err != nil {
+		return false
+	}
+	if message.status(now) != SIGNATURE_STATUS_VALID {
+		return false
+	}
+
+	return DBSignature__verifyMessageLineage(store, signer, signee, *message, signature.F_signature)
+}
+
+/* walks parents back from target, stopping after TRUST_PATH_MAX_PATHS chains */
+func trustPathCollect(parents map[int][]*DBSignature, root_id int, target_id int) [][]*DBSignature {
+	paths := make([][]*DBSignature, 0)
+
+	var walk func(user_id int, suffix []*DBSignature)
+	walk = func(user_id int, suffix []*DBSignature) {
+		if len(paths) >= TRUST_PATH_MAX_PATHS {
+			return
+		}
+		if user_id == root_id {
+			path := make([]*DBSignature, len(suffix))
+			for i := range suffix {
+				path[i] = suffix[len(suffix)-1-i]
+			}
+			paths = append(paths, path)
+			return
+		}
+		for _, signature := range parents[user_id] {
+			walk(signature.F_signer_id, append(suffix, signature))
+		}
+	}
+	walk(target_id, make([]*DBSignature, 0, 8))
+
+	return paths
+}
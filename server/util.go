@@ -2,14 +2,15 @@ package main
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	crand "crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
 	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
+	"github.com/fivebillionmph/be227a/protocol"
 	gss "github.com/fivebillionmph/gosimpleserver"
-	"math/rand"
 	"net/http"
 	"os"
 	"time"
@@ -53,28 +54,27 @@ func errorResponse(w http.ResponseWriter, status int, msg string) {
 	http.Error(w, msg, status)
 }
 
-func publicKeyToUserRequest(r *http.Request, server *gss.Server) (*DBUser, error) {
-	type json_request_type struct {
-		Public_key string `json:"public_key"`
-	}
-	json_request := json_request_type{}
-	err := requestJSONDecode(r, &json_request)
+/* also returns the request, whose key string and scheme preferences decide the challenge scheme */
+func publicKeyToUserRequest(r *http.Request, server *gss.Server) (*DBUser, *ChallengeRequest, error) {
+	challenge_request := ChallengeRequest{}
+	err := requestJSONDecode(r, &challenge_request)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	public_key, err := stringToPublicKey(json_request.Public_key)
+	public_key, err := stringToPublicKey(challenge_request.Public_key)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return DBUser__getByPublicKey(server.RequestDBConnection(), public_key)
+	user, err := DBUser__getByPublicKey(requestStorage(server), public_key)
+	return user, &challenge_request, err
 }
 
-func userChallengeResponse(w http.ResponseWriter, public_key *rsa.PublicKey, challenge_type string) error {
-	challenge, err := UserChallenge__new(public_key, challenge_type)
+func userChallengeResponse(w http.ResponseWriter, public_key crypto.PublicKey, challenge_type string, challenge_request *ChallengeRequest) error {
+	challenge, err := UserChallenge__new(public_key, challenge_type, challenge_request)
 	if err != nil {
-		errorResponse(w, 500, "Error sending challenge")
+		errorResponse(w, 400, "No acceptable challenge scheme")
 		return err
 	}
 	err = challenge.sendJSONResponse(w)
@@ -85,54 +85,132 @@ func userChallengeResponse(w http.ResponseWriter, public_key *rsa.PublicKey, cha
 	return nil
 }
 
-func stringToPublicKey(key_str string) (*rsa.PublicKey, error) {
-	block, _ := pem.Decode([]byte(key_str))
-	if block == nil {
-		return nil, errors.New("Invalid public key")
+/* accepts pkcs1 "RSA PUBLIC KEY" and pkix "PUBLIC KEY" pem blocks, and authorized_keys lines */
+func stringToPublicKey(key_str string) (crypto.PublicKey, error) {
+	if isSSHPublicKeyString(key_str) {
+		return sshStringToPublicKey(key_str)
 	}
-	return x509.ParsePKCS1PublicKey([]byte(block.Bytes))
+
+	return protocol.StringToPublicKey(key_str)
 }
 
-func derStringToPublicKey(der_str string) (*rsa.PublicKey, error) {
-	return x509.ParsePKCS1PublicKey([]byte(der_str))
+func checkPublicKeyType(public_key crypto.PublicKey) (crypto.PublicKey, error) {
+	switch public_key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+		return public_key, nil
+	default:
+		return nil, errors.New("Unsupported public key algorithm")
+	}
 }
 
-func publicKeyToString(key *rsa.PublicKey) (string, error) {
-	der_format := publicKeyToDerString(key)
-	pem := pem.EncodeToMemory(
-		&pem.Block{
-			Type:  "RSA PUBLIC KEY",
-			Bytes: []byte(der_format),
-		},
-	)
-	if pem == nil {
-		return "", errors.New("invalid public key")
+/* compares two pem public keys by their der encoding so formatting differences don't matter */
+func samePublicKeyString(a string, b string) bool {
+	key_a, err := stringToPublicKey(a)
+	if err != nil {
+		return false
 	}
-	return string(pem), nil
+	key_b, err := stringToPublicKey(b)
+	if err != nil {
+		return false
+	}
+	return publicKeyToDerString(key_a) == publicKeyToDerString(key_b)
 }
 
-func publicKeyToDerString(key *rsa.PublicKey) string {
-	return string(x509.MarshalPKCS1PublicKey(key))
+func derStringToPublicKey(der_str string) (crypto.PublicKey, error) {
+	rsa_public_key, err := x509.ParsePKCS1PublicKey([]byte(der_str))
+	if err == nil {
+		return rsa_public_key, nil
+	}
+
+	public_key, err := x509.ParsePKIXPublicKey([]byte(der_str))
+	if err != nil {
+		return nil, err
+	}
+	return checkPublicKeyType(public_key)
+}
+
+/* rsa keys stay pkcs1 so they match the keys stored before other algorithms were supported */
+func publicKeyToString(key crypto.PublicKey) (string, error) {
+	return protocol.PublicKeyToString(key)
+}
+
+/* returns an empty string for unsupported keys */
+func publicKeyToDerString(key crypto.PublicKey) string {
+	rsa_public_key, ok := key.(*rsa.PublicKey)
+	if ok {
+		return string(x509.MarshalPKCS1PublicKey(rsa_public_key))
+	}
+
+	_, err := checkPublicKeyType(key)
+	if err != nil {
+		return ""
+	}
+	der_bytes, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return ""
+	}
+	return string(der_bytes)
 }
 
-func verifyPublicKeySignature(public_key *rsa.PublicKey, message string, signature string) bool {
+func verifyPublicKeySignature(public_key crypto.PublicKey, message string, signature string) bool {
 	// message is the unencrypted string
 	// signature is the encrypted string hash signed by the public key
+	// any key type may also send an SSHSIG signature.
 
-	message_hash := sha256.Sum256([]byte(message))
+	if isSSHSignature(signature) {
+		return verifySSHSignature(public_key, message, signature)
+	}
 
-	err := rsa.VerifyPKCS1v15(public_key, crypto.SHA256, message_hash[:], []byte(signature))
+	return protocol.Verify(public_key, message, []byte(signature))
+}
 
-	return err == nil
+/* for signatures being submitted now, which may not use a refused legacy scheme */
+func verifyNewPublicKeySignature(public_key crypto.PublicKey, message string, signature string) bool {
+	if isSSHSignature(signature) {
+		return verifySSHSignature(public_key, message, signature)
+	}
+
+	scheme, ok := protocol.VerifyScheme(public_key, message, []byte(signature))
+	return ok && !(global_refuse_legacy_schemes && scheme == protocol.SIGNATURE_SCHEME_PKCS1V15)
 }
 
-func randomString(length int) string {
-	const alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+/* scheme is the negotiated rsa signature scheme, ssh signatures bring their own */
+func verifyPublicKeySignatureScheme(public_key crypto.PublicKey, message string, signature string, scheme string) bool {
+	if isSSHSignature(signature) {
+		return verifySSHSignature(public_key, message, signature)
+	}
 
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = alphabet[rand.Intn(len(alphabet))]
+	return protocol.VerifyWithScheme(public_key, message, []byte(signature), scheme)
+}
+
+/* signs with global_private_key so clients can check a message came from this server */
+func serverSign(message []byte) ([]byte, error) {
+	return protocol.Sign(global_private_key, string(message))
+}
+
+func serverVerify(message []byte, signature []byte) bool {
+	return protocol.VerifyWithScheme(&global_private_key.PublicKey, string(message), signature, protocol.SIGNATURE_SCHEME_PSS)
+}
+
+/* from crypto/rand, for anything that must not be guessable */
+func randomString(length int) (string, error) {
+	const alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	/* bytes at or above this would make the first characters more likely */
+	const limit = 256 - 256%len(alphabet)
+
+	b := make([]byte, 0, length)
+	buffer := make([]byte, length)
+	for len(b) < length {
+		_, err := crand.Read(buffer)
+		if err != nil {
+			return "", err
+		}
+		for _, c := range buffer {
+			if int(c) < limit && len(b) < length {
+				b = append(b, alphabet[int(c)%len(alphabet)])
+			}
+		}
 	}
 
-	return string(b)
+	return string(b), nil
 }
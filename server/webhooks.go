@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	gss "github.com/fivebillionmph/gosimpleserver"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * events are posted as json to every url in WEBHOOKS. each delivery is queued
+ * in the webhook_deliveries table first, so with mysql storage pending
+ * deliveries survive a restart. failed attempts are retried with exponential
+ * backoff until WEBHOOK_MAX_ATTEMPTS.
+ *
+ * receivers check X-Webhook-Signature, "sha256=" and the hex hmac-sha256 of
+ * "<X-Webhook-Timestamp>.<body>" keyed with WEBHOOK_SECRET.
+ *
+ * session events use the SESSION_EVENT_* names of the session stream.
+ */
+const WEBHOOK_EVENT_USER_REGISTER = "user_register"
+const WEBHOOK_EVENT_SIGNATURE_ADD = "signature_add"
+
+const WEBHOOK_SIGNATURE_HEADER = "X-Webhook-Signature"
+const WEBHOOK_TIMESTAMP_HEADER = "X-Webhook-Timestamp"
+const WEBHOOK_EVENT_HEADER = "X-Webhook-Event"
+const WEBHOOK_DELIVERY_HEADER = "X-Webhook-Delivery"
+
+const WEBHOOK_MAX_ATTEMPTS = 8
+const WEBHOOK_BACKOFF_BASE = 10  // seconds, doubled after every failed attempt
+const WEBHOOK_BACKOFF_MAX = 3600 // seconds
+const WEBHOOK_BATCH_SIZE = 50
+const WEBHOOK_TIMEOUT = 10 * time.Second
+const WEBHOOK_ERROR_MAX_LENGTH = 512
+
+/* set from WEBHOOKS, comma separated urls */
+var global_webhook_urls []string
+
+/* set from WEBHOOK_SECRET, required with WEBHOOKS */
+var global_webhook_secret []byte
+
+/* set from WEBHOOK_EVENTS, comma separated event types, empty sends all of them */
+var global_webhook_events map[string]bool
+
+/* nudges the dispatcher when something is queued, so it doesn't wait for the next tick */
+var global_webhook_wakeup = make(chan bool, 1)
+
+var global_webhook_client = &http.Client{Timeout: WEBHOOK_TIMEOUT}
+
+type WebhookPayload struct {
+	Event_type string      `json:"event_type"`
+	Timestamp  int         `json:"timestamp"`
+	Host_name  string      `json:"host_name"`
+	Data       interface{} `json:"data"`
+}
+
+func initWebhooks() error {
+	global_webhook_urls = make([]string, 0, 2)
+	global_webhook_events = make(map[string]bool)
+
+	for _, webhook_url := range strings.Split(os.Getenv("WEBHOOKS"), ",") {
+		webhook_url = strings.TrimSpace(webhook_url)
+		if webhook_url == "" {
+			continue
+		}
+		parsed_url, err := url.Parse(webhook_url)
+		if err != nil || (parsed_url.Scheme != "http" && parsed_url.Scheme != "https") || parsed_url.Host == "" {
+			return errors.New("invalid webhook url: " + webhook_url)
+		}
+		global_webhook_urls = append(global_webhook_urls, webhook_url)
+	}
+
+	global_webhook_secret = []byte(os.Getenv("WEBHOOK_SECRET"))
+	if len(global_webhook_urls) > 0 && len(global_webhook_secret) == 0 {
+		return errors.New("WEBHOOK_SECRET is required with WEBHOOKS")
+	}
+
+	for _, event_type := range strings.Split(os.Getenv("WEBHOOK_EVENTS"), ",") {
+		event_type = strings.TrimSpace(event_type)
+		if event_type == "" {
+			continue
+		}
+		switch event_type {
+		case WEBHOOK_EVENT_USER_REGISTER, WEBHOOK_EVENT_SIGNATURE_ADD, SESSION_EVENT_START, SESSION_EVENT_STOP, SESSION_EVENT_EXPIRE:
+			global_webhook_events[event_type] = true
+		default:
+			return errors.New("unknown webhook event: " + event_type)
+		}
+	}
+
+	return nil
+}
+
+func webhookPayloadSignature(timestamp_str string, payload []byte) string {
+	mac := hmac.New(sha256.New, global_webhook_secret)
+	mac.Write([]byte(timestamp_str + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+/* the delay before the next attempt after attempts have failed */
+func webhookBackoff(attempts int) int {
+	backoff := WEBHOOK_BACKOFF_BASE
+	for i := 1; i < attempts && backoff < WEBHOOK_BACKOFF_MAX; i++ {
+		backoff *= 2
+	}
+	if backoff > WEBHOOK_BACKOFF_MAX {
+		backoff = WEBHOOK_BACKOFF_MAX
+	}
+	return backoff
+}
+
+/*
+ * queues the event for every webhook. a failure is only logged, the
+ * registration, signature or session it's about still goes ahead.
+ */
+func webhookEnqueue(store Storage, event_type string, data interface{}) {
+	if len(global_webhook_urls) == 0 {
+		return
+	}
+	if len(global_webhook_events) > 0 && !global_webhook_events[event_type] {
+		return
+	}
+
+	payload, err := json.Marshal(&WebhookPayload{
+		Event_type: event_type,
+		Timestamp:  timestamp(),
+		Host_name:  global_host_name,
+		Data:       data,
+	})
+	if err != nil {
+		log.Println("webhook:", err)
+		return
+	}
+
+	for _, webhook_url := range global_webhook_urls {
+		_, err := DBWebhookDelivery__create(store, webhook_url, event_type, string(payload))
+		if err != nil {
+			log.Println("webhook:", err)
+		}
+	}
+
+	select {
+	case global_webhook_wakeup <- true:
+	default:
+	}
+}
+
+func webhookUserRegister(store Storage, db_user *DBUser) {
+	public_key_string, err := db_user.publicKeyString()
+	if err != nil {
+		return
+	}
+
+	webhookEnqueue(store, WEBHOOK_EVENT_USER_REGISTER, struct {
+		Id           int    `json:"id"`
+		Name         string `json:"name"`
+		Organization string `json:"organization"`
+		Public_key   string `json:"public_key"`
+	}{
+		db_user.F_id,
+		db_user.F_name,
+		db_user.F_organization,
+		public_key_string,
+	})
+}
+
+func webhookSignatureAdd(store Storage, db_signature *DBSignature, signer *DBUser, signee *DBUser) {
+	signer_public_key_string, err := signer.publicKeyString()
+	if err != nil {
+		return
+	}
+	signee_public_key_string, err := signee.publicKeyString()
+	if err != nil {
+		return
+	}
+
+	webhookEnqueue(store, WEBHOOK_EVENT_SIGNATURE_ADD, struct {
+		Id                int    `json:"id"`
+		Timestamp         int    `json:"timestamp"`
+		Signer_public_key string `json:"signer_public_key"`
+		Signee_public_key string `json:"signee_public_key"`
+		Message           string `json:"message"`
+		Signature         string `json:"signature"`
+	}{
+		db_signature.F_id,
+		db_signature.F_timestamp,
+		signer_public_key_string,
+		signee_public_key_string,
+		db_signature.F_message,
+		db_signature.base64Signature(),
+	})
+}
+
+/* the data is the same event the session stream sends */
+func webhookSession(store Storage, event_type string, session *UserSession) {
+	if len(global_webhook_urls) == 0 {
+		return
+	}
+
+	event, err := SessionEvent__new(event_type, session)
+	if err != nil {
+		return
+	}
+	webhookEnqueue(store, event_type, event)
+}
+
+/* posts the delivery once and records how it went */
+func (self *DBWebhookDelivery) attempt(store Storage) error {
+	now := timestamp()
+	status_code, err := self.post(now)
+
+	self.F_attempts++
+	self.F_last_attempt_timestamp = now
+	self.F_last_status_code = status_code
+	self.F_last_error = ""
+	if err != nil {
+		self.F_last_error = err.Error()
+		if len(self.F_last_error) > WEBHOOK_ERROR_MAX_LENGTH {
+			self.F_last_error = self.F_last_error[:WEBHOOK_ERROR_MAX_LENGTH]
+		}
+	}
+
+	switch {
+	case err == nil:
+		self.F_status = WEBHOOK_STATUS_DELIVERED
+	case self.F_attempts >= WEBHOOK_MAX_ATTEMPTS:
+		self.F_status = WEBHOOK_STATUS_FAILED
+	default:
+		self.F_next_attempt_timestamp = now + webhookBackoff(self.F_attempts)
+	}
+
+	return self.update(store)
+}
+
+/* any 2xx is a success */
+func (self *DBWebhookDelivery) post(now int) (int, error) {
+	request, err := http.NewRequest("POST", self.F_url, strings.NewReader(self.F_payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp_str := strconv.Itoa(now)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WEBHOOK_EVENT_HEADER, self.F_event_type)
+	request.Header.Set(WEBHOOK_DELIVERY_HEADER, strconv.Itoa(self.F_id))
+	request.Header.Set(WEBHOOK_TIMESTAMP_HEADER, timestamp_str)
+	request.Header.Set(WEBHOOK_SIGNATURE_HEADER, webhookPayloadSignature(timestamp_str, []byte(self.F_payload)))
+
+	res, err := global_webhook_client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, WEBHOOK_ERROR_MAX_LENGTH))
+		return res.StatusCode, errors.New(res.Status + ": " + string(bytes.TrimSpace(body)))
+	}
+	io.Copy(ioutil.Discard, res.Body)
+
+	return res.StatusCode, nil
+}
+
+/* attempts every delivery that's due, a batch at a time */
+func deliverWebhooks(store Storage) error {
+	for {
+		deliveries, err := DBWebhookDelivery__getDue(store, timestamp(), WEBHOOK_BATCH_SIZE)
+		if err != nil {
+			return err
+		}
+
+		for _, delivery := range deliveries {
+			err := delivery.attempt(store)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(deliveries) < WEBHOOK_BATCH_SIZE {
+			return nil
+		}
+	}
+}
+
+/* delivers what's due every interval, or sooner when something is queued */
+func startWebhookDispatcher(server *gss.Server, interval time.Duration) {
+	if len(global_webhook_urls) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			err := deliverWebhooks(requestStorage(server))
+			if err != nil {
+				log.Println("webhook:", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-global_webhook_wakeup:
+			}
+		}
+	}()
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const TEST_WEBHOOK_SECRET = "s3cret"
+
+type testWebhookRequest struct {
+	header http.Header
+	body   []byte
+	/* whether the signature header checked out against TEST_WEBHOOK_SECRET */
+	signed bool
+}
+
+/* records what it's sent and answers with the queued status codes, then 200 */
+type testWebhookReceiver struct {
+	mutex        sync.Mutex
+	requests     []testWebhookRequest
+	status_codes []int
+	server       *httptest.Server
+}
+
+func testWebhookReceiver__new(t *testing.T) *testWebhookReceiver {
+	receiver := &testWebhookReceiver{}
+	receiver.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte(TEST_WEBHOOK_SECRET))
+		mac.Write([]byte(r.Header.Get("X-Webhook-Timestamp") + "."))
+		mac.Write(body)
+		signed := hmac.Equal([]byte(r.Header.Get("X-Webhook-Signature")), []byte("sha256="+hex.EncodeToString(mac.Sum(nil))))
+
+		receiver.mutex.Lock()
+		defer receiver.mutex.Unlock()
+		receiver.requests = append(receiver.requests, testWebhookRequest{r.Header, body, signed})
+		if len(receiver.status_codes) > 0 {
+			status_code := receiver.status_codes[0]
+			receiver.status_codes = receiver.status_codes[1:]
+			w.WriteHeader(status_code)
+			w.Write([]byte("busy"))
+		}
+	}))
+	t.Cleanup(receiver.server.Close)
+	return receiver
+}
+
+func (self *testWebhookReceiver) fail(status_codes ...int) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.status_codes = append(self.status_codes, status_codes...)
+}
+
+func (self *testWebhookReceiver) received() []testWebhookRequest {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return append([]testWebhookRequest{}, self.requests...)
+}
+
+func testWebhooks(t *testing.T, webhooks string, events string) {
+	/* registered before Setenv so it runs after the variables are restored */
+	t.Cleanup(func() {
+		initWebhooks()
+	})
+	t.Setenv("WEBHOOKS", webhooks)
+	t.Setenv("WEBHOOK_SECRET", TEST_WEBHOOK_SECRET)
+	t.Setenv("WEBHOOK_EVENTS", events)
+	err := initWebhooks()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+/* the only delivery in the log, as it is now */
+func testWebhookDelivery(t *testing.T, store Storage) *DBWebhookDelivery {
+	deliveries, err := DBWebhookDelivery__getRecent(store, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("%d deliveries", len(deliveries))
+	}
+	return deliveries[0]
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		backoff  int
+	}{
+		{1, 10},
+		{2, 20},
+		{3, 40},
+		{4, 80},
+		{5, 160},
+		{6, 320},
+		{7, 640},
+		{8, 1280},
+		{9, 2560},
+		{10, 3600},
+		{11, 3600},
+		{64, 3600},
+	}
+	for _, test := range tests {
+		if webhookBackoff(test.attempts) != test.backoff {
+			t.Errorf("backoff after %d attempts is %d, want %d", test.attempts, webhookBackoff(test.attempts), test.backoff)
+		}
+	}
+}
+
+func TestWebhookPayloadSignature(t *testing.T) {
+	testWebhooks(t, "", "")
+
+	signature := webhookPayloadSignature("1700000000", []byte(`{"event_type":"user_register"}`))
+	if signature != "sha256=221b729354c24991f25a4f3a4bcec004524e7a0d9cae922c434a71bec530ce4c" {
+		t.Fatal("signature", signature)
+	}
+	if webhookPayloadSignature("1700000001", []byte(`{"event_type":"user_register"}`)) == signature {
+		t.Fatal("signature doesn't cover the timestamp")
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	test_server := testServer(t)
+	receiver := testWebhookReceiver__new(t)
+	testWebhooks(t, receiver.server.URL, "")
+	store := requestStorage(nil)
+
+	testClient(t, test_server.URL, "ed25519", "hooked")
+	delivery := testWebhookDelivery(t, store)
+	if delivery.F_status != WEBHOOK_STATUS_PENDING || delivery.F_event_type != WEBHOOK_EVENT_USER_REGISTER || delivery.F_url != receiver.server.URL {
+		t.Fatalf("queued %+v", delivery)
+	}
+
+	err := deliverWebhooks(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := receiver.received()
+	if len(requests) != 1 {
+		t.Fatalf("%d requests", len(requests))
+	}
+	request := requests[0]
+	if !request.signed {
+		t.Fatal("signature header doesn't verify")
+	}
+	if request.header.Get("X-Webhook-Event") != WEBHOOK_EVENT_USER_REGISTER || request.header.Get("X-Webhook-Delivery") != strconv.Itoa(delivery.F_id) || request.header.Get("Content-Type") != "application/json" {
+		t.Fatalf("headers %v", request.header)
+	}
+	payload := WebhookPayload{}
+	err = json.Unmarshal(request.body, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event_type != WEBHOOK_EVENT_USER_REGISTER || payload.Host_name != "test" || payload.Data.(map[string]interface{})["name"] != "hooked" {
+		t.Fatalf("payload %+v", payload)
+	}
+
+	delivery = testWebhookDelivery(t, store)
+	if delivery.F_status != WEBHOOK_STATUS_DELIVERED || delivery.F_attempts != 1 || delivery.F_last_status_code != 200 || delivery.F_last_error != "" {
+		t.Fatalf("delivered %+v", delivery)
+	}
+
+	/* delivered rows aren't sent again */
+	deliverWebhooks(store)
+	if len(receiver.received()) != 1 {
+		t.Fatal("delivered twice")
+	}
+}
+
+func TestWebhookEvents(t *testing.T) {
+	test_server := testServer(t)
+	receiver := testWebhookReceiver__new(t)
+	testWebhooks(t, receiver.server.URL, WEBHOOK_EVENT_SIGNATURE_ADD)
+	store := requestStorage(nil)
+
+	signer, _ := testClient(t, test_server.URL, "ed25519", "signer")
+	_, signee_public_key := testClient(t, test_server.URL, "ed25519", "signee")
+	testSign(t, signer, signee_public_key)
+
+	delivery := testWebhookDelivery(t, store)
+	if delivery.F_event_type != WEBHOOK_EVENT_SIGNATURE_ADD {
+		t.Fatalf("queued %+v", delivery)
+	}
+
+	t.Setenv("WEBHOOK_EVENTS", "bogus")
+	if initWebhooks() == nil {
+		t.Fatal("accepted an unknown event")
+	}
+	t.Setenv("WEBHOOK_EVENTS", "")
+	t.Setenv("WEBHOOK_SECRET", "")
+	if initWebhooks() == nil {
+		t.Fatal("accepted webhooks without a secret")
+	}
+}
+
+/* failed attempts wait out the backoff, then succeed or give up */
+func TestWebhookRetry(t *testing.T) {
+	testServer(t)
+	receiver := testWebhookReceiver__new(t)
+	testWebhooks(t, receiver.server.URL, "")
+	store := requestStorage(nil)
+
+	receiver.fail(503, 500)
+	webhookEnqueue(store, WEBHOOK_EVENT_USER_REGISTER, map[string]int{"id": 1})
+
+	for attempts := 1; attempts <= 2; attempts++ {
+		err := deliverWebhooks(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delivery := testWebhookDelivery(t, store)
+		if delivery.F_status != WEBHOOK_STATUS_PENDING || delivery.F_attempts != attempts || !strings.Contains(delivery.F_last_error, "busy") {
+			t.Fatalf("after attempt %d %+v", attempts, delivery)
+		}
+		if delivery.F_last_status_code != []int{503, 500}[attempts-1] {
+			t.Fatalf("attempt %d recorded status %d", attempts, delivery.F_last_status_code)
+		}
+		if delivery.F_next_attempt_timestamp != delivery.F_last_attempt_timestamp+webhookBackoff(attempts) {
+			t.Fatalf("attempt %d next at %d, last at %d", attempts, delivery.F_next_attempt_timestamp, delivery.F_last_attempt_timestamp)
+		}
+
+		/* not due yet */
+		deliverWebhooks(store)
+		if len(receiver.received()) != attempts {
+			t.Fatalf("retried attempt %d before its backoff", attempts)
+		}
+
+		delivery.F_next_attempt_timestamp = timestamp()
+		store.webhookDeliveryUpdate(delivery)
+	}
+
+	deliverWebhooks(store)
+	delivery := testWebhookDelivery(t, store)
+	if delivery.F_status != WEBHOOK_STATUS_DELIVERED || delivery.F_attempts != 3 || delivery.F_last_status_code != 200 || delivery.F_last_error != "" {
+		t.Fatalf("after retries %+v", delivery)
+	}
+	for _, request := range receiver.received() {
+		if !request.signed || request.header.Get("X-Webhook-Delivery") != strconv.Itoa(delivery.F_id) {
+			t.Fatal("retry sent a different delivery")
+		}
+	}
+}
+
+func TestWebhookGiveUp(t *testing.T) {
+	testServer(t)
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	testWebhooks(t, unreachable.URL, "")
+	store := requestStorage(nil)
+
+	webhookEnqueue(store, WEBHOOK_EVENT_USER_REGISTER, map[string]int{"id": 1})
+	for attempts := 1; attempts <= WEBHOOK_MAX_ATTEMPTS; attempts++ {
+		deliverWebhooks(store)
+		delivery := testWebhookDelivery(t, store)
+		if delivery.F_attempts != attempts || delivery.F_last_status_code != 0 || delivery.F_last_error == "" {
+			t.Fatalf("after attempt %d %+v", attempts, delivery)
+		}
+		if attempts < WEBHOOK_MAX_ATTEMPTS && delivery.F_status != WEBHOOK_STATUS_PENDING {
+			t.Fatalf("gave up after %d attempts", attempts)
+		}
+		delivery.F_next_attempt_timestamp = 0
+		store.webhookDeliveryUpdate(delivery)
+	}
+
+	delivery := testWebhookDelivery(t, store)
+	if delivery.F_status != WEBHOOK_STATUS_FAILED {
+		t.Fatalf("after %d attempts %+v", WEBHOOK_MAX_ATTEMPTS, delivery)
+	}
+	deliverWebhooks(store)
+	if testWebhookDelivery(t, store).F_attempts != WEBHOOK_MAX_ATTEMPTS {
+		t.Fatal("attempted a failed delivery")
+	}
+
+	/* errors are cut to WEBHOOK_ERROR_MAX_LENGTH */
+	verbose := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		w.Write([]byte(strings.Repeat("x", 2*WEBHOOK_ERROR_MAX_LENGTH)))
+	}))
+	defer verbose.Close()
+	testWebhooks(t, verbose.URL, "")
+	webhookEnqueue(store, WEBHOOK_EVENT_USER_REGISTER, map[string]int{"id": 2})
+	deliverWebhooks(store)
+	deliveries, _ := DBWebhookDelivery__getRecent(store, 1)
+	if deliveries[0].F_last_status_code != 500 || len(deliveries[0].F_last_error) != WEBHOOK_ERROR_MAX_LENGTH {
+		t.Fatalf("error %d bytes, status %d", len(deliveries[0].F_last_error), deliveries[0].F_last_status_code)
+	}
+}
+
+func TestWebhookDeliveryLog(t *testing.T) {
+	test_server := testServer(t)
+	receiver := testWebhookReceiver__new(t)
+	testWebhooks(t, receiver.server.URL, "")
+	store := requestStorage(nil)
+
+	admin, admin_public_key := testClient(t, test_server.URL, "ed25519", "")
+	global_admin_public_key, _ = stringToPublicKey(admin_public_key)
+	defer initAdmin()
+
+	receiver.fail(503)
+	for i := 1; i <= 3; i++ {
+		webhookEnqueue(store, WEBHOOK_EVENT_USER_REGISTER, map[string]int{"id": i})
+	}
+	deliverWebhooks(store)
+
+	deliveries, err := admin.AdminWebhookDeliveries(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 {
+		t.Fatalf("%d deliveries listed with a limit of 2", len(deliveries))
+	}
+	if deliveries[0].Id <= deliveries[1].Id {
+		t.Fatal("deliveries not listed newest first")
+	}
+
+	deliveries, err = admin.AdminWebhookDeliveries(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 3 {
+		t.Fatalf("%d deliveries listed", len(deliveries))
+	}
+	oldest := deliveries[2]
+	if oldest.Status != WEBHOOK_STATUS_PENDING || oldest.Attempts != 1 || oldest.Last_status_code != 503 || oldest.Url != receiver.server.URL || oldest.Event_type != WEBHOOK_EVENT_USER_REGISTER {
+		t.Fatalf("oldest delivery %+v", oldest)
+	}
+	for _, delivery := range deliveries[:2] {
+		if delivery.Status != WEBHOOK_STATUS_DELIVERED || delivery.Last_status_code != 200 {
+			t.Fatalf("delivery %+v", delivery)
+		}
+	}
+
+	other, _ := testClient(t, test_server.URL, "ed25519", "other")
+	if _, err := other.AdminWebhookDeliveries(0); err == nil {
+		t.Fatal("listed webhook deliveries without an admin key")
+	}
+}